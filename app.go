@@ -33,5 +33,7 @@ func main() {
 		log.Fatalf("failed to create new server: %s", err)
 	}
 
-	log.Fatalf("fatal server error: %s", srv.Serve())
+	if err := srv.Serve(); err != nil {
+		log.Fatalf("fatal server error: %s", err)
+	}
 }
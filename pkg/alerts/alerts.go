@@ -2,6 +2,8 @@ package alerts
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -18,9 +20,108 @@ import (
 // Monitor combines an Alert, a Check, and an Interval.
 // It has a single method Run that calls Check at every Interval.
 type Monitor struct {
+	Name string
+	// Source names the DataSource the Check queries, for metrics.
+	Source   string
 	Alert    Alert
 	Check    Check
 	Interval time.Duration
+
+	// For is how long a Check must keep failing before the Monitor fires.
+	// While it waits the Monitor is Pending and does not call Alert.
+	For time.Duration
+	// MaxBackoff turns on exponential backoff between failed Checks,
+	// doubling the wait from Interval up to MaxBackoff. Zero disables it.
+	MaxBackoff time.Duration
+	// Align schedules Checks on multiples of Interval rather than counting
+	// from when the Monitor started, so Monitors with the same Interval
+	// check together and can share their queries. Backoff isn't aligned.
+	Align bool
+	// Resolve is optionally called when a firing Monitor's Check passes again.
+	Resolve func(ctx context.Context)
+	// Gate is asked before every Check if it is set. Returning false skips
+	// the Check, e.g. on instances that don't own scheduling.
+	Gate func() bool
+	// OnChange is optionally called with each State transition.
+	OnChange func(from, to State)
+	// OnObserve is optionally called with the Monitor's Progress after
+	// every Check that judged the data, e.g. to share its State with
+	// composite monitors on other instances or to Restore it later.
+	OnObserve func(p Progress)
+	// Counts is optionally asked whether the Monitor counts toward the
+	// alerts_firing gauge here, e.g. only on the instance that owns it, so
+	// that the gauge can be summed across instances that all load it.
+	// Monitors count by default.
+	Counts func() bool
+	// Clock defaults to the wall clock.
+	Clock Clock
+
+	mu       sync.Mutex
+	state    State
+	since    time.Time // start of the current run of failed Checks
+	failures int       // number of consecutive failed Checks
+	counted  bool      // whether the Monitor is in the alerts_firing gauge
+}
+
+// State is where a Monitor is in its alerting lifecycle.
+type State int
+
+const (
+	// StateOK means the last Check passed.
+	StateOK State = iota
+	// StatePending means Checks are failing but not yet for the Monitor's For.
+	StatePending
+	// StateFiring means Checks have failed for at least For and Alert is called.
+	StateFiring
+)
+
+// String implements fmt.Stringer.
+func (s State) String() string {
+	switch s {
+	case StateOK:
+		return "ok"
+	case StatePending:
+		return "pending"
+	case StateFiring:
+		return "firing"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseState parses a State's String.
+func ParseState(s string) (State, error) {
+	for _, state := range []State{StateOK, StatePending, StateFiring} {
+		if state.String() == s {
+			return state, nil
+		}
+	}
+	return StateOK, fmt.Errorf("unknown state %q", s)
+}
+
+// Progress is where a Monitor is in its alerting lifecycle: its State
+// and the run of failed Checks that led there.
+type Progress struct {
+	State    State
+	Since    time.Time // start of the current run of failed Checks
+	Failures int       // number of consecutive failed Checks
+}
+
+// Progress returns the Monitor's current Progress.
+func (m *Monitor) Progress() Progress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Progress{State: m.state, Since: m.since, Failures: m.failures}
+}
+
+// Restore sets the Monitor's Progress, e.g. to carry on where a previous
+// run of the Monitor left off. A pending Monitor keeps counting its For
+// from Since.
+func (m *Monitor) Restore(p Progress) {
+	m.mu.Lock()
+	m.state, m.since, m.failures = p.State, p.Since, p.Failures
+	m.mu.Unlock()
+	m.recount()
 }
 
 // Alert is called when a Check returns false.
@@ -41,30 +142,211 @@ type Check func(ctx context.Context) (bool, error)
 type Siren struct {
 	sync.Mutex
 	monitors []*Monitor
+	cancels  map[string]context.CancelFunc
+
+	// Clock is handed to every added Monitor that doesn't have its own.
+	Clock Clock
+	// Gate is bound to every added Monitor that doesn't have its own.
+	Gate func(m *Monitor) bool
+	// External keeps the Siren from running added Monitors itself, for
+	// when something else schedules their Checks by calling Evaluate.
+	External bool
 }
 
-// Add adds a Monitor to the Siren and starts the Monitor.
+// Add adds a Monitor to the Siren and starts the Monitor, unless the
+// Siren is External. Monitor names must be unique within a Siren.
 func (s *Siren) Add(ctx context.Context, mon *Monitor) error {
 	s.Lock()
+	defer s.Unlock()
+
+	for _, m := range s.monitors {
+		if m.Name == mon.Name {
+			return fmt.Errorf("ErrDuplicateMonitor: %q", mon.Name)
+		}
+	}
+	if mon.Clock == nil {
+		mon.Clock = s.Clock
+	}
+	if mon.Gate == nil && s.Gate != nil {
+		gate := s.Gate
+		mon.Gate = func() bool { return gate(mon) }
+	}
+
 	s.monitors = append(s.monitors, mon)
-	s.Unlock()
+	monitorsLoaded.Set(float64(len(s.monitors)))
+	if s.External {
+		return nil
+	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	if s.cancels == nil {
+		s.cancels = map[string]context.CancelFunc{}
+	}
+	s.cancels[mon.Name] = cancel
 	go mon.Run(ctx)
 
 	return nil
 }
 
-// Run starts a monitor and listens for context cancellations
-// TODO: consider exponential backoff upon failed checks
+// Get returns the named Monitor, or nil if the Siren doesn't have it.
+func (s *Siren) Get(name string) *Monitor {
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range s.monitors {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Remove stops the named Monitor and removes it from the Siren.
+// It returns false if there was no such Monitor.
+func (s *Siren) Remove(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, m := range s.monitors {
+		if m.Name != name {
+			continue
+		}
+		if cancel, ok := s.cancels[name]; ok {
+			cancel()
+			delete(s.cancels, name)
+		}
+		m.uncount()
+		s.monitors = append(s.monitors[:i], s.monitors[i+1:]...)
+		monitorsLoaded.Set(float64(len(s.monitors)))
+		return true
+	}
+	return false
+}
+
+// Monitors returns a snapshot of the Siren's Monitors.
+func (s *Siren) Monitors() []*Monitor {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*Monitor(nil), s.monitors...)
+}
+
+// Run starts a monitor and blocks until its context is cancelled.
 func (m *Monitor) Run(ctx context.Context) error {
-	// start running the monitor
+	clock := clockOrDefault(m.Clock)
 	for {
 		// run check once at the beginning and then every mon.Interval
-		ok, err := m.Check(ctx)
-		if !ok {
-			// alert when check fails
-			go m.Alert(ctx, err)
+		if m.Gate == nil || m.Gate() {
+			m.Evaluate(ctx)
+		} else {
+			// another instance may have taken the Monitor over
+			m.recount()
+		}
+		wait := m.wait()
+		if m.Align && wait == m.Interval {
+			now := clock.Now()
+			wait = now.Truncate(wait).Add(wait).Sub(now)
+		}
+		due := clock.Now().Add(wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(wait):
+			schedulerLag.Observe(since(clock, due))
 		}
-		time.Sleep(m.Interval)
 	}
 }
+
+// State returns the Monitor's current State.
+func (m *Monitor) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Evaluate runs the Check once and calls Alert or Resolve as the
+// resulting state transition requires. It returns the Monitor's new State
+// and the Check's error. Run calls it every Interval; schedulers that run
+// Checks themselves, like the job queue, call it directly.
+func (m *Monitor) Evaluate(ctx context.Context) (State, error) {
+	clock := clockOrDefault(m.Clock)
+	start := clock.Now()
+	ok, err := m.Check(withBatching(ctx))
+	checkDuration.WithLabelValues(m.Name, m.Source).Observe(since(clock, start))
+	checkResults.WithLabelValues(m.Name, result(ok, err)).Inc()
+	if errors.Is(err, ErrSuppressed) || errors.Is(err, ErrUnknown) {
+		return m.State(), err
+	}
+	if ctx.Err() != nil {
+		// the Monitor was stopped mid-check, e.g. on shutdown, so the
+		// Check never got to judge the data
+		return m.State(), ctx.Err()
+	}
+
+	from, to := m.observe(clock.Now(), ok)
+	m.recount()
+	if from != to && m.OnChange != nil {
+		m.OnChange(from, to)
+	}
+	if m.OnObserve != nil {
+		m.OnObserve(m.Progress())
+	}
+	switch {
+	case to == StateFiring:
+		// alert on every failed check once firing
+		go m.Alert(ctx, err)
+	case from == StateFiring && to == StateOK && m.Resolve != nil:
+		go m.Resolve(ctx)
+	}
+	return to, err
+}
+
+// observe records the result of a Check made at now and returns the
+// Monitor's state before and after it.
+func (m *Monitor) observe(now time.Time, ok bool) (from, to State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from = m.state
+	if ok {
+		m.failures = 0
+		m.state = StateOK
+		return from, m.state
+	}
+
+	if m.failures == 0 {
+		m.since = now
+	}
+	m.failures++
+	if now.Sub(m.since) >= m.For {
+		m.state = StateFiring
+	} else {
+		m.state = StatePending
+	}
+	return from, m.state
+}
+
+// wait returns how long to wait before the next Check, backing off
+// exponentially after consecutive failures if MaxBackoff is set.
+func (m *Monitor) wait() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.Interval
+	if m.MaxBackoff <= 0 {
+		return d
+	}
+	for i := 1; i < m.failures && d < m.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > m.MaxBackoff {
+		d = m.MaxBackoff
+	}
+	return d
+}
+
+// clockOrDefault returns c, or the wall clock if c is nil.
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
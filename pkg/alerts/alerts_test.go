@@ -2,28 +2,40 @@ package alerts
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 )
 
+// epoch is the time every FakeClock in these tests starts at.
+var epoch = time.Date(2022, 9, 9, 12, 0, 0, 0, time.UTC)
+
 func TestAlerts(t *testing.T) {
 	t.Run("should add and start an influx monitor", func(t *testing.T) {
+		config, err := InfluxConfigFromEnv()
+		if err != nil || config.Validate() != nil {
+			t.Skip("INFLUX_URL, INFLUX_TOKEN and INFLUX_ORGID are required for the influx monitor test")
+		}
 		is := is.New(t)
-		ctx := context.Background()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-		ic, err := NewInfluxClient(ctx)
+		ic, err := NewInfluxClient(config)
 		is.NoErr(err)
+		defer ic.Close()
 
-		query := `from(bucket: "growmon")
-		|> range(start: -10000, stop: now())
-		|> filter(fn: (r) => r["_measurement"] == "STBProto")
-		|> filter(fn: (r) => r["_field"] == "heat_index" or r["_field"] == "humidity" or r["_field"] == "temperature" or r["_field"] == "uuid")
-		|> filter(fn: (r) => r["UUID"] == "UUID: 00-00-01")
-		|> aggregateWindow(every: 30m, fn: mean, createEmpty: false)
-		|> yield(name: "mean")`
+		query, err := BuiltinTemplates["device"].Render(map[string]json.RawMessage{
+			"device": json.RawMessage(`"UUID: 00-00-01"`),
+			"fields": json.RawMessage(`["heat_index", "humidity", "temperature", "uuid"]`),
+			"window": json.RawMessage(`"168h"`),
+			"every":  json.RawMessage(`"30m"`),
+		})
+		is.NoErr(err)
 
 		mon, err := ic.create(ctx, query)
 		is.NoErr(err)
@@ -39,28 +51,375 @@ func TestAlerts(t *testing.T) {
 
 	t.Run("should call alert on fail", func(t *testing.T) {
 		is := is.New(t)
-		ctx := context.Background()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-		wg := sync.WaitGroup{}
-		called := 0
+		alerted := make(chan error, 1)
 		mon := &Monitor{
 			Alert: func(ctx context.Context, err error) {
-				called++
-				is.True(err.Error() == "ErrMock")
-				wg.Done()
+				alerted <- err
 			},
 			Check: func(ctx context.Context) (bool, error) {
-				wg.Add(1)
 				return false, fmt.Errorf("ErrMock")
 			},
+			Interval: time.Minute,
 		}
 
 		s := &Siren{
 			monitors: []*Monitor{},
+			Clock:    NewFakeClock(epoch),
 		}
 
 		err := s.Add(ctx, mon)
 		is.NoErr(err)
-		wg.Wait()
+		is.Equal((<-alerted).Error(), "ErrMock")
+	})
+
+	t.Run("should keep its state when stopped mid-check", func(t *testing.T) {
+		is := is.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		mon := &Monitor{
+			Alert: func(ctx context.Context, err error) {
+				t.Errorf("alerted on a cancelled check: %v", err)
+			},
+			Check: func(ctx context.Context) (bool, error) {
+				cancel()
+				return false, ctx.Err()
+			},
+			Clock: NewFakeClock(epoch),
+		}
+
+		state, err := mon.Evaluate(ctx)
+		is.True(errors.Is(err, context.Canceled))
+		is.Equal(state, StateOK)
+	})
+}
+
+func TestSiren(t *testing.T) {
+	t.Run("should only check monitors its gate allows", func(t *testing.T) {
+		is := is.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		clock := NewFakeClock(epoch)
+		leader := make(chan bool, 1)
+		leader <- false
+		s := &Siren{
+			Clock: clock,
+			Gate: func(m *Monitor) bool {
+				ok := <-leader
+				leader <- ok
+				return ok
+			},
+		}
+		sc := &script{clock: clock}
+		is.NoErr(s.Add(ctx, &Monitor{Name: "gated", Check: sc.Check, Interval: time.Minute}))
+
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
+		clock.BlockUntil(1)
+		sc.mu.Lock()
+		is.Equal(len(sc.calls), 0) // not leader, never checked
+		sc.mu.Unlock()
+
+		<-leader
+		leader <- true
+		clock.Advance(time.Minute)
+		clock.BlockUntil(1)
+		sc.mu.Lock()
+		is.Equal(sc.calls, []time.Duration{2 * time.Minute})
+		sc.mu.Unlock()
+	})
+
+	t.Run("should reject duplicate names and remove monitors", func(t *testing.T) {
+		is := is.New(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		clock := NewFakeClock(epoch)
+		s := &Siren{Clock: clock}
+		sc := &script{clock: clock}
+		is.NoErr(s.Add(ctx, &Monitor{Name: "tent", Check: sc.Check, Interval: time.Minute}))
+		is.True(s.Add(ctx, &Monitor{Name: "tent", Check: sc.Check}) != nil)
+		is.Equal(len(s.Monitors()), 1)
+
+		clock.BlockUntil(1)
+		is.True(s.Remove("tent"))
+		is.True(!s.Remove("tent"))
+		is.Equal(len(s.Monitors()), 0)
+	})
+}
+
+// script is a fake Check that returns results in order, then passes
+// forever. It records the fake time of every call.
+type script struct {
+	mu      sync.Mutex
+	clock   *FakeClock
+	results []bool
+	calls   []time.Duration // offset from epoch of each call
+}
+
+func (s *script) Check(ctx context.Context) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, s.clock.Now().Sub(epoch))
+	if len(s.results) == 0 {
+		return true, nil
+	}
+	ok := s.results[0]
+	s.results = s.results[1:]
+	if !ok {
+		return false, fmt.Errorf("ErrScripted")
+	}
+	return true, nil
+}
+
+// drive runs mon on clock, advancing a minute at a time until the
+// Check has been called n times, and returns the script's call offsets.
+func drive(t *testing.T, mon *Monitor, clock *FakeClock, sc *script, n int) []time.Duration {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		mon.Run(ctx)
+		close(done)
+	}()
+
+	for i := 0; ; i++ {
+		clock.BlockUntil(1)
+		sc.mu.Lock()
+		calls := len(sc.calls)
+		sc.mu.Unlock()
+		if calls >= n {
+			break
+		}
+		if i > 10000 {
+			t.Fatalf("monitor made only %d of %d checks", calls, n)
+		}
+		clock.Advance(time.Minute)
+	}
+	cancel()
+	clock.Advance(time.Hour) // release the final wait
+	<-done
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.calls
+}
+
+func TestMonitorTiming(t *testing.T) {
+	m := time.Minute
+	tests := []struct {
+		name       string
+		start      time.Duration // offset from epoch the monitor starts at
+		interval   time.Duration
+		maxBackoff time.Duration
+		align      bool
+		results    []bool
+		want       []time.Duration
+	}{
+		{
+			name:     "checks every interval",
+			interval: 5 * m,
+			results:  []bool{true, false, true},
+			want:     []time.Duration{0, 5 * m, 10 * m, 15 * m},
+		},
+		{
+			name:     "no backoff without MaxBackoff",
+			interval: 2 * m,
+			results:  []bool{false, false, false},
+			want:     []time.Duration{0, 2 * m, 4 * m, 6 * m},
+		},
+		{
+			name:       "backs off exponentially up to MaxBackoff",
+			interval:   m,
+			maxBackoff: 4 * m,
+			results:    []bool{false, false, false, false, true},
+			want:       []time.Duration{0, 1 * m, 3 * m, 7 * m, 11 * m, 12 * m},
+		},
+		{
+			name:       "resets backoff after a pass",
+			interval:   m,
+			maxBackoff: 8 * m,
+			results:    []bool{false, false, true, false},
+			want:       []time.Duration{0, 1 * m, 3 * m, 4 * m, 5 * m},
+		},
+		{
+			name:     "aligns checks to multiples of the interval",
+			start:    2 * m,
+			interval: 5 * m,
+			align:    true,
+			results:  []bool{true, true},
+			want:     []time.Duration{2 * m, 5 * m, 10 * m, 15 * m},
+		},
+		{
+			name:       "doesn't align backoff",
+			start:      2 * m,
+			interval:   2 * m,
+			maxBackoff: 8 * m,
+			align:      true,
+			results:    []bool{false, false, true},
+			want:       []time.Duration{2 * m, 4 * m, 8 * m, 10 * m},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			clock := NewFakeClock(epoch.Add(tt.start))
+			sc := &script{clock: clock, results: tt.results}
+			mon := &Monitor{
+				Alert:      func(ctx context.Context, err error) {},
+				Check:      sc.Check,
+				Interval:   tt.interval,
+				MaxBackoff: tt.maxBackoff,
+				Align:      tt.align,
+				Clock:      clock,
+			}
+			is.Equal(drive(t, mon, clock, sc, len(tt.want)), tt.want)
+		})
+	}
+}
+
+func TestMonitorStates(t *testing.T) {
+	m := time.Minute
+	type step struct {
+		at   time.Duration
+		ok   bool
+		want State
+	}
+	tests := []struct {
+		name  string
+		hold  time.Duration
+		steps []step
+	}{
+		{
+			name: "fires immediately without a hold",
+			steps: []step{
+				{0, true, StateOK},
+				{m, false, StateFiring},
+				{2 * m, true, StateOK},
+			},
+		},
+		{
+			name: "pends until the hold has passed",
+			hold: 10 * m,
+			steps: []step{
+				{0, false, StatePending},
+				{5 * m, false, StatePending},
+				{10 * m, false, StateFiring},
+				{15 * m, false, StateFiring},
+				{20 * m, true, StateOK},
+			},
+		},
+		{
+			name: "a pass resets the hold",
+			hold: 10 * m,
+			steps: []step{
+				{0, false, StatePending},
+				{5 * m, true, StateOK},
+				{10 * m, false, StatePending},
+				{15 * m, false, StatePending},
+				{20 * m, false, StateFiring},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			mon := &Monitor{For: tt.hold}
+			for _, st := range tt.steps {
+				_, to := mon.observe(epoch.Add(st.at), st.ok)
+				is.Equal(to, st.want)
+			}
+		})
+	}
+}
+
+func TestMonitorAlertsAndResolves(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := NewFakeClock(epoch)
+	src := NewMemorySource()
+	series := Series{Measurement: "STBProto", Field: "temperature"}
+	src.Set("q", series)
+
+	alerted := make(chan error, 10)
+	resolved := make(chan struct{}, 10)
+	changes := make(chan State, 10)
+	rule := &Rule{Source: src, Query: "q", Condition: Fresh(10 * time.Minute), Clock: clock}
+	mon := &Monitor{
+		Alert:    func(ctx context.Context, err error) { alerted <- err },
+		Resolve:  func(ctx context.Context) { resolved <- struct{}{} },
+		OnChange: func(from, to State) { changes <- to },
+		Check:    rule.Check,
+		Interval: time.Minute,
+		Clock:    clock,
+	}
+	go mon.Run(ctx)
+
+	// no points at all, so the first check fires
+	is.Equal((<-alerted).Error(), "no data in the last 10m0s")
+	clock.BlockUntil(1)
+	is.Equal(mon.State(), StateFiring)
+
+	// fresh data resolves it on the next tick
+	series.Points = []Point{{Time: epoch.Add(time.Minute), Value: 24}}
+	src.Set("q", series)
+	clock.Advance(time.Minute)
+	<-resolved
+	clock.BlockUntil(1)
+	is.Equal(mon.State(), StateOK)
+	is.Equal(src.Calls(), 2)
+	is.Equal(<-changes, StateFiring)
+	is.Equal(<-changes, StateOK)
+}
+
+func TestMonitorRestore(t *testing.T) {
+	t.Run("should resolve a restored firing monitor when it passes", func(t *testing.T) {
+		is := is.New(t)
+		resolved := make(chan struct{}, 1)
+		var observed []Progress
+		mon := &Monitor{
+			Check:     func(ctx context.Context) (bool, error) { return true, nil },
+			Resolve:   func(ctx context.Context) { resolved <- struct{}{} },
+			OnObserve: func(p Progress) { observed = append(observed, p) },
+			Clock:     NewFakeClock(epoch),
+		}
+		mon.Restore(Progress{State: StateFiring, Since: epoch.Add(-time.Hour), Failures: 4})
+
+		state, err := mon.Evaluate(context.Background())
+		is.NoErr(err)
+		is.Equal(state, StateOK)
+		<-resolved
+		is.Equal(observed, []Progress{{State: StateOK, Since: epoch.Add(-time.Hour)}})
+	})
+
+	t.Run("should keep counting a restored hold", func(t *testing.T) {
+		is := is.New(t)
+		mon := &Monitor{For: 10 * time.Minute}
+		mon.Restore(Progress{State: StatePending, Since: epoch, Failures: 2})
+		_, to := mon.observe(epoch.Add(10*time.Minute), false)
+		is.Equal(to, StateFiring)
+		is.Equal(mon.Progress().Failures, 3)
+	})
+
+	t.Run("should observe every judged check, not just transitions", func(t *testing.T) {
+		is := is.New(t)
+		observed := 0
+		mon := &Monitor{
+			Check:     func(ctx context.Context) (bool, error) { return true, nil },
+			OnObserve: func(p Progress) { observed++ },
+			Clock:     NewFakeClock(epoch),
+		}
+		for i := 0; i < 3; i++ {
+			_, err := mon.Evaluate(context.Background())
+			is.NoErr(err)
+		}
+		is.Equal(observed, 3)
 	})
 }
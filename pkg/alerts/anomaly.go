@@ -0,0 +1,184 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Anomaly methods.
+const (
+	// MethodZScore compares the latest value with the mean and standard
+	// deviation of the history, or of the same time in earlier seasons.
+	MethodZScore = "zscore"
+	// MethodEWMA compares the latest value with an exponentially weighted
+	// moving mean and variance of the history, so recent points count most.
+	MethodEWMA = "ewma"
+)
+
+// Anomaly fails when the latest value of Field strays from the baseline
+// learned from the earlier Points in the same Series. The monitor's query
+// sets how much history there is to learn from, e.g. range(start: -7d).
+type Anomaly struct {
+	Field string `json:"field"`
+	// Method is zscore or ewma. It defaults to zscore.
+	Method string `json:"method,omitempty"`
+	// Sensitivity is how many standard deviations from the baseline the
+	// latest value may be. It defaults to 3; lower is more sensitive.
+	Sensitivity float64 `json:"sensitivity,omitempty"`
+	// Season limits a zscore baseline to Points at the same phase of an
+	// earlier season, e.g. "24h" for the same time on previous days.
+	Season Duration `json:"season,omitempty"`
+	// Tolerance is how close to the same phase a seasonal Point must be.
+	// It defaults to 30m.
+	Tolerance Duration `json:"tolerance,omitempty"`
+	// Alpha is the EWMA smoothing factor in (0, 1]. It defaults to 0.3.
+	Alpha float64 `json:"alpha,omitempty"`
+	// Floor is the smallest distance from the baseline, in the field's own
+	// units, that counts as an anomaly. It keeps a flat history from
+	// flagging every small change.
+	Floor float64 `json:"floor,omitempty"`
+	// MinPoints is how many baseline Points are needed before judging.
+	// It defaults to 10.
+	MinPoints int `json:"minPoints,omitempty"`
+}
+
+// Validate reports whether the Anomaly can be evaluated, and fills in defaults.
+func (a *Anomaly) Validate() error {
+	if a.Field == "" {
+		return fmt.Errorf("anomaly needs a field")
+	}
+	switch a.Method {
+	case "":
+		a.Method = MethodZScore
+	case MethodZScore, MethodEWMA:
+	default:
+		return fmt.Errorf("anomaly method must be %s or %s, not %q", MethodZScore, MethodEWMA, a.Method)
+	}
+	if a.Sensitivity < 0 || a.Alpha < 0 || a.Alpha > 1 || a.Floor < 0 || a.MinPoints < 0 {
+		return fmt.Errorf("anomaly sensitivity, alpha, floor and minPoints must not be negative, and alpha is at most 1")
+	}
+	if a.Season < 0 || a.Tolerance < 0 {
+		return fmt.Errorf("anomaly season and tolerance must not be negative")
+	}
+	if a.Season > 0 && a.Method != MethodZScore {
+		return fmt.Errorf("anomaly season only applies to the %s method", MethodZScore)
+	}
+	if a.Sensitivity == 0 {
+		a.Sensitivity = 3
+	}
+	if a.Alpha == 0 {
+		a.Alpha = 0.3
+	}
+	if a.Tolerance == 0 {
+		a.Tolerance = Duration(30 * time.Minute)
+	}
+	if a.MinPoints == 0 {
+		a.MinPoints = 10
+	}
+	return nil
+}
+
+// Condition returns the Anomaly as a Condition.
+func (a *Anomaly) Condition() Condition {
+	return func(now time.Time, series []Series) (bool, error) {
+		found := false
+		for _, s := range series {
+			if s.Field != a.Field || len(s.Points) == 0 {
+				continue
+			}
+			last := s.Points[len(s.Points)-1]
+			mean, std, n := a.baseline(s.Points[:len(s.Points)-1], last.Time)
+			if n < a.MinPoints {
+				continue
+			}
+			found = true
+			spread := a.Sensitivity * std
+			if spread < a.Floor {
+				spread = a.Floor
+			}
+			if math.Abs(last.Value-mean) <= spread {
+				continue
+			}
+			min, max := mean-spread, mean+spread
+			z := math.Inf(1)
+			if std > 0 {
+				z = (last.Value - mean) / std
+			}
+			return false, &Violation{
+				Kind:   "anomaly",
+				Field:  a.Field,
+				Tags:   s.Tags,
+				Time:   last.Time,
+				Value:  last.Value,
+				Raw:    last.Raw,
+				Min:    &min,
+				Max:    &max,
+				Reason: fmt.Sprintf("%s is %g, expected %.3g to %.3g (%.1f standard deviations from %.3g)", a.Field, last.Value, min, max, z, mean),
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("not enough %s history for a baseline, need %d points", a.Field, a.MinPoints)
+		}
+		return true, nil
+	}
+}
+
+// baseline returns the expected mean and standard deviation at t learned
+// from history, and how many Points it was learned from.
+func (a *Anomaly) baseline(history []Point, t time.Time) (mean, std float64, n int) {
+	if a.Method == MethodEWMA {
+		var variance float64
+		for i, p := range history {
+			if i == 0 {
+				mean = p.Value
+				continue
+			}
+			diff := p.Value - mean
+			mean += a.Alpha * diff
+			variance = (1 - a.Alpha) * (variance + a.Alpha*diff*diff)
+		}
+		return mean, math.Sqrt(variance), len(history)
+	}
+
+	var sum, sumSq float64
+	for _, p := range history {
+		if a.Season > 0 && !a.inPhase(p.Time, t) {
+			continue
+		}
+		sum += p.Value
+		sumSq += p.Value * p.Value
+		n++
+	}
+	if n == 0 {
+		return 0, 0, 0
+	}
+	mean = sum / float64(n)
+	variance := sumSq/float64(n) - mean*mean
+	if variance < 0 { // rounding
+		variance = 0
+	}
+	return mean, math.Sqrt(variance), n
+}
+
+// inPhase reports whether p falls within Tolerance of t's phase in an
+// earlier Season.
+func (a *Anomaly) inPhase(p, t time.Time) bool {
+	season, tolerance := time.Duration(a.Season), time.Duration(a.Tolerance)
+	off := t.Sub(p) % season
+	return off <= tolerance || season-off <= tolerance
+}
+
+func init() {
+	conditions["anomaly"] = func(spec json.RawMessage, env *Env) (Condition, error) {
+		var a Anomaly
+		if err := strictUnmarshal(spec, &a); err != nil {
+			return nil, err
+		}
+		if err := a.Validate(); err != nil {
+			return nil, err
+		}
+		return a.Condition(), nil
+	}
+}
@@ -0,0 +1,72 @@
+package alerts
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestAnomaly(t *testing.T) {
+	// hourly returns two weeks of hourly temperatures following a day/night
+	// cycle, with latest as the final Point.
+	hourly := func(latest float64) []Series {
+		s := Series{Measurement: "environment", Field: FieldTemperature}
+		for i := 0; i < 14*24; i++ {
+			at := epoch.Add(time.Duration(i) * time.Hour)
+			v := 22 + 4*math.Sin(2*math.Pi*float64(i%24)/24) + 0.2*float64(i%3)
+			s.Points = append(s.Points, Point{Time: at, Value: v})
+		}
+		s.Points = append(s.Points, Point{Time: epoch.Add(14 * 24 * time.Hour), Value: latest})
+		return []Series{s}
+	}
+	tests := []struct {
+		name   string
+		spec   string
+		series []Series
+		ok     bool
+		// anomaly is whether the check should fail with an anomaly
+		// rather than some other error.
+		anomaly bool
+	}{
+		{name: "usual", spec: `{"type": "anomaly", "field": "temperature"}`, series: hourly(22.2), ok: true},
+		{name: "far outside", spec: `{"type": "anomaly", "field": "temperature"}`, series: hourly(35), anomaly: true},
+		{name: "seasonal catches what plain zscore misses", spec: `{"type": "anomaly", "field": "temperature", "season": "24h"}`, series: hourly(25), anomaly: true},
+		{name: "plain zscore", spec: `{"type": "anomaly", "field": "temperature"}`, series: hourly(25), ok: true},
+		{name: "floor", spec: `{"type": "anomaly", "field": "temperature", "season": "24h", "floor": 5}`, series: hourly(25), ok: true},
+		{name: "ewma", spec: `{"type": "anomaly", "field": "temperature", "method": "ewma"}`, series: hourly(35), anomaly: true},
+		{name: "ewma usual", spec: `{"type": "anomaly", "field": "temperature", "method": "ewma"}`, series: hourly(22), ok: true},
+		{name: "not enough history", spec: `{"type": "anomaly", "field": "temperature", "minPoints": 1000}`, series: hourly(22)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			cond, err := ParseCondition([]byte(tt.spec), nil)
+			is.NoErr(err)
+			ok, err := cond(epoch, tt.series)
+			is.Equal(ok, tt.ok)
+			if tt.ok {
+				is.NoErr(err)
+			}
+			var v *Violation
+			is.Equal(errors.As(err, &v) && v.Kind == "anomaly", tt.anomaly)
+		})
+	}
+}
+
+func TestAnomalyExpectedRange(t *testing.T) {
+	is := is.New(t)
+	s := Series{Field: FieldHumidity}
+	for i, v := range []float64{50, 52, 48, 50, 52, 48, 50, 52, 48, 50, 70} {
+		s.Points = append(s.Points, Point{Time: epoch.Add(time.Duration(i) * time.Minute), Value: v})
+	}
+	a := &Anomaly{Field: FieldHumidity}
+	is.NoErr(a.Validate())
+	_, err := a.Condition()(epoch, []Series{s})
+	var v *Violation
+	is.True(errors.As(err, &v))
+	is.Equal(v.Kind, "anomaly")
+	is.True(*v.Min < 50 && *v.Max > 50 && *v.Max < 70) // expected range is around the baseline
+}
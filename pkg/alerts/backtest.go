@@ -0,0 +1,146 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxBacktestChecks bounds how many Checks one Backtest may replay.
+const maxBacktestChecks = 2000
+
+// Backtest replays a Condition over a past time range on a Monitor's
+// schedule, to see how often it would have alerted. It goes through the
+// same states, holds and backoff a running Monitor would.
+type Backtest struct {
+	// Query returns the Series the monitor's query would have returned at
+	// a past time, e.g. an InfluxClient query rewritten with AsOf.
+	Query     func(ctx context.Context, at time.Time) ([]Series, error)
+	Condition Condition
+
+	Interval   time.Duration
+	For        time.Duration
+	MaxBackoff time.Duration
+
+	Start time.Time
+	End   time.Time
+
+	// OnCheck is optionally called after every Check with the Monitor's
+	// resulting State and the Check's error.
+	OnCheck func(at time.Time, state State, err error)
+}
+
+// BacktestEvent is a transition a Monitor would have alerted or resolved on.
+type BacktestEvent struct {
+	Time   time.Time `json:"time"`
+	State  string    `json:"state"` // firing or resolved
+	Reason string    `json:"reason,omitempty"`
+}
+
+// BacktestAlert is one would-be alert, from firing until it resolved.
+type BacktestAlert struct {
+	Start time.Time `json:"start"`
+	// End is nil if the alert was still open at the end of the range.
+	End      *time.Time `json:"end,omitempty"`
+	Duration Duration   `json:"duration"`
+	// Notifications is how many times Alert would have been called.
+	Notifications int    `json:"notifications"`
+	Reason        string `json:"reason"`
+}
+
+// BacktestResult is what a Backtest found.
+type BacktestResult struct {
+	Checks        int             `json:"checks"`
+	Failures      int             `json:"failures"`
+	Suppressed    int             `json:"suppressed"`
+	Unknown       int             `json:"unknown"`
+	Events        []BacktestEvent `json:"events"`
+	Alerts        []BacktestAlert `json:"alerts"`
+	Notifications int             `json:"notifications"`
+	// Open is how long alerts were open in total.
+	Open Duration `json:"open"`
+}
+
+// Validate reports whether the Backtest can run.
+func (b *Backtest) Validate() error {
+	if !b.End.After(b.Start) {
+		return fmt.Errorf("backtest end must be after its start")
+	}
+	if b.Interval <= 0 {
+		return fmt.Errorf("backtest needs a positive interval")
+	}
+	if n := b.End.Sub(b.Start) / b.Interval; n > maxBacktestChecks {
+		return fmt.Errorf("backtest would make %d checks, the limit is %d; use a shorter range or a longer interval", n, maxBacktestChecks)
+	}
+	return nil
+}
+
+// Run replays the Condition from Start to End.
+func (b *Backtest) Run(ctx context.Context) (*BacktestResult, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	mon := &Monitor{Interval: b.Interval, For: b.For, MaxBackoff: b.MaxBackoff}
+	res := &BacktestResult{Events: []BacktestEvent{}, Alerts: []BacktestAlert{}}
+	var open *BacktestAlert
+
+	for at := b.Start; !at.After(b.End); at = at.Add(mon.wait()) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		res.Checks++
+		series, err := b.Query(ctx, at)
+		ok := false
+		if err != nil {
+			err = fmt.Errorf("failed to query datasource: %w", err)
+		} else {
+			ok, err = b.Condition(at, series)
+		}
+		if errors.Is(err, ErrSuppressed) || errors.Is(err, ErrUnknown) {
+			if errors.Is(err, ErrUnknown) {
+				res.Unknown++
+			} else {
+				res.Suppressed++
+			}
+			if b.OnCheck != nil {
+				b.OnCheck(at, mon.State(), err)
+			}
+			continue
+		}
+		if !ok {
+			res.Failures++
+		}
+
+		from, to := mon.observe(at, ok)
+		if b.OnCheck != nil {
+			b.OnCheck(at, to, err)
+		}
+		switch {
+		case to == StateFiring:
+			res.Notifications++
+			if from != StateFiring {
+				reason := "check failed"
+				if err != nil {
+					reason = err.Error()
+				}
+				res.Events = append(res.Events, BacktestEvent{Time: at, State: "firing", Reason: reason})
+				res.Alerts = append(res.Alerts, BacktestAlert{Start: at, Reason: reason})
+				open = &res.Alerts[len(res.Alerts)-1]
+			}
+			open.Notifications++
+		case from == StateFiring && to == StateOK:
+			res.Events = append(res.Events, BacktestEvent{Time: at, State: "resolved"})
+			end := at
+			open.End = &end
+			open.Duration = Duration(at.Sub(open.Start))
+			res.Open += open.Duration
+			open = nil
+		}
+	}
+	if open != nil {
+		open.Duration = Duration(b.End.Sub(open.Start))
+		res.Open += open.Duration
+	}
+	return res, nil
+}
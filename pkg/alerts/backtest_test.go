@@ -0,0 +1,87 @@
+package alerts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestBacktest(t *testing.T) {
+	m := time.Minute
+	// humidity is 50% except from 30m to 60m and at 100m, when it's 30%.
+	humidity := func(ctx context.Context, at time.Time) ([]Series, error) {
+		v := 50.0
+		if off := at.Sub(epoch); (off >= 30*m && off < 60*m) || off == 100*m {
+			v = 30
+		}
+		return []Series{{Field: FieldHumidity, Points: []Point{{Time: at, Value: v}}}}, nil
+	}
+	cond := (&Threshold{Field: FieldHumidity, Min: float(40)}).Condition()
+
+	tests := []struct {
+		name          string
+		hold          time.Duration
+		alerts        int
+		notifications int
+		open          time.Duration
+	}{
+		{name: "no hold", alerts: 2, notifications: 4, open: 40 * m},
+		{name: "hold filters the blip", hold: 10 * m, alerts: 1, notifications: 2, open: 20 * m},
+		{name: "hold longer than the incident", hold: 45 * m, alerts: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			b := &Backtest{
+				Query:     humidity,
+				Condition: cond,
+				Interval:  10 * m,
+				For:       tt.hold,
+				Start:     epoch,
+				End:       epoch.Add(2 * time.Hour),
+			}
+			res, err := b.Run(context.Background())
+			is.NoErr(err)
+			is.Equal(res.Checks, 13)
+			is.Equal(res.Failures, 4)
+			is.Equal(len(res.Alerts), tt.alerts)
+			is.Equal(res.Notifications, tt.notifications)
+			is.Equal(time.Duration(res.Open), tt.open)
+			is.Equal(len(res.Events), 2*tt.alerts)
+		})
+	}
+}
+
+func TestBacktestOpenAtEnd(t *testing.T) {
+	is := is.New(t)
+	b := &Backtest{
+		Query: func(ctx context.Context, at time.Time) ([]Series, error) {
+			return []Series{{Field: FieldHumidity, Points: []Point{{Time: at, Value: 30}}}}, nil
+		},
+		Condition: (&Threshold{Field: FieldHumidity, Min: float(40)}).Condition(),
+		Interval:  10 * time.Minute,
+		Start:     epoch,
+		End:       epoch.Add(time.Hour),
+	}
+	res, err := b.Run(context.Background())
+	is.NoErr(err)
+	is.Equal(len(res.Alerts), 1)
+	is.Equal(res.Alerts[0].End, nil)
+	is.Equal(res.Alerts[0].Notifications, 7)
+	is.Equal(time.Duration(res.Open), time.Hour)
+
+	b.Interval = time.Second
+	b.End = epoch.Add(24 * time.Hour)
+	_, err = b.Run(context.Background())
+	is.True(err != nil) // too many checks
+}
+
+func TestAsOf(t *testing.T) {
+	is := is.New(t)
+	is.Equal(AsOf(`from(bucket: "growmon") |> range(start: -1h)`, epoch),
+		"option now = () => 2022-09-09T12:00:00Z\nfrom(bucket: \"growmon\") |> range(start: -1h)")
+	is.Equal(AsOf("import \"math\"\n\nfrom(bucket: \"growmon\")", epoch),
+		"import \"math\"\n\noption now = () => 2022-09-09T12:00:00Z\nfrom(bucket: \"growmon\")")
+}
@@ -0,0 +1,217 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchWindow is how long a Batched DataSource waits for other
+	// devices' queries before running a batch.
+	DefaultBatchWindow = 50 * time.Millisecond
+	// DefaultBatchSize is the most devices a Batched DataSource queries at once.
+	DefaultBatchSize = 100
+	// batchTimeout bounds a batch's query, since it runs for many callers.
+	batchTimeout = time.Minute
+)
+
+// deviceFilter matches a filter on one device in a normalized query.
+var deviceFilter = regexp.MustCompile(`\|>\s*filter\(fn:\s*\(r\)\s*=>\s*r(?:\["` + DeviceTag + `"\]|\.` + DeviceTag + `)\s*==\s*("(?:[^"\\]|\\.)*")\s*\)`)
+
+// batchStages are the Flux functions a batchable query may pipe through.
+// They all work table by table, so merging devices into one query doesn't
+// change any device's results.
+var batchStages = map[string]bool{
+	"range": true, "filter": true, "aggregateWindow": true, "window": true,
+	"first": true, "last": true, "min": true, "max": true, "mean": true,
+	"median": true, "sum": true, "count": true, "limit": true, "tail": true,
+	"sort": true, "fill": true, "derivative": true, "difference": true,
+	"movingAverage": true, "timedMovingAverage": true, "elapsed": true,
+	"yield": true,
+}
+
+// batchingKey marks a context as a scheduled Check's.
+type batchingKey struct{}
+
+// withBatching marks ctx as a scheduled Check's, whose queries a Batched
+// DataSource may hold back briefly to merge them with other devices'.
+func withBatching(ctx context.Context) context.Context {
+	return context.WithValue(ctx, batchingKey{}, true)
+}
+
+// batching reports whether ctx is a scheduled Check's.
+func batching(ctx context.Context) bool {
+	b, _ := ctx.Value(batchingKey{}).(bool)
+	return b
+}
+
+// Batched is a DataSource that merges queries which only differ in the
+// device they filter on into one query for all of those devices, then
+// splits the results back out by device. Only the queries of scheduled
+// Checks are batched. Others, like previews and backtests, go straight
+// to the Source.
+type Batched struct {
+	Source DataSource
+	// Window is how long to wait for other devices' queries. It defaults
+	// to DefaultBatchWindow.
+	Window time.Duration
+	// Size is the most devices in one batch. It defaults to DefaultBatchSize.
+	Size int
+	// Clock defaults to the wall clock.
+	Clock Clock
+
+	mu      sync.Mutex
+	pending map[string]*batch
+}
+
+// batch is the queries for one shape waiting to be run together.
+type batch struct {
+	shape   string // the normalized query with the device filter cut out
+	query   string // the first query, run as is if it ends up alone
+	devices []string
+	once    sync.Once
+	done    chan struct{}
+	results map[string][]Series
+	err     error
+}
+
+// Query implements DataSource.
+func (b *Batched) Query(ctx context.Context, query string) ([]Series, error) {
+	if !batching(ctx) {
+		return b.Source.Query(ctx, query)
+	}
+	shape, device, ok := batchShape(query)
+	if !ok {
+		return b.Source.Query(ctx, query)
+	}
+
+	size := b.Size
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	b.mu.Lock()
+	if b.pending == nil {
+		b.pending = map[string]*batch{}
+	}
+	bt, ok := b.pending[shape]
+	if !ok {
+		bt = &batch{shape: shape, query: query, done: make(chan struct{})}
+		b.pending[shape] = bt
+		window := b.Window
+		if window <= 0 {
+			window = DefaultBatchWindow
+		}
+		after := clockOrDefault(b.Clock).After(window)
+		go func() {
+			<-after
+			b.flush(bt)
+		}()
+	}
+	if !bt.has(device) {
+		bt.devices = append(bt.devices, device)
+	}
+	full := len(bt.devices) >= size
+	b.mu.Unlock()
+	if full {
+		go b.flush(bt)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-bt.done:
+	}
+	if bt.err != nil {
+		return nil, bt.err
+	}
+	return copySeries(bt.results[device]), nil
+}
+
+// has reports whether device is in the batch.
+func (bt *batch) has(device string) bool {
+	for _, d := range bt.devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
+// flush stops the batch taking queries and runs it, once.
+func (b *Batched) flush(bt *batch) {
+	b.mu.Lock()
+	if b.pending[bt.shape] == bt {
+		delete(b.pending, bt.shape)
+	}
+	b.mu.Unlock()
+	bt.once.Do(func() { b.run(bt) })
+}
+
+// run queries every device in the batch and splits the results by device.
+func (b *Batched) run(bt *batch) {
+	defer close(bt.done)
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+
+	query := bt.query
+	if len(bt.devices) > 1 {
+		set := make([]string, len(bt.devices))
+		for i, d := range bt.devices {
+			set[i] = fluxString(d)
+		}
+		sort.Strings(set)
+		filter := fmt.Sprintf(`|> filter(fn: (r) => contains(value: r["%s"], set: [%s]))`, DeviceTag, strings.Join(set, ", "))
+		query = strings.Replace(bt.shape, batchPlaceholder, filter, 1)
+	}
+	series, err := b.Source.Query(ctx, query)
+	batchDevices.Observe(float64(len(bt.devices)))
+	batchQueriesSaved.Add(float64(len(bt.devices) - 1))
+	if err != nil {
+		bt.err = err
+		return
+	}
+	bt.results = map[string][]Series{}
+	for _, s := range series {
+		device := s.Tags[DeviceTag]
+		bt.results[device] = append(bt.results[device], s)
+	}
+}
+
+// batchPlaceholder stands in for the device filter in a batch's shape.
+const batchPlaceholder = "\x00"
+
+// batchShape returns a query with its device filter cut out, and the
+// device it filtered on. It reports false for queries that can't be
+// batched: ones without exactly one device filter, or that do anything
+// but read one bucket and work on its tables one at a time.
+func batchShape(query string) (shape, device string, ok bool) {
+	q := NormalizeQuery(query)
+	matches := deviceFilter.FindAllStringSubmatchIndex(q, -1)
+	if len(matches) != 1 || !strings.HasPrefix(q, "from(") || strings.Count(q, "from(") != 1 {
+		return "", "", false
+	}
+	m := matches[0]
+	device, err := strconv.Unquote(q[m[2]:m[3]])
+	if err != nil {
+		return "", "", false
+	}
+	shape = q[:m[0]] + batchPlaceholder + q[m[1]:]
+
+	stages := strings.Split(q[:m[0]]+q[m[1]:], "|>")
+	for _, stage := range stages[1:] {
+		name := strings.TrimSpace(stage)
+		if i := strings.Index(name, "("); i > 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+		if !batchStages[name] {
+			return "", "", false
+		}
+	}
+	return shape, device, true
+}
@@ -0,0 +1,215 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// deviceQuery is the shape of query the device template renders.
+const deviceQuery = `from(bucket: "growmon")
+  |> range(start: -1h)
+  |> filter(fn: (r) => r["_measurement"] == "STBProto")
+  |> filter(fn: (r) => r["UUID"] == %q)
+  |> filter(fn: (r) => contains(value: r["_field"], set: ["temperature"]))
+  |> aggregateWindow(every: 5m, fn: mean, createEmpty: false)`
+
+// deviceSource answers any query with a temperature Series for every
+// device it names, and records the queries it was asked.
+type deviceSource struct {
+	mu      sync.Mutex
+	queries []string
+	err     error
+}
+
+func (d *deviceSource) Query(ctx context.Context, query string) ([]Series, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries = append(d.queries, query)
+	if d.err != nil {
+		return nil, d.err
+	}
+	var series []Series
+	for _, device := range []string{"00-00-01", "00-00-02", "00-00-03"} {
+		if strings.Contains(query, `"`+device+`"`) {
+			series = append(series, deviceSeries(device))
+		}
+	}
+	return series, nil
+}
+
+func (d *deviceSource) Queries() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.queries...)
+}
+
+func deviceSeries(device string) Series {
+	return Series{
+		Measurement: "STBProto",
+		Field:       FieldTemperature,
+		Tags:        map[string]string{DeviceTag: device},
+		Points:      []Point{{Time: epoch, Value: 21}},
+	}
+}
+
+// pendingDevices returns how many devices are waiting in b's batches.
+func pendingDevices(b *Batched) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, bt := range b.pending {
+		n += len(bt.devices)
+	}
+	return n
+}
+
+// queryAll queries every device through b from a scheduled Check at once,
+// and returns each device's results once clock has passed the window.
+func queryAll(t *testing.T, b *Batched, clock *FakeClock, devices ...string) ([][]Series, []error) {
+	t.Helper()
+	results := make([][]Series, len(devices))
+	errs := make([]error, len(devices))
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device string) {
+			defer wg.Done()
+			results[i], errs[i] = b.Query(withBatching(context.Background()), fmt.Sprintf(deviceQuery, device))
+		}(i, device)
+	}
+	for pendingDevices(b) < len(devices) {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(DefaultBatchWindow)
+	wg.Wait()
+	return results, errs
+}
+
+func TestBatched(t *testing.T) {
+	t.Run("should merge devices into one query and split the results", func(t *testing.T) {
+		is := is.New(t)
+		src := &deviceSource{}
+		clock := NewFakeClock(epoch)
+		b := &Batched{Source: src, Clock: clock}
+
+		results, errs := queryAll(t, b, clock, "00-00-01", "00-00-02", "00-00-03")
+		is.Equal(len(src.Queries()), 1)
+		is.True(strings.Contains(src.Queries()[0], `contains(value: r["UUID"], set: ["00-00-01", "00-00-02", "00-00-03"])`))
+		for i, device := range []string{"00-00-01", "00-00-02", "00-00-03"} {
+			is.NoErr(errs[i])
+			is.Equal(results[i], []Series{deviceSeries(device)})
+		}
+	})
+
+	t.Run("should run a lone query as it is", func(t *testing.T) {
+		is := is.New(t)
+		src := &deviceSource{}
+		clock := NewFakeClock(epoch)
+		b := &Batched{Source: src, Clock: clock}
+
+		results, errs := queryAll(t, b, clock, "00-00-01")
+		is.NoErr(errs[0])
+		is.Equal(src.Queries(), []string{fmt.Sprintf(deviceQuery, "00-00-01")})
+		is.Equal(results[0], []Series{deviceSeries("00-00-01")})
+	})
+
+	t.Run("should run a full batch without waiting", func(t *testing.T) {
+		is := is.New(t)
+		src := &deviceSource{}
+		b := &Batched{Source: src, Size: 2, Clock: NewFakeClock(epoch)}
+
+		var wg sync.WaitGroup
+		for _, device := range []string{"00-00-01", "00-00-02"} {
+			wg.Add(1)
+			go func(device string) {
+				defer wg.Done()
+				_, err := b.Query(withBatching(context.Background()), fmt.Sprintf(deviceQuery, device))
+				is.NoErr(err)
+			}(device)
+		}
+		wg.Wait()
+		is.Equal(len(src.Queries()), 1)
+	})
+
+	t.Run("should give every device the batch's error", func(t *testing.T) {
+		is := is.New(t)
+		src := &deviceSource{err: fmt.Errorf("ErrMock")}
+		clock := NewFakeClock(epoch)
+		b := &Batched{Source: src, Clock: clock}
+
+		_, errs := queryAll(t, b, clock, "00-00-01", "00-00-02")
+		is.Equal(len(src.Queries()), 1)
+		is.Equal(errs[0].Error(), "ErrMock")
+		is.Equal(errs[1].Error(), "ErrMock")
+	})
+
+	t.Run("should only batch scheduled checks", func(t *testing.T) {
+		is := is.New(t)
+		src := &deviceSource{}
+		b := &Batched{Source: src, Clock: NewFakeClock(epoch)}
+
+		// the clock never moves, so this would block if it were batched
+		got, err := b.Query(context.Background(), fmt.Sprintf(deviceQuery, "00-00-01"))
+		is.NoErr(err)
+		is.Equal(got, []Series{deviceSeries("00-00-01")})
+	})
+}
+
+func TestBatchShape(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		device string
+		ok     bool
+	}{
+		{
+			name:   "device template",
+			query:  fmt.Sprintf(deviceQuery, "00-00-01"),
+			device: "00-00-01",
+			ok:     true,
+		},
+		{
+			name:   "dot notation",
+			query:  `from(bucket: "growmon") |> range(start: -1h) |> filter(fn: (r) => r.UUID == "00-00-02") |> last()`,
+			device: "00-00-02",
+			ok:     true,
+		},
+		{
+			name:  "no device filter",
+			query: `from(bucket: "growmon") |> range(start: -1h) |> last()`,
+		},
+		{
+			name:  "regroups devices",
+			query: `from(bucket: "growmon") |> range(start: -1h) |> filter(fn: (r) => r["UUID"] == "00-00-01") |> group() |> mean()`,
+		},
+		{
+			name:  "more than one device",
+			query: `from(bucket: "growmon") |> filter(fn: (r) => r["UUID"] == "00-00-01") |> filter(fn: (r) => r["UUID"] == "00-00-02")`,
+		},
+		{
+			name:  "imports",
+			query: "import \"math\"\nfrom(bucket: \"growmon\") |> filter(fn: (r) => r[\"UUID\"] == \"00-00-01\")",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			_, device, ok := batchShape(tt.query)
+			is.Equal(ok, tt.ok)
+			is.Equal(device, tt.device)
+		})
+	}
+
+	t.Run("queries for different devices share a shape", func(t *testing.T) {
+		is := is.New(t)
+		a, _, _ := batchShape(fmt.Sprintf(deviceQuery, "00-00-01"))
+		b, _, _ := batchShape(fmt.Sprintf(deviceQuery, "00-00-02"))
+		is.Equal(a, b)
+	})
+}
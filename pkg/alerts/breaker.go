@@ -0,0 +1,166 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrUnknown is returned by Checks that couldn't judge the data because
+// their DataSource is down. Like ErrSuppressed, Monitors keep their
+// current State instead of treating it as a failure.
+var ErrUnknown = errors.New("ErrUnknown")
+
+const (
+	// DefaultBreakerThreshold is how many queries in a row must fail before
+	// a Breaker without a Health check opens.
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown is how long a Breaker stays open before it
+	// lets a query through to see whether its source is back.
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// Breaker is a DataSource that tracks the health of its Source and stops
+// querying it while it's down. A failed query makes it ask Health whether
+// the Source itself is down, rather than just that query. If Health fails
+// too, or there's no Health and Threshold queries in a row have failed,
+// the Breaker opens. While it's open every query fails fast with
+// ErrUnknown. After Cooldown it tries again, and closes once the Source
+// answers.
+type Breaker struct {
+	Source DataSource
+	// Name names the Source for metrics and OnChange.
+	Name string
+	// Health optionally checks whether the Source is up, e.g. by pinging it.
+	Health    func(ctx context.Context) error
+	Threshold int
+	Cooldown  time.Duration
+	// OnChange is optionally called when the Breaker opens, with the error
+	// that opened it, and when it closes again, with nil.
+	OnChange func(err error)
+	// Clock defaults to the wall clock.
+	Clock Clock
+
+	mu       sync.Mutex
+	open     bool
+	since    time.Time // when the Breaker last opened or closed
+	retry    time.Time // when an open Breaker next lets a query through
+	failures int
+	err      error
+}
+
+// SourceHealth is the health of a Breaker's Source.
+type SourceHealth struct {
+	Name    string    `json:"name"`
+	Healthy bool      `json:"healthy"`
+	Since   time.Time `json:"since,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Status reports the health of the Breaker's Source.
+func (b *Breaker) Status() SourceHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := SourceHealth{Name: b.Name, Healthy: !b.open, Since: b.since}
+	if b.open && b.err != nil {
+		h.Error = b.err.Error()
+	}
+	return h
+}
+
+// Query implements DataSource.
+func (b *Breaker) Query(ctx context.Context, query string) ([]Series, error) {
+	clock := clockOrDefault(b.Clock)
+	b.mu.Lock()
+	if b.open {
+		if clock.Now().Before(b.retry) {
+			err := b.err
+			b.mu.Unlock()
+			return nil, b.unknown(err)
+		}
+		// let this query through to probe the Source, and hold the rest
+		// back for another Cooldown in case it's still down
+		b.retry = clock.Now().Add(b.cooldown())
+	}
+	b.mu.Unlock()
+
+	series, err := b.Source.Query(ctx, query)
+	if err == nil {
+		b.closed()
+		return series, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+
+	down := err
+	if b.Health != nil {
+		if down = b.Health(ctx); down == nil {
+			// the Source is up, only this query failed
+			b.closed()
+			return nil, err
+		}
+	}
+	b.mu.Lock()
+	b.failures++
+	threshold := b.Threshold
+	if threshold <= 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	opened := false
+	if b.Health != nil || b.failures >= threshold || b.open {
+		opened = !b.open
+		b.open = true
+		b.err = down
+		b.retry = clock.Now().Add(b.cooldown())
+		if opened {
+			b.since = clock.Now()
+		}
+	}
+	open := b.open
+	b.mu.Unlock()
+
+	if opened {
+		datasourceUp.WithLabelValues(b.Name).Set(0)
+		if b.OnChange != nil {
+			b.OnChange(down)
+		}
+	}
+	if open {
+		return nil, b.unknown(down)
+	}
+	return nil, err
+}
+
+// closed records a successful query, closing the Breaker if it was open.
+func (b *Breaker) closed() {
+	b.mu.Lock()
+	wasOpen := b.open
+	b.open = false
+	b.failures = 0
+	b.err = nil
+	if wasOpen {
+		b.since = clockOrDefault(b.Clock).Now()
+	}
+	b.mu.Unlock()
+
+	datasourceUp.WithLabelValues(b.Name).Set(1)
+	if wasOpen && b.OnChange != nil {
+		b.OnChange(nil)
+	}
+}
+
+// unknown wraps the error that opened the Breaker in ErrUnknown.
+func (b *Breaker) unknown(err error) error {
+	return fmt.Errorf("%w: datasource %s is down: %v", ErrUnknown, b.Name, err)
+}
+
+// cooldown returns the Breaker's Cooldown or its default.
+func (b *Breaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return DefaultBreakerCooldown
+	}
+	return b.Cooldown
+}
@@ -0,0 +1,123 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// flakySource is a MemorySource with a Health check that can be failed.
+type flakySource struct {
+	*MemorySource
+	down error
+}
+
+func (f *flakySource) Health(ctx context.Context) error {
+	return f.down
+}
+
+func TestBreaker(t *testing.T) {
+	series := Series{Field: FieldTemperature, Points: []Point{{Time: epoch, Value: 21}}}
+	ctx := context.Background()
+
+	t.Run("should open when the source is down and close when it's back", func(t *testing.T) {
+		is := is.New(t)
+		src := &flakySource{MemorySource: NewMemorySource()}
+		src.Set("q", series)
+		clock := NewFakeClock(epoch)
+		var changes []error
+		b := &Breaker{Source: src, Name: "test", Health: src.Health, Clock: clock, OnChange: func(err error) {
+			changes = append(changes, err)
+		}}
+
+		_, err := b.Query(ctx, "q")
+		is.NoErr(err)
+		is.True(b.Status().Healthy)
+
+		src.Fail(fmt.Errorf("ErrConnRefused"))
+		src.down = fmt.Errorf("ErrConnRefused")
+		_, err = b.Query(ctx, "q")
+		is.True(errors.Is(err, ErrUnknown))
+		is.Equal(b.Status(), SourceHealth{Name: "test", Since: epoch, Error: "ErrConnRefused"})
+		is.Equal(len(changes), 1)
+
+		// fails fast while open
+		calls := src.Calls()
+		_, err = b.Query(ctx, "q")
+		is.True(errors.Is(err, ErrUnknown))
+		is.Equal(src.Calls(), calls)
+
+		// tries again after the cooldown, and stays open while it's down
+		clock.Advance(DefaultBreakerCooldown)
+		_, err = b.Query(ctx, "q")
+		is.True(errors.Is(err, ErrUnknown))
+		is.Equal(src.Calls(), calls+1)
+		is.Equal(len(changes), 1)
+
+		src.Fail(nil)
+		src.down = nil
+		clock.Advance(DefaultBreakerCooldown)
+		got, err := b.Query(ctx, "q")
+		is.NoErr(err)
+		is.Equal(got, []Series{series})
+		is.True(b.Status().Healthy)
+		is.Equal(changes, []error{fmt.Errorf("ErrConnRefused"), nil})
+	})
+
+	t.Run("should fail queries normally while the source is up", func(t *testing.T) {
+		is := is.New(t)
+		src := &flakySource{MemorySource: NewMemorySource()}
+		b := &Breaker{Source: src, Name: "test", Health: src.Health, Clock: NewFakeClock(epoch)}
+
+		for i := 0; i < 10; i++ {
+			_, err := b.Query(ctx, "unknown")
+			is.True(err != nil)
+			is.True(!errors.Is(err, ErrUnknown))
+		}
+		is.True(b.Status().Healthy)
+	})
+
+	t.Run("should open after Threshold failures without a health check", func(t *testing.T) {
+		is := is.New(t)
+		src := NewMemorySource()
+		src.Fail(fmt.Errorf("ErrTimeout"))
+		b := &Breaker{Source: src, Name: "test", Threshold: 3, Cooldown: time.Minute, Clock: NewFakeClock(epoch)}
+
+		for i := 0; i < 2; i++ {
+			_, err := b.Query(ctx, "q")
+			is.True(!errors.Is(err, ErrUnknown))
+		}
+		_, err := b.Query(ctx, "q")
+		is.True(errors.Is(err, ErrUnknown))
+		is.True(!b.Status().Healthy)
+	})
+
+	t.Run("should keep a monitor's state while the source is down", func(t *testing.T) {
+		is := is.New(t)
+		src := &flakySource{MemorySource: NewMemorySource()}
+		src.Set("q", series)
+		b := &Breaker{Source: src, Name: "test", Health: src.Health, Clock: NewFakeClock(epoch)}
+		rule := &Rule{Source: b, Query: "q", Condition: Fresh(time.Hour), Clock: NewFakeClock(epoch)}
+		alerted := make(chan error, 1)
+		mon := &Monitor{Check: rule.Check, Alert: func(ctx context.Context, err error) { alerted <- err }, Clock: rule.Clock}
+
+		state, err := mon.Evaluate(ctx)
+		is.NoErr(err)
+		is.Equal(state, StateOK)
+
+		src.Fail(fmt.Errorf("ErrConnRefused"))
+		src.down = fmt.Errorf("ErrConnRefused")
+		state, err = mon.Evaluate(ctx)
+		is.True(errors.Is(err, ErrUnknown))
+		is.Equal(state, StateOK)
+		select {
+		case err := <-alerted:
+			t.Fatalf("alerted while the datasource was down: %v", err)
+		default:
+		}
+	})
+}
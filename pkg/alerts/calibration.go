@@ -0,0 +1,76 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+)
+
+// DeviceTag is the tag GRO-01 units identify themselves with.
+const DeviceTag = "UUID"
+
+// Calibration corrects one field of one device: the calibrated value is
+// raw*Scale + Offset. A zero Scale is treated as 1.
+type Calibration struct {
+	Offset float64 `json:"offset"`
+	Scale  float64 `json:"scale"`
+}
+
+// Apply returns the calibrated value of raw.
+func (c Calibration) Apply(raw float64) float64 {
+	scale := c.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return raw*scale + c.Offset
+}
+
+// CalibrationKey identifies the device and field a Calibration is for.
+type CalibrationKey struct {
+	Device string
+	Field  string
+}
+
+// Calibrated wraps a DataSource and applies per-device Calibrations to
+// its results. Calibrated Points keep their raw value in Point.Raw so
+// that alerts can report both.
+type Calibrated struct {
+	Source DataSource
+	// Calibrations returns the current calibrations. It is called on every
+	// query so that edits apply right away.
+	Calibrations func(ctx context.Context) (map[CalibrationKey]Calibration, error)
+}
+
+// Query implements DataSource.
+func (c *Calibrated) Query(ctx context.Context, query string) ([]Series, error) {
+	series, err := c.Source.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	cals, err := c.Calibrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load calibrations: %w", err)
+	}
+	return Calibrate(series, cals), nil
+}
+
+// Calibrate returns a copy of series with cals applied.
+func Calibrate(series []Series, cals map[CalibrationKey]Calibration) []Series {
+	out := make([]Series, len(series))
+	for i, s := range series {
+		out[i] = s
+		cal, ok := cals[CalibrationKey{Device: s.Tags[DeviceTag], Field: s.Field}]
+		if !ok {
+			continue
+		}
+		points := make([]Point, len(s.Points))
+		for j, p := range s.Points {
+			raw := p.Value
+			if p.Raw != nil {
+				raw = *p.Raw
+			}
+			points[j] = Point{Time: p.Time, Value: cal.Apply(raw), Raw: &raw}
+		}
+		out[i].Points = points
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestCalibrated(t *testing.T) {
+	is := is.New(t)
+	src := NewMemorySource()
+	off := map[string]string{DeviceTag: "UUID: 00-00-01"}
+	fine := map[string]string{DeviceTag: "UUID: 00-00-02"}
+	src.Set("q",
+		Series{Field: FieldTemperature, Tags: off, Points: []Point{{Time: epoch, Value: 30}}},
+		Series{Field: FieldHumidity, Tags: off, Points: []Point{{Time: epoch, Value: 50}}},
+		Series{Field: FieldTemperature, Tags: fine, Points: []Point{{Time: epoch, Value: 30}}},
+	)
+
+	cal := &Calibrated{
+		Source: src,
+		Calibrations: func(ctx context.Context) (map[CalibrationKey]Calibration, error) {
+			return map[CalibrationKey]Calibration{
+				{Device: "UUID: 00-00-01", Field: FieldTemperature}: {Offset: -1.5},
+				{Device: "UUID: 00-00-01", Field: FieldHumidity}:    {Scale: 1.5, Offset: -2},
+			}, nil
+		},
+	}
+	series, err := cal.Query(context.Background(), "q")
+	is.NoErr(err)
+	is.Equal(series[0].Points[0].Value, 28.5)
+	is.Equal(*series[0].Points[0].Raw, 30.0)
+	is.Equal(series[1].Points[0].Value, 73.0)
+	is.Equal(series[2].Points[0].Value, 30.0) // other devices are untouched
+	is.Equal(series[2].Points[0].Raw, nil)
+
+	// alerts report the calibrated value and keep the raw one for audit
+	_, err = (&Threshold{Field: FieldTemperature, Max: float(28)}).Condition()(epoch, series[:1])
+	var v *Violation
+	is.True(errors.As(err, &v))
+	is.Equal(v.Value, 28.5)
+	is.Equal(*v.Raw, 30.0)
+}
+
+// float returns a pointer to f, for optional bounds.
+func float(f float64) *float64 {
+	return &f
+}
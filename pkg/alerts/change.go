@@ -0,0 +1,155 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Ways a Change measures how a field moved over its window.
+const (
+	// ChangeRate is the change per minute.
+	ChangeRate = "rate"
+	// ChangeDelta is the absolute change.
+	ChangeDelta = "delta"
+	// ChangePercent is the change as a percentage of the starting value.
+	ChangePercent = "percent"
+)
+
+// Change fails when Field moves faster or further than Min and Max allow
+// over Window, e.g. a humidity delta below -10 in 15m when a door is left
+// open. Falls are negative, so Min bounds drops and Max bounds rises.
+type Change struct {
+	// By is rate, delta or percent.
+	By     string   `json:"-"`
+	Field  string   `json:"field"`
+	Window Duration `json:"window"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+}
+
+// Validate reports whether the Change can be evaluated.
+func (c *Change) Validate() error {
+	switch c.By {
+	case ChangeRate, ChangeDelta, ChangePercent:
+	default:
+		return fmt.Errorf("unknown change %q", c.By)
+	}
+	if c.Field == "" {
+		return fmt.Errorf("%s needs a field", c.By)
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("%s needs a positive window", c.By)
+	}
+	if c.Min == nil && c.Max == nil {
+		return fmt.Errorf("%s needs a min or a max", c.By)
+	}
+	if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+		return fmt.Errorf("%s min %g is above max %g", c.By, *c.Min, *c.Max)
+	}
+	return nil
+}
+
+// Condition returns the Change as a Condition.
+func (c *Change) Condition() Condition {
+	return func(now time.Time, series []Series) (bool, error) {
+		found := false
+		for _, s := range series {
+			if s.Field != c.Field {
+				continue
+			}
+			first, last, ok := c.span(s)
+			if !ok {
+				continue
+			}
+			found = true
+			var change float64
+			var unit string
+			switch c.By {
+			case ChangeRate:
+				change = (last.Value - first.Value) / last.Time.Sub(first.Time).Minutes()
+				unit = "/min"
+			case ChangeDelta:
+				change = last.Value - first.Value
+			case ChangePercent:
+				if first.Value == 0 {
+					if v := c.fromZero(s, first, last); v != nil {
+						return false, v
+					}
+					continue
+				}
+				change = (last.Value - first.Value) / first.Value * 100
+				unit = "%"
+			}
+			if (c.Min == nil || change >= *c.Min) && (c.Max == nil || change <= *c.Max) {
+				continue
+			}
+			return false, &Violation{
+				Kind:   c.By,
+				Field:  c.Field,
+				Tags:   s.Tags,
+				Time:   last.Time,
+				Value:  change,
+				Min:    c.Min,
+				Max:    c.Max,
+				Reason: fmt.Sprintf("%s changed by %.3g%s from %g to %g in %s, outside %s", c.Field, change, unit, first.Value, last.Value, last.Time.Sub(first.Time), bounds(c.Min, c.Max)),
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("not enough %s data in the last %s", c.Field, time.Duration(c.Window))
+		}
+		return true, nil
+	}
+}
+
+// fromZero judges a percent change from a starting value of 0. Any move
+// away from 0 is an unbounded percentage, so it's outside a bound in its
+// direction. The Violation's Value is the absolute change instead.
+func (c *Change) fromZero(s Series, first, last Point) *Violation {
+	delta := last.Value - first.Value
+	if (delta <= 0 || c.Max == nil) && (delta >= 0 || c.Min == nil) {
+		return nil
+	}
+	return &Violation{
+		Kind:   c.By,
+		Field:  c.Field,
+		Tags:   s.Tags,
+		Time:   last.Time,
+		Value:  delta,
+		Min:    c.Min,
+		Max:    c.Max,
+		Reason: fmt.Sprintf("%s changed from 0 to %g in %s, an unbounded percent change outside %s", c.Field, last.Value, last.Time.Sub(first.Time), bounds(c.Min, c.Max)),
+	}
+}
+
+// span returns the earliest Point within Window of the latest one, and
+// the latest one. ok is false if there aren't two such Points.
+func (c *Change) span(s Series) (first, last Point, ok bool) {
+	last, ok = s.Last()
+	if !ok {
+		return first, last, false
+	}
+	since := last.Time.Add(-time.Duration(c.Window))
+	for _, p := range s.Points {
+		if !p.Time.Before(since) && p.Time.Before(last.Time) {
+			return p, last, true
+		}
+	}
+	return first, last, false
+}
+
+func init() {
+	for _, by := range []string{ChangeRate, ChangeDelta, ChangePercent} {
+		by := by
+		conditions[by] = func(spec json.RawMessage, env *Env) (Condition, error) {
+			c := Change{By: by}
+			if err := strictUnmarshal(spec, &c); err != nil {
+				return nil, err
+			}
+			if err := c.Validate(); err != nil {
+				return nil, err
+			}
+			return c.Condition(), nil
+		}
+	}
+}
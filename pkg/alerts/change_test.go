@@ -0,0 +1,58 @@
+package alerts
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestChange(t *testing.T) {
+	// every5mOf returns a Series of field with a Point every 5 minutes
+	// ending at epoch.
+	every5mOf := func(field string, values ...float64) []Series {
+		s := Series{Measurement: "environment", Field: field}
+		for i, v := range values {
+			at := epoch.Add(time.Duration(i-len(values)+1) * 5 * time.Minute)
+			s.Points = append(s.Points, Point{Time: at, Value: v})
+		}
+		return []Series{s}
+	}
+	every5m := func(values ...float64) []Series { return every5mOf(FieldHumidity, values...) }
+	// temperatures can start from 0, unlike humidity
+	temps := func(values ...float64) []Series { return every5mOf(FieldTemperature, values...) }
+	tests := []struct {
+		name   string
+		spec   string
+		series []Series
+		ok     bool
+		change float64
+	}{
+		{name: "steady delta", spec: `{"type": "delta", "field": "humidity", "window": "15m", "min": -10}`, series: every5m(60, 60, 59, 58, 60), ok: true},
+		{name: "door left open", spec: `{"type": "delta", "field": "humidity", "window": "15m", "min": -10}`, series: every5m(60, 60, 55, 50, 48), change: -12},
+		{name: "old drop is outside the window", spec: `{"type": "delta", "field": "humidity", "window": "10m", "min": -10}`, series: every5m(60, 49, 48, 48), ok: true},
+		{name: "percent", spec: `{"type": "percent", "field": "humidity", "window": "15m", "min": -10}`, series: every5m(60, 55, 50, 50), change: -100.0 / 6},
+		{name: "percent within", spec: `{"type": "percent", "field": "humidity", "window": "15m", "min": -10}`, series: every5m(60, 58, 57, 55), ok: true},
+		{name: "percent rise from zero", spec: `{"type": "percent", "field": "temperature", "window": "15m", "max": 50}`, series: temps(0, 5, 20), change: 20},
+		{name: "percent fall from zero", spec: `{"type": "percent", "field": "temperature", "window": "15m", "min": -50}`, series: temps(0, -2, -4), change: -4},
+		{name: "rise from zero is within a fall bound", spec: `{"type": "percent", "field": "temperature", "window": "15m", "min": -10}`, series: temps(0, 5, 20), ok: true},
+		{name: "steady at zero", spec: `{"type": "percent", "field": "temperature", "window": "15m", "max": 50}`, series: temps(0, 0, 0), ok: true},
+		{name: "rate", spec: `{"type": "rate", "field": "humidity", "window": "10m", "max": 1}`, series: every5m(40, 45, 55), change: 1.5},
+		{name: "rate within", spec: `{"type": "rate", "field": "humidity", "window": "10m", "max": 1}`, series: every5m(40, 45, 50), ok: true},
+		{name: "one point", spec: `{"type": "rate", "field": "humidity", "window": "10m", "max": 1}`, series: every5m(40)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			cond, err := ParseCondition([]byte(tt.spec), nil)
+			is.NoErr(err)
+			ok, err := cond(epoch, tt.series)
+			is.Equal(ok, tt.ok)
+			var v *Violation
+			if errors.As(err, &v) {
+				is.True(v.Value-tt.change < 1e-9 && tt.change-v.Value < 1e-9) // change in the payload
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Composite conditions combine whether other conditions fail, so that an
+// alert can need several problems at once, e.g. high temperature and low
+// humidity. Each part is a condition spec of its own, and may be another
+// composite or a monitor reference.
+const (
+	// CompositeAnd fails when all of its conditions fail.
+	CompositeAnd = "and"
+	// CompositeOr fails when any of its conditions fail.
+	CompositeOr = "or"
+	// CompositeNot fails when its condition passes.
+	CompositeNot = "not"
+	// CompositeAtLeast fails when at least K of its conditions fail.
+	CompositeAtLeast = "atLeast"
+)
+
+// Composite is a boolean combination of conditions.
+type Composite struct {
+	Op string `json:"-"`
+	// Of are the condition specs the Composite combines. A not takes one.
+	Of []json.RawMessage `json:"of"`
+	// K is how many conditions must fail for an atLeast to fail.
+	K int `json:"k,omitempty"`
+}
+
+// Validate reports whether the Composite can be evaluated.
+func (c *Composite) Validate() error {
+	switch c.Op {
+	case CompositeAnd, CompositeOr:
+		if len(c.Of) == 0 {
+			return fmt.Errorf("%s needs at least one condition", c.Op)
+		}
+	case CompositeNot:
+		if len(c.Of) != 1 {
+			return fmt.Errorf("not needs exactly one condition")
+		}
+	case CompositeAtLeast:
+		if c.K < 1 || c.K > len(c.Of) {
+			return fmt.Errorf("atLeast needs a k between 1 and its %d conditions", len(c.Of))
+		}
+	default:
+		return fmt.Errorf("unknown composite %q", c.Op)
+	}
+	if c.K != 0 && c.Op != CompositeAtLeast {
+		return fmt.Errorf("k only applies to atLeast")
+	}
+	return nil
+}
+
+// Condition parses the Composite's parts with env and returns the
+// Composite as a Condition.
+func (c *Composite) Condition(env *Env) (Condition, error) {
+	parts := make([]Condition, len(c.Of))
+	for i, spec := range c.Of {
+		cond, err := ParseCondition(spec, env)
+		if err != nil {
+			return nil, fmt.Errorf("condition %d: %w", i+1, err)
+		}
+		parts[i] = cond
+	}
+	need := c.K
+	switch c.Op {
+	case CompositeAnd:
+		need = len(parts)
+	case CompositeOr, CompositeNot:
+		need = 1
+	}
+
+	return func(now time.Time, series []Series) (bool, error) {
+		var causes, passed []string
+		for i, cond := range parts {
+			ok, err := cond(now, series)
+			switch {
+			case errors.Is(err, ErrSuppressed):
+				return false, err
+			case ok:
+				passed = append(passed, string(c.Of[i]))
+			case err != nil:
+				causes = append(causes, err.Error())
+			default:
+				causes = append(causes, fmt.Sprintf("%s failed", c.Of[i]))
+			}
+		}
+
+		if c.Op == CompositeNot {
+			if len(passed) == 0 {
+				return true, nil
+			}
+			return false, &Violation{
+				Kind:   CompositeNot,
+				Time:   now,
+				Reason: fmt.Sprintf("%s passed", passed[0]),
+				Causes: passed,
+			}
+		}
+		if len(causes) < need {
+			return true, nil
+		}
+		return false, &Violation{
+			Kind:   c.Op,
+			Time:   now,
+			Value:  float64(len(causes)),
+			Reason: fmt.Sprintf("%d of %d conditions failed: %s", len(causes), len(parts), strings.Join(causes, "; ")),
+			Causes: causes,
+		}
+	}, nil
+}
+
+// MonitorRef fails while the named monitor is firing.
+type MonitorRef struct {
+	Name string `json:"name"`
+}
+
+// Condition returns the MonitorRef as a Condition that looks up states
+// with state.
+func (m *MonitorRef) Condition(state func(string) (State, error)) Condition {
+	return func(now time.Time, series []Series) (bool, error) {
+		s, err := state(m.Name)
+		if err != nil {
+			return false, fmt.Errorf("failed to get state of monitor %q: %w", m.Name, err)
+		}
+		if s != StateFiring {
+			return true, nil
+		}
+		return false, &Violation{
+			Kind:   "monitor",
+			Time:   now,
+			Reason: fmt.Sprintf("monitor %q is firing", m.Name),
+		}
+	}
+}
+
+// References returns the names of the monitors a condition spec refers
+// to, including in nested composites.
+func References(spec []byte) ([]string, error) {
+	var node struct {
+		Type string            `json:"type"`
+		Name string            `json:"name"`
+		Of   []json.RawMessage `json:"of"`
+	}
+	if err := json.Unmarshal(spec, &node); err != nil {
+		return nil, err
+	}
+	if node.Type == "monitor" {
+		return []string{node.Name}, nil
+	}
+	if !isComposite(node.Type) {
+		return nil, nil
+	}
+	var names []string
+	for _, part := range node.Of {
+		refs, err := References(part)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, refs...)
+	}
+	return names, nil
+}
+
+// FindCycle returns a cycle of monitors in deps, which maps each monitor
+// to the monitors it refers to, e.g. [a b a]. It returns nil if there is none.
+func FindCycle(deps map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	marks := map[string]int{}
+	var path []string
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch marks[name] {
+		case done:
+			return nil
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = done
+		return nil
+	}
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names) // report the same cycle every time
+	for _, name := range names {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+func isComposite(t string) bool {
+	switch t {
+	case CompositeAnd, CompositeOr, CompositeNot, CompositeAtLeast:
+		return true
+	}
+	return false
+}
+
+func init() {
+	for _, op := range []string{CompositeAnd, CompositeOr, CompositeNot, CompositeAtLeast} {
+		op := op
+		conditions[op] = func(spec json.RawMessage, env *Env) (Condition, error) {
+			c := Composite{Op: op}
+			if err := strictUnmarshal(spec, &c); err != nil {
+				return nil, err
+			}
+			if err := c.Validate(); err != nil {
+				return nil, err
+			}
+			return c.Condition(env)
+		}
+	}
+	conditions["monitor"] = func(spec json.RawMessage, env *Env) (Condition, error) {
+		var m MonitorRef
+		if err := strictUnmarshal(spec, &m); err != nil {
+			return nil, err
+		}
+		if m.Name == "" {
+			return nil, fmt.Errorf("monitor needs a name")
+		}
+		if env.State == nil {
+			return nil, fmt.Errorf("monitor states aren't available here")
+		}
+		return m.Condition(env.State), nil
+	}
+}
@@ -0,0 +1,107 @@
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestComposite(t *testing.T) {
+	reading := func(field string, v float64, device string) Series {
+		return Series{Field: field, Tags: map[string]string{DeviceTag: device}, Points: []Point{{Time: epoch, Value: v}}}
+	}
+	hot := `{"type": "threshold", "field": "temperature", "max": 29}`
+	dry := `{"type": "threshold", "field": "humidity", "min": 40}`
+	states := map[string]State{"sensor-1": StateFiring, "sensor-2": StateOK, "sensor-3": StateFiring}
+	env := &Env{State: func(name string) (State, error) {
+		s, ok := states[name]
+		if !ok {
+			return StateOK, fmt.Errorf("unknown monitor %q", name)
+		}
+		return s, nil
+	}}
+	ref := func(name string) string { return fmt.Sprintf(`{"type": "monitor", "name": %q}`, name) }
+
+	tests := []struct {
+		name   string
+		spec   string
+		series []Series
+		ok     bool
+		// causes is how many parts the explanation should list.
+		causes int
+	}{
+		{name: "hot and dry", spec: `{"type": "and", "of": [` + hot + `, ` + dry + `]}`, series: []Series{reading("temperature", 31, "a"), reading("humidity", 30, "a")}, causes: 2},
+		{name: "hot but humid", spec: `{"type": "and", "of": [` + hot + `, ` + dry + `]}`, series: []Series{reading("temperature", 31, "a"), reading("humidity", 60, "a")}, ok: true},
+		{name: "hot or dry", spec: `{"type": "or", "of": [` + hot + `, ` + dry + `]}`, series: []Series{reading("temperature", 31, "a"), reading("humidity", 60, "a")}, causes: 1},
+		{name: "not", spec: `{"type": "not", "of": [` + dry + `]}`, series: []Series{reading("humidity", 60, "a")}, causes: 1},
+		{name: "nested", spec: `{"type": "or", "of": [{"type": "not", "of": [` + dry + `]}, ` + hot + `]}`, series: []Series{reading("temperature", 20, "a"), reading("humidity", 30, "a")}, ok: true},
+		{name: "two of three sensors", spec: `{"type": "atLeast", "k": 2, "of": [` + ref("sensor-1") + `, ` + ref("sensor-2") + `, ` + ref("sensor-3") + `]}`, causes: 2},
+		{name: "three of three sensors", spec: `{"type": "atLeast", "k": 3, "of": [` + ref("sensor-1") + `, ` + ref("sensor-2") + `, ` + ref("sensor-3") + `]}`, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			cond, err := ParseCondition([]byte(tt.spec), env)
+			is.NoErr(err)
+			ok, err := cond(epoch, tt.series)
+			is.Equal(ok, tt.ok)
+			var v *Violation
+			if tt.ok {
+				is.NoErr(err)
+				return
+			}
+			is.True(errors.As(err, &v))
+			is.Equal(len(v.Causes), tt.causes)
+		})
+	}
+}
+
+func TestCompositeExplains(t *testing.T) {
+	is := is.New(t)
+	cond, err := ParseCondition([]byte(`{"type": "and", "of": [
+		{"type": "threshold", "field": "temperature", "max": 29},
+		{"type": "threshold", "field": "humidity", "min": 40}
+	]}`), nil)
+	is.NoErr(err)
+	_, err = cond(epoch.Add(time.Minute), []Series{
+		{Field: FieldTemperature, Points: []Point{{Time: epoch, Value: 31}}},
+		{Field: FieldHumidity, Points: []Point{{Time: epoch, Value: 30}}},
+	})
+	is.Equal(err.Error(), "2 of 2 conditions failed: temperature is 31, outside [-inf, 29]; humidity is 30, outside [40, +inf]")
+}
+
+func TestCompositeInvalid(t *testing.T) {
+	for _, spec := range []string{
+		`{"type": "and", "of": []}`,
+		`{"type": "not", "of": [{"type": "fresh", "window": "1m"}, {"type": "fresh", "window": "1m"}]}`,
+		`{"type": "atLeast", "k": 3, "of": [{"type": "fresh", "window": "1m"}]}`,
+		`{"type": "or", "k": 1, "of": [{"type": "fresh", "window": "1m"}]}`,
+		`{"type": "or", "of": [{"type": "nope"}]}`,
+		`{"type": "monitor", "name": "no states without an env"}`,
+	} {
+		t.Run(spec, func(t *testing.T) {
+			is := is.New(t)
+			_, err := ParseCondition([]byte(spec), nil)
+			is.True(err != nil)
+		})
+	}
+}
+
+func TestReferencesAndCycles(t *testing.T) {
+	is := is.New(t)
+	refs, err := References([]byte(`{"type": "or", "of": [
+		{"type": "monitor", "name": "a"},
+		{"type": "not", "of": [{"type": "monitor", "name": "b"}]},
+		{"type": "threshold", "field": "vpd", "max": 1.2}
+	]}`))
+	is.NoErr(err)
+	is.Equal(refs, []string{"a", "b"})
+
+	is.Equal(FindCycle(map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil}), nil)
+	is.Equal(strings.Join(FindCycle(map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}), " -> "), "a -> b -> c -> a")
+	is.Equal(FindCycle(map[string][]string{"a": {"a"}}), []string{"a", "a"})
+}
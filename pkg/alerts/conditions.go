@@ -0,0 +1,277 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Violation is the error a Condition returns when the data breaks it.
+// Alerts can unwrap it with errors.As to record a structured payload.
+type Violation struct {
+	Kind   string            `json:"kind"` // the kind of Condition that failed, e.g. threshold
+	Field  string            `json:"field,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	Time   time.Time         `json:"time"`
+	Value  float64           `json:"value"`
+	Raw    *float64          `json:"raw,omitempty"` // the uncalibrated value, if Value was calibrated
+	Min    *float64          `json:"min,omitempty"`
+	Max    *float64          `json:"max,omitempty"`
+	Reason string            `json:"reason"`
+	// Causes explain why a composite condition failed, one per failed part.
+	Causes []string `json:"causes,omitempty"`
+}
+
+// Error implements error.
+func (v *Violation) Error() string {
+	return v.Reason
+}
+
+// Threshold is a Condition that fails when the latest Point of any
+// Series for Field falls outside [Min, Max]. Either bound may be nil.
+// Night, if set, replaces Min and Max while Lights are off. If the
+// Threshold has a Grow whose current Stage targets Field, the Stage's
+// range is used instead.
+type Threshold struct {
+	Field  string         `json:"field"`
+	Min    *float64       `json:"min,omitempty"`
+	Max    *float64       `json:"max,omitempty"`
+	Night  *Range         `json:"night,omitempty"`
+	Grow   *Grow          `json:"-"`
+	Lights *LightSchedule `json:"-"`
+}
+
+// Validate reports whether the Threshold is usable.
+func (t *Threshold) Validate() error {
+	if t.Field == "" {
+		return fmt.Errorf("threshold needs a field")
+	}
+	if t.Min == nil && t.Max == nil && t.Grow == nil {
+		return fmt.Errorf("threshold needs a min or a max, or a running grow to take its bounds from")
+	}
+	if t.Night != nil && t.Night.Min != nil && t.Night.Max != nil && *t.Night.Min > *t.Night.Max {
+		return fmt.Errorf("threshold night min %g is above max %g", *t.Night.Min, *t.Night.Max)
+	}
+	if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+		return fmt.Errorf("threshold min %g is above max %g", *t.Min, *t.Max)
+	}
+	return nil
+}
+
+// Condition returns the Threshold as a Condition. It returns
+// ErrSuppressed while its Lights are settling after a switch.
+func (t *Threshold) Condition() Condition {
+	return func(now time.Time, series []Series) (bool, error) {
+		min, max := t.Min, t.Max
+		if t.Lights != nil {
+			if t.Lights.Settling(now) {
+				return false, ErrSuppressed
+			}
+			if t.Night != nil && !t.Lights.IsDay(now) {
+				min, max = t.Night.Min, t.Night.Max
+			}
+		}
+		if t.Grow != nil {
+			if r, ok := t.Grow.Bounds(t.Field, now); ok {
+				min, max = r.Min, r.Max
+			}
+		}
+		if min == nil && max == nil {
+			return false, fmt.Errorf("no %s target for the current stage", t.Field)
+		}
+		return checkBounds(t.Field, min, max, series)
+	}
+}
+
+// checkBounds fails on the first Series for field whose latest Point is
+// outside [min, max].
+func checkBounds(field string, min, max *float64, series []Series) (bool, error) {
+	found := false
+	for _, s := range series {
+		if s.Field != field {
+			continue
+		}
+		p, ok := s.Last()
+		if !ok {
+			continue
+		}
+		found = true
+		if (min != nil && p.Value < *min) || (max != nil && p.Value > *max) {
+			return false, &Violation{
+				Kind:   "threshold",
+				Field:  field,
+				Tags:   s.Tags,
+				Time:   p.Time,
+				Value:  p.Value,
+				Raw:    p.Raw,
+				Min:    min,
+				Max:    max,
+				Reason: fmt.Sprintf("%s is %g, outside %s", field, p.Value, bounds(min, max)),
+			}
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("no %s data", field)
+	}
+	return true, nil
+}
+
+// bounds formats a range for humans, e.g. "[0.8, 1.2]" or "[-inf, 29]".
+func bounds(min, max *float64) string {
+	lo, hi := "-inf", "+inf"
+	if min != nil {
+		lo = fmt.Sprintf("%g", *min)
+	}
+	if max != nil {
+		hi = fmt.Sprintf("%g", *max)
+	}
+	return fmt.Sprintf("[%s, %s]", lo, hi)
+}
+
+// Duration is a time.Duration that is written in JSON as a string like "15m".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Env holds what a Condition may need beyond its spec.
+type Env struct {
+	// Grow is the grow running where the monitor's device is, if any.
+	Grow *Grow
+	// Lights is the light schedule where the monitor's device is, if any.
+	Lights *LightSchedule
+	// State looks up another monitor's State by name, for conditions on
+	// other monitors.
+	State func(monitor string) (State, error)
+}
+
+// conditionBuilder turns the JSON spec of one type of Condition into a Condition.
+type conditionBuilder func(spec json.RawMessage, env *Env) (Condition, error)
+
+// conditions holds the builders for every Condition type that can be
+// configured as JSON, keyed by the spec's "type".
+var conditions = map[string]conditionBuilder{
+	"fresh": func(spec json.RawMessage, env *Env) (Condition, error) {
+		var f struct {
+			Window Duration `json:"window"`
+		}
+		if err := strictUnmarshal(spec, &f); err != nil {
+			return nil, err
+		}
+		if f.Window <= 0 {
+			return nil, fmt.Errorf("fresh needs a positive window")
+		}
+		return Fresh(time.Duration(f.Window)), nil
+	},
+	"threshold": func(spec json.RawMessage, env *Env) (Condition, error) {
+		var t Threshold
+		if err := strictUnmarshal(spec, &t); err != nil {
+			return nil, err
+		}
+		t.Lights = env.Lights
+		if env.Grow != nil {
+			g := *env.Grow
+			if g.IsDay == nil && env.Lights != nil {
+				g.IsDay = env.Lights.IsDay
+			}
+			t.Grow = &g
+		}
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+		return t.Condition(), nil
+	},
+}
+
+// ParseCondition builds a Condition from its JSON spec, an object whose
+// "type" names the kind of Condition and whose other keys configure it:
+//
+//	{"type": "threshold", "field": "vpd", "min": 0.8, "max": 1.2}
+//
+// env may be nil.
+func ParseCondition(spec []byte, env *Env) (Condition, error) {
+	if env == nil {
+		env = &Env{}
+	}
+	var head struct {
+		Type   string          `json:"type"`
+		Faults json.RawMessage `json:"faults"`
+	}
+	if err := json.Unmarshal(spec, &head); err != nil {
+		return nil, fmt.Errorf("invalid condition: %w", err)
+	}
+	build, ok := conditions[head.Type]
+	if !ok {
+		return nil, fmt.Errorf("invalid condition: unknown type %q, want one of %s",
+			head.Type, strings.Join(conditionTypes(), ", "))
+	}
+	cond, err := build(spec, env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s condition: %w", head.Type, err)
+	}
+	// Freshness doesn't look at values, so it only checks for sensor
+	// faults when asked to.
+	if head.Faults == nil && head.Type == "fresh" {
+		return cond, nil
+	}
+	faults := &Faults{}
+	if head.Faults != nil {
+		dec := json.NewDecoder(bytes.NewReader(head.Faults))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(faults); err != nil {
+			return nil, fmt.Errorf("invalid %s condition: faults: %w", head.Type, err)
+		}
+	}
+	if err := faults.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s condition: %w", head.Type, err)
+	}
+	return faults.Wrap(cond), nil
+}
+
+// conditionTypes returns the configurable Condition types in sorted order.
+func conditionTypes() []string {
+	types := make([]string, 0, len(conditions))
+	for t := range conditions {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// strictUnmarshal decodes a condition spec into v, rejecting unknown keys
+// other than "type" and "faults" so that typos don't silently disable a
+// bound.
+func strictUnmarshal(spec json.RawMessage, v interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(spec, &fields); err != nil {
+		return err
+	}
+	delete(fields, "type")
+	delete(fields, "faults")
+	clean, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(clean))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
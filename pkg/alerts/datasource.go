@@ -0,0 +1,131 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Point is a single timestamped value in a Series.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	// Raw is the value as the device reported it, if Value was calibrated.
+	Raw *float64 `json:"raw,omitempty"`
+}
+
+// Series is an ordered run of Points for one field of one measurement,
+// identified by its tags (e.g. the device UUID).
+type Series struct {
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Points      []Point           `json:"points"`
+}
+
+// Last returns the most recent Point in the Series and false if it is empty.
+func (s Series) Last() (Point, bool) {
+	if len(s.Points) == 0 {
+		return Point{}, false
+	}
+	return s.Points[len(s.Points)-1], true
+}
+
+// DataSource is anything a Monitor can query for timeseries data.
+type DataSource interface {
+	Query(ctx context.Context, query string) ([]Series, error)
+}
+
+// Condition decides whether the Series returned by a query are healthy
+// at the time now. It has the same contract as a Check.
+type Condition func(now time.Time, series []Series) (bool, error)
+
+// Rule pairs a query on a DataSource with the Condition its results
+// must meet. Its Check method can be used as a Monitor's Check.
+type Rule struct {
+	Source    DataSource
+	Query     string
+	Condition Condition
+	// Clock defaults to the wall clock.
+	Clock Clock
+}
+
+// Check runs the Rule's query and evaluates its Condition against the
+// result. A Rule without a Query evaluates its Condition without data,
+// e.g. for conditions on other monitors.
+func (r *Rule) Check(ctx context.Context) (bool, error) {
+	if r.Query == "" {
+		return r.Condition(clockOrDefault(r.Clock).Now(), nil)
+	}
+	series, err := r.Source.Query(ctx, r.Query)
+	if err != nil {
+		return false, fmt.Errorf("failed to query datasource: %w", err)
+	}
+	return r.Condition(clockOrDefault(r.Clock).Now(), series)
+}
+
+// Fresh is a Condition that passes if any Series has a Point
+// within window of now.
+func Fresh(window time.Duration) Condition {
+	return func(now time.Time, series []Series) (bool, error) {
+		then := now.Add(-window)
+		for _, s := range series {
+			if p, ok := s.Last(); ok && p.Time.After(then) {
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("no data in the last %s", window)
+	}
+}
+
+// MemorySource is an in-memory DataSource that answers queries with
+// canned Series. It is meant for tests and dry runs.
+type MemorySource struct {
+	mu      sync.Mutex
+	results map[string][]Series
+	err     error
+	calls   int
+}
+
+// NewMemorySource returns an empty MemorySource.
+func NewMemorySource() *MemorySource {
+	return &MemorySource{results: map[string][]Series{}}
+}
+
+// Set makes query return series.
+func (m *MemorySource) Set(query string, series ...Series) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[query] = series
+}
+
+// Fail makes every query return err until it is called again with nil.
+func (m *MemorySource) Fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// Calls returns how many times Query has been called.
+func (m *MemorySource) Calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+// Query implements DataSource.
+func (m *MemorySource) Query(ctx context.Context, query string) ([]Series, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls++
+	if m.err != nil {
+		return nil, m.err
+	}
+	series, ok := m.results[query]
+	if !ok {
+		return nil, fmt.Errorf("ErrUnknownQuery: %q", query)
+	}
+	return series, nil
+}
@@ -0,0 +1,143 @@
+package alerts
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Raw fields reported by GRO-01 units in the STBProto measurement.
+const (
+	FieldTemperature = "temperature" // air temperature in °C
+	FieldHumidity    = "humidity"    // relative humidity in %
+)
+
+// Fields derived from temperature and humidity.
+const (
+	FieldVPD              = "vpd"               // leaf vapor pressure deficit in kPa
+	FieldDewPoint         = "dew_point"         // dew point in °C
+	FieldAbsoluteHumidity = "absolute_humidity" // water vapor density in g/m³
+)
+
+// Derived wraps a DataSource and adds the derived grow metrics to its
+// results. Wherever a query returns temperature and humidity series for
+// the same measurement and tags, Derived adds vpd, dew_point and
+// absolute_humidity series computed at their shared timestamps, so
+// Conditions can use them like any other field.
+type Derived struct {
+	Source DataSource
+	// LeafOffset is the leaf temperature minus the air temperature in °C.
+	// Leaves usually run a degree or two cooler than the air under LEDs.
+	LeafOffset float64
+}
+
+// Query implements DataSource.
+func (d *Derived) Query(ctx context.Context, query string) ([]Series, error) {
+	series, err := d.Source.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return d.Derive(series), nil
+}
+
+// Derive returns series with the derived series appended.
+func (d *Derived) Derive(series []Series) []Series {
+	type pair struct{ temp, hum *Series }
+	groups := map[string]*pair{}
+	var order []string
+	for i := range series {
+		s := &series[i]
+		if s.Field != FieldTemperature && s.Field != FieldHumidity {
+			continue
+		}
+		k := groupKey(*s)
+		p, ok := groups[k]
+		if !ok {
+			p = &pair{}
+			groups[k] = p
+			order = append(order, k)
+		}
+		if s.Field == FieldTemperature {
+			p.temp = s
+		} else {
+			p.hum = s
+		}
+	}
+
+	out := append([]Series(nil), series...)
+	for _, k := range order {
+		p := groups[k]
+		if p.temp == nil || p.hum == nil {
+			continue
+		}
+		vpd := derivedSeries(*p.temp, FieldVPD)
+		dew := derivedSeries(*p.temp, FieldDewPoint)
+		abs := derivedSeries(*p.temp, FieldAbsoluteHumidity)
+
+		hum := map[time.Time]float64{}
+		for _, pt := range p.hum.Points {
+			hum[pt.Time] = pt.Value
+		}
+		for _, pt := range p.temp.Points {
+			rh, ok := hum[pt.Time]
+			if !ok {
+				continue
+			}
+			vpd.Points = append(vpd.Points, Point{Time: pt.Time, Value: VPD(pt.Value, rh, d.LeafOffset)})
+			dew.Points = append(dew.Points, Point{Time: pt.Time, Value: DewPoint(pt.Value, rh)})
+			abs.Points = append(abs.Points, Point{Time: pt.Time, Value: AbsoluteHumidity(pt.Value, rh)})
+		}
+		out = append(out, vpd, dew, abs)
+	}
+	return out
+}
+
+// derivedSeries returns an empty Series for field with the same
+// measurement and tags as s.
+func derivedSeries(s Series, field string) Series {
+	return Series{Measurement: s.Measurement, Field: field, Tags: s.Tags}
+}
+
+// groupKey identifies the measurement and tags a Series belongs to.
+func groupKey(s Series) string {
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(s.Measurement)
+	for _, k := range keys {
+		b.WriteString("," + k + "=" + s.Tags[k])
+	}
+	return b.String()
+}
+
+// SaturationVaporPressure returns the saturation vapor pressure of water
+// in kPa at temp °C, by the Tetens equation.
+func SaturationVaporPressure(temp float64) float64 {
+	return 0.61078 * math.Exp(17.27*temp/(temp+237.3))
+}
+
+// VPD returns the leaf vapor pressure deficit in kPa for air at temp °C
+// and rh % relative humidity, with leaves at temp+leafOffset °C.
+func VPD(temp, rh, leafOffset float64) float64 {
+	actual := SaturationVaporPressure(temp) * rh / 100
+	return SaturationVaporPressure(temp+leafOffset) - actual
+}
+
+// DewPoint returns the dew point in °C for air at temp °C and rh %
+// relative humidity, by the Magnus formula.
+func DewPoint(temp, rh float64) float64 {
+	const b, c = 17.62, 243.12
+	gamma := math.Log(rh/100) + b*temp/(c+temp)
+	return c * gamma / (b - gamma)
+}
+
+// AbsoluteHumidity returns the water vapor density in g/m³ for air at
+// temp °C and rh % relative humidity.
+func AbsoluteHumidity(temp, rh float64) float64 {
+	return 6.112 * math.Exp(17.67*temp/(temp+243.5)) * rh * 2.1674 / (273.15 + temp)
+}
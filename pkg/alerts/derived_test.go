@@ -0,0 +1,93 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestDerivedMetrics(t *testing.T) {
+	tests := []struct {
+		name                 string
+		temp, rh, leafOffset float64
+		vpd, dewPoint, abs   float64
+	}{
+		{name: "veg room", temp: 25, rh: 60, vpd: 1.267, dewPoint: 16.69, abs: 13.82},
+		{name: "cool leaves", temp: 25, rh: 60, leafOffset: -2, vpd: 0.909, dewPoint: 16.69, abs: 13.82},
+		{name: "saturated air", temp: 20, rh: 100, vpd: 0, dewPoint: 20, abs: 17.28},
+		{name: "hot and dry flower room", temp: 30, rh: 40, vpd: 2.546, dewPoint: 14.93, abs: 12.14},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			is.True(math.Abs(VPD(tt.temp, tt.rh, tt.leafOffset)-tt.vpd) < 0.01)
+			is.True(math.Abs(DewPoint(tt.temp, tt.rh)-tt.dewPoint) < 0.01)
+			is.True(math.Abs(AbsoluteHumidity(tt.temp, tt.rh)-tt.abs) < 0.01)
+		})
+	}
+}
+
+func TestDerivedSource(t *testing.T) {
+	is := is.New(t)
+	src := NewMemorySource()
+	tags := map[string]string{"UUID": "UUID: 00-00-01"}
+	src.Set("q",
+		Series{Measurement: "STBProto", Field: FieldTemperature, Tags: tags, Points: []Point{
+			{Time: epoch, Value: 25},
+			{Time: epoch.Add(time.Minute), Value: 30},
+		}},
+		Series{Measurement: "STBProto", Field: FieldHumidity, Tags: tags, Points: []Point{
+			{Time: epoch, Value: 60},
+			{Time: epoch.Add(time.Minute), Value: 40},
+		}},
+	)
+
+	series, err := (&Derived{Source: src}).Query(context.Background(), "q")
+	is.NoErr(err)
+	is.Equal(len(series), 5)
+	is.Equal(series[2].Field, FieldVPD)
+	is.Equal(series[2].Tags, tags)
+	is.Equal(len(series[2].Points), 2)
+
+	// alert if VPD leaves 0.8-1.2 kPa
+	cond, err := ParseCondition([]byte(`{"type": "threshold", "field": "vpd", "min": 0.8, "max": 1.2}`), nil)
+	is.NoErr(err)
+	ok, err := cond(epoch, series)
+	is.True(!ok)
+	var v *Violation
+	is.True(errors.As(err, &v))
+	is.Equal(v.Field, FieldVPD)
+	is.Equal(v.Tags, tags)
+	is.True(v.Value > 2.5)
+}
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  string
+	}{
+		{name: "fresh", spec: `{"type": "fresh", "window": "15m"}`},
+		{name: "threshold", spec: `{"type": "threshold", "field": "temperature", "max": 29}`},
+		{name: "unknown type", spec: `{"type": "nope"}`, err: `invalid condition: unknown type "nope", want one of and, anomaly, atLeast, delta, expr, forecast, fresh, monitor, not, or, percent, rate, threshold`},
+		{name: "typo", spec: `{"type": "threshold", "field": "temperature", "mx": 29}`, err: `invalid threshold condition: json: unknown field "mx"`},
+		{name: "no bounds", spec: `{"type": "threshold", "field": "temperature"}`, err: "invalid threshold condition: threshold needs a min or a max, or a running grow to take its bounds from"},
+		{name: "bad window", spec: `{"type": "fresh", "window": "soon"}`, err: `invalid fresh condition: time: invalid duration "soon"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			_, err := ParseCondition([]byte(tt.spec), nil)
+			if tt.err == "" {
+				is.NoErr(err)
+				return
+			}
+			is.True(err != nil)
+			is.Equal(err.Error(), tt.err)
+		})
+	}
+}
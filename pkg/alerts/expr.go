@@ -0,0 +1,612 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultExprTimeout is how long an expression may take to evaluate
+	// unless its condition sets its own timeout.
+	DefaultExprTimeout = 100 * time.Millisecond
+	// maxExprLen bounds the size of an expression's source.
+	maxExprLen = 1024
+)
+
+// Expr is a sandboxed boolean expression over the Series a query returns,
+// e.g. mean(temperature) > 29 && max(humidity) < 40. A bare field name is
+// its latest value, and the aggregate functions take a field name and
+// reduce every Point of it. Expressions can't loop, call out or allocate
+// beyond their inputs, and evaluation is cut off at Timeout.
+type Expr struct {
+	src  string
+	root *exprNode
+	// Timeout defaults to DefaultExprTimeout.
+	Timeout time.Duration
+}
+
+// aggregates are the functions that reduce a field's Points to a number.
+var aggregates = map[string]func(points []Point) float64{
+	"count": func(points []Point) float64 { return float64(len(points)) },
+	"first": func(points []Point) float64 { return points[0].Value },
+	"last":  func(points []Point) float64 { return points[len(points)-1].Value },
+	"max": func(points []Point) float64 {
+		max := points[0].Value
+		for _, p := range points[1:] {
+			if p.Value > max {
+				max = p.Value
+			}
+		}
+		return max
+	},
+	"mean": func(points []Point) float64 {
+		var sum float64
+		for _, p := range points {
+			sum += p.Value
+		}
+		return sum / float64(len(points))
+	},
+	"min": func(points []Point) float64 {
+		min := points[0].Value
+		for _, p := range points[1:] {
+			if p.Value < min {
+				min = p.Value
+			}
+		}
+		return min
+	},
+	"stddev": func(points []Point) float64 {
+		var sum, sumSq float64
+		for _, p := range points {
+			sum += p.Value
+			sumSq += p.Value * p.Value
+		}
+		n := float64(len(points))
+		return math.Sqrt(math.Max(0, sumSq/n-(sum/n)*(sum/n)))
+	},
+	"sum": func(points []Point) float64 {
+		var sum float64
+		for _, p := range points {
+			sum += p.Value
+		}
+		return sum
+	},
+}
+
+// functionNames returns every function an expression can call, sorted.
+func functionNames() []string {
+	names := []string{"abs"}
+	for name := range aggregates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseExpr parses and type checks an expression. Errors give the column
+// they were found at.
+func ParseExpr(src string) (*Expr, error) {
+	if len(src) > maxExprLen {
+		return nil, fmt.Errorf("expression is %d characters long, the limit is %d", len(src), maxExprLen)
+	}
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{src: src, tokens: tokens}
+	root, err := p.parse(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, exprErrorf(t.pos, "unexpected %q", t.text)
+	}
+	if root.typ != boolType {
+		return nil, exprErrorf(root.pos, "expression must be true or false, not a number")
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// String returns the expression's source.
+func (x *Expr) String() string {
+	return x.src
+}
+
+// Eval evaluates the expression against series. It also returns the value
+// of each field and function in it, to explain the result.
+func (x *Expr) Eval(series []Series) (bool, []string, error) {
+	timeout := x.Timeout
+	if timeout <= 0 {
+		timeout = DefaultExprTimeout
+	}
+	e := &exprEval{
+		src:      x.src,
+		series:   series,
+		deadline: time.Now().Add(timeout),
+		timeout:  timeout,
+		fields:   map[string][]Point{},
+		seen:     map[string]bool{},
+	}
+	v, err := e.eval(x.root)
+	if err != nil {
+		return false, nil, err
+	}
+	return v.b, e.explained, nil
+}
+
+// Condition returns a Condition that fails when the expression is true.
+func (x *Expr) Condition() Condition {
+	return func(now time.Time, series []Series) (bool, error) {
+		fire, explained, err := x.Eval(series)
+		if err != nil {
+			return false, fmt.Errorf("failed to evaluate %s: %w", x.src, err)
+		}
+		if !fire {
+			return true, nil
+		}
+		return false, &Violation{
+			Kind:   "expr",
+			Time:   now,
+			Reason: fmt.Sprintf("%s is true with %s", x.src, strings.Join(explained, ", ")),
+		}
+	}
+}
+
+type exprType int
+
+const (
+	numberType exprType = iota
+	boolType
+)
+
+func (t exprType) String() string {
+	if t == boolType {
+		return "true or false"
+	}
+	return "a number"
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	pos  int // byte offset in the source
+	text string
+}
+
+// exprOps are the operator tokens, longest first so "<=" beats "<".
+var exprOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "!", "(", ")", ","}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isDigit(c) || c == '.':
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && isDigit(src[i]) {
+					i++
+				}
+			}
+			if _, err := strconv.ParseFloat(src[start:i], 64); err != nil {
+				return nil, exprErrorf(start, "invalid number %q", src[start:i])
+			}
+			tokens = append(tokens, exprToken{kind: tokNumber, pos: start, text: src[start:i]})
+		case isLetter(c):
+			start := i
+			for i < len(src) && (isLetter(src[i]) || isDigit(src[i])) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokIdent, pos: start, text: src[start:i]})
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, exprErrorf(i, "unexpected character %q", src[i])
+			}
+			tokens = append(tokens, exprToken{kind: tokOp, pos: i, text: op})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, pos: len(src), text: "end of expression"}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isLetter reports whether c can start a field or function name.
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+// exprNode is a type checked node of an expression's syntax tree.
+type exprNode struct {
+	op       string // an operator, or one of num, bool, field and call
+	typ      exprType
+	pos, end int // the node's span in the source
+	num      float64
+	b        bool
+	name     string // the field or function name
+	args     []*exprNode
+}
+
+// binaryOps maps each binary operator to its precedence, higher binding tighter.
+var binaryOps = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6,
+}
+
+type exprParser struct {
+	src    string
+	tokens []exprToken
+	i      int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) expect(op string) (exprToken, error) {
+	t := p.next()
+	if t.kind != tokOp || t.text != op {
+		return t, exprErrorf(t.pos, "expected %q but found %q", op, t.text)
+	}
+	return t, nil
+}
+
+// parse parses binary operators that bind tighter than min by precedence climbing.
+func (p *exprParser) parse(min int) (*exprNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec, ok := binaryOps[t.text]
+		if t.kind != tokOp || !ok || prec <= min {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parse(prec)
+		if err != nil {
+			return nil, err
+		}
+		n := &exprNode{op: t.text, pos: left.pos, end: right.end, args: []*exprNode{left, right}}
+		switch {
+		case prec <= 2: // logical
+			n.typ = boolType
+			err = checkTypes(t, boolType, left, right)
+		case prec == 3: // equality
+			n.typ = boolType
+			err = checkTypes(t, left.typ, left, right)
+		case prec == 4: // comparison
+			n.typ = boolType
+			err = checkTypes(t, numberType, left, right)
+		default: // arithmetic
+			n.typ = numberType
+			err = checkTypes(t, numberType, left, right)
+		}
+		if err != nil {
+			return nil, err
+		}
+		left = n
+	}
+}
+
+// checkTypes makes sure every operand of op is of type want.
+func checkTypes(op exprToken, want exprType, operands ...*exprNode) error {
+	for _, o := range operands {
+		if o.typ != want {
+			return exprErrorf(o.pos, "%q needs %s, but %s is %s", op.text, want, o.text(), o.typ)
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) unary() (*exprNode, error) {
+	t := p.peek()
+	if t.kind == tokOp && (t.text == "!" || t.text == "-") {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		want := numberType
+		if t.text == "!" {
+			want = boolType
+		}
+		if err := checkTypes(t, want, operand); err != nil {
+			return nil, err
+		}
+		return &exprNode{op: t.text, typ: want, pos: t.pos, end: operand.end, args: []*exprNode{operand}}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (*exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		v, _ := strconv.ParseFloat(t.text, 64)
+		return &exprNode{op: "num", typ: numberType, pos: t.pos, end: t.pos + len(t.text), num: v}, nil
+	case tokIdent:
+		end := t.pos + len(t.text)
+		switch t.text {
+		case "true", "false":
+			return &exprNode{op: "bool", typ: boolType, pos: t.pos, end: end, b: t.text == "true"}, nil
+		}
+		if next := p.peek(); next.kind != tokOp || next.text != "(" {
+			return &exprNode{op: "field", typ: numberType, pos: t.pos, end: end, name: t.text}, nil
+		}
+		return p.call(t)
+	case tokOp:
+		if t.text == "(" {
+			n, err := p.parse(0)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+	return nil, exprErrorf(t.pos, "unexpected %q", t.text)
+}
+
+// call parses a function call to the function named by t.
+func (p *exprParser) call(t exprToken) (*exprNode, error) {
+	_, isAggregate := aggregates[t.text]
+	if !isAggregate && t.text != "abs" {
+		return nil, exprErrorf(t.pos, "unknown function %q, want one of %s", t.text, strings.Join(functionNames(), ", "))
+	}
+	p.next() // (
+	arg, err := p.parse(0)
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind == tokOp && next.text == "," {
+		return nil, exprErrorf(next.pos, "%s takes one argument", t.text)
+	}
+	closing, err := p.expect(")")
+	if err != nil {
+		return nil, err
+	}
+	if isAggregate && arg.op != "field" {
+		return nil, exprErrorf(arg.pos, "%s needs a field name, not %s", t.text, arg.text())
+	}
+	if err := checkTypes(t, numberType, arg); err != nil {
+		return nil, err
+	}
+	return &exprNode{op: "call", typ: numberType, pos: t.pos, end: closing.pos + 1, name: t.text, args: []*exprNode{arg}}, nil
+}
+
+// text describes a node for error messages.
+func (n *exprNode) text() string {
+	switch n.op {
+	case "num":
+		return strconv.FormatFloat(n.num, 'g', -1, 64)
+	case "bool":
+		return strconv.FormatBool(n.b)
+	case "field":
+		return n.name
+	case "call":
+		return n.name + "(" + n.args[0].text() + ")"
+	}
+	return "the " + n.op + " expression"
+}
+
+// exprValue is the result of evaluating an exprNode.
+type exprValue struct {
+	num float64
+	b   bool
+}
+
+type exprEval struct {
+	src       string
+	series    []Series
+	deadline  time.Time
+	timeout   time.Duration
+	steps     int
+	fields    map[string][]Point
+	seen      map[string]bool
+	explained []string
+}
+
+// step counts n units of work and fails once the deadline has passed.
+func (e *exprEval) step(n int) error {
+	e.steps += n
+	if e.steps >= 1024 {
+		e.steps = 0
+		if time.Now().After(e.deadline) {
+			return fmt.Errorf("expression took longer than %s", e.timeout)
+		}
+	}
+	return nil
+}
+
+// points returns every Point of a field across the Series in time order.
+func (e *exprEval) points(field string) ([]Point, error) {
+	if points, ok := e.fields[field]; ok {
+		return points, nil
+	}
+	var points []Point
+	for _, s := range e.series {
+		if s.Field != field {
+			continue
+		}
+		if err := e.step(len(s.Points)); err != nil {
+			return nil, err
+		}
+		points = append(points, s.Points...)
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no %s data", field)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	e.fields[field] = points
+	return points, nil
+}
+
+// explain records the value of a field or function for the explanation.
+func (e *exprEval) explain(n *exprNode, v float64) {
+	text := e.src[n.pos:n.end]
+	if e.seen[text] {
+		return
+	}
+	e.seen[text] = true
+	e.explained = append(e.explained, fmt.Sprintf("%s = %g", text, v))
+}
+
+func (e *exprEval) eval(n *exprNode) (exprValue, error) {
+	if err := e.step(1); err != nil {
+		return exprValue{}, err
+	}
+	switch n.op {
+	case "num":
+		return exprValue{num: n.num}, nil
+	case "bool":
+		return exprValue{b: n.b}, nil
+	case "field":
+		points, err := e.points(n.name)
+		if err != nil {
+			return exprValue{}, err
+		}
+		v := points[len(points)-1].Value
+		e.explain(n, v)
+		return exprValue{num: v}, nil
+	case "call":
+		if n.name == "abs" {
+			arg, err := e.eval(n.args[0])
+			return exprValue{num: math.Abs(arg.num)}, err
+		}
+		points, err := e.points(n.args[0].name)
+		if err != nil {
+			return exprValue{}, err
+		}
+		if err := e.step(len(points)); err != nil {
+			return exprValue{}, err
+		}
+		v := aggregates[n.name](points)
+		e.explain(n, v)
+		return exprValue{num: v}, nil
+	case "!":
+		v, err := e.eval(n.args[0])
+		return exprValue{b: !v.b}, err
+	}
+
+	left, err := e.eval(n.args[0])
+	if err != nil {
+		return exprValue{}, err
+	}
+	if len(n.args) == 1 { // unary minus
+		return exprValue{num: -left.num}, nil
+	}
+	// short circuit the logical operators
+	if (n.op == "&&" && !left.b) || (n.op == "||" && left.b) {
+		return left, nil
+	}
+	right, err := e.eval(n.args[1])
+	if err != nil {
+		return exprValue{}, err
+	}
+	l, r := left.num, right.num
+	switch n.op {
+	case "&&", "||":
+		return right, nil
+	case "==":
+		return exprValue{b: left == right}, nil
+	case "!=":
+		return exprValue{b: left != right}, nil
+	case "<":
+		return exprValue{b: l < r}, nil
+	case "<=":
+		return exprValue{b: l <= r}, nil
+	case ">":
+		return exprValue{b: l > r}, nil
+	case ">=":
+		return exprValue{b: l >= r}, nil
+	case "+":
+		return exprValue{num: l + r}, nil
+	case "-":
+		return exprValue{num: l - r}, nil
+	case "*":
+		return exprValue{num: l * r}, nil
+	case "/":
+		if r == 0 {
+			return exprValue{}, exprErrorf(n.args[1].pos, "division by zero")
+		}
+		return exprValue{num: l / r}, nil
+	}
+	return exprValue{}, exprErrorf(n.pos, "unknown operator %q", n.op)
+}
+
+// exprErrorf returns an error at a byte offset in an expression, reported
+// as a 1-based column.
+func exprErrorf(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", pos+1, fmt.Sprintf(format, args...))
+}
+
+func init() {
+	conditions["expr"] = func(spec json.RawMessage, env *Env) (Condition, error) {
+		var c struct {
+			Expr    string   `json:"expr"`
+			Timeout Duration `json:"timeout,omitempty"`
+		}
+		if err := strictUnmarshal(spec, &c); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(c.Expr) == "" {
+			return nil, fmt.Errorf("expr needs an expression")
+		}
+		if c.Timeout < 0 || time.Duration(c.Timeout) > time.Second {
+			return nil, fmt.Errorf("expr timeout must be between 0 and 1s")
+		}
+		x, err := ParseExpr(c.Expr)
+		if err != nil {
+			return nil, err
+		}
+		x.Timeout = time.Duration(c.Timeout)
+		return x.Condition(), nil
+	}
+}
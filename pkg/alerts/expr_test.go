@@ -0,0 +1,108 @@
+package alerts
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestExpr(t *testing.T) {
+	series := []Series{
+		{Field: FieldTemperature, Tags: map[string]string{DeviceTag: "a"}, Points: []Point{
+			{Time: epoch, Value: 28}, {Time: epoch.Add(2 * time.Minute), Value: 31},
+		}},
+		{Field: FieldTemperature, Tags: map[string]string{DeviceTag: "b"}, Points: []Point{
+			{Time: epoch.Add(time.Minute), Value: 30},
+		}},
+		{Field: FieldHumidity, Points: []Point{{Time: epoch, Value: 35}, {Time: epoch.Add(time.Minute), Value: 38}}},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: "mean(temperature) > 29 && max(humidity) < 40", want: true},
+		{expr: "mean(temperature) > 29 && max(humidity) < 38", want: false},
+		{expr: "temperature == 31", want: true},
+		{expr: "first(temperature) == 28 && last(temperature) == 31", want: true},
+		{expr: "count(temperature) == 3 && sum(humidity) == 73", want: true},
+		{expr: "min(temperature) < 20 || !(humidity >= 38)", want: false},
+		{expr: "abs(last(temperature) - first(temperature)) > 2", want: true},
+		{expr: "1 + 2 * 3 == 7 && -temperature < 0 && (1 + 2) * 3 == 9", want: true},
+		{expr: "10 - 4 - 3 == 3 && 8 / 4 / 2 == 1", want: true},
+		{expr: "stddev(humidity) == 1.5", want: true},
+		{expr: "true != false", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			is := is.New(t)
+			x, err := ParseExpr(tt.expr)
+			is.NoErr(err)
+			got, _, err := x.Eval(series)
+			is.NoErr(err)
+			is.Equal(got, tt.want)
+		})
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{expr: "mean(temperature)", err: "column 1: expression must be true or false, not a number"},
+		{expr: "avg(temperature) > 1", err: `column 1: unknown function "avg", want one of abs, count, first, last, max, mean, min, stddev, sum`},
+		{expr: "mean(temperature > 1", err: `column 21: expected ")" but found "end of expression"`},
+		{expr: "temperature > 1 &&", err: `column 19: unexpected "end of expression"`},
+		{expr: "temperature && true", err: `column 1: "&&" needs true or false, but temperature is a number`},
+		{expr: "mean(1) > 0", err: "column 6: mean needs a field name, not 1"},
+		{expr: "max(temperature, humidity) > 0", err: "column 16: max takes one argument"},
+		{expr: "temperature > 1 $", err: `column 17: unexpected character '$'`},
+		{expr: "temperature > 1 2", err: `column 17: unexpected "2"`},
+		{expr: "1..2 > 0", err: `column 1: invalid number "1..2"`},
+		{expr: strings.Repeat("1", 2000), err: "expression is 2000 characters long, the limit is 1024"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			is := is.New(t)
+			_, err := ParseExpr(tt.expr)
+			is.True(err != nil)
+			is.Equal(err.Error(), tt.err)
+		})
+	}
+}
+
+func TestExprCondition(t *testing.T) {
+	is := is.New(t)
+	cond, err := ParseCondition([]byte(`{"type": "expr", "expr": "mean(temperature) > 29 && max(humidity) < 40"}`), nil)
+	is.NoErr(err)
+	_, err = cond(epoch, []Series{
+		{Field: FieldTemperature, Points: []Point{{Time: epoch, Value: 30}}},
+		{Field: FieldHumidity, Points: []Point{{Time: epoch, Value: 35}}},
+	})
+	var v *Violation
+	is.True(errors.As(err, &v))
+	is.Equal(v.Reason, "mean(temperature) > 29 && max(humidity) < 40 is true with mean(temperature) = 30, max(humidity) = 35")
+
+	ok, err := cond(epoch, []Series{{Field: FieldTemperature, Points: []Point{{Time: epoch, Value: 30}}}})
+	is.True(!ok)
+	is.Equal(err.Error(), "failed to evaluate mean(temperature) > 29 && max(humidity) < 40: no humidity data")
+
+	_, err = ParseCondition([]byte(`{"type": "expr", "expr": "avg(temperature) > 29"}`), nil)
+	is.True(strings.HasPrefix(err.Error(), `invalid expr condition: column 1: unknown function "avg"`))
+}
+
+func TestExprTimeout(t *testing.T) {
+	is := is.New(t)
+	s := Series{Field: FieldTemperature}
+	for i := 0; i < 200000; i++ {
+		s.Points = append(s.Points, Point{Time: epoch.Add(time.Duration(i) * time.Second), Value: 25})
+	}
+	x, err := ParseExpr("mean(temperature) + stddev(temperature) + max(temperature) + min(temperature) > 0")
+	is.NoErr(err)
+	x.Timeout = time.Nanosecond
+	_, _, err = x.Eval([]Series{s})
+	is.Equal(err.Error(), "expression took longer than 1ns")
+}
@@ -0,0 +1,177 @@
+package alerts
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// KindSensorFault is the Violation kind for readings that say more about
+// the sensor than about the room, so they aren't mistaken for an
+// environmental alert.
+const KindSensorFault = "sensor_fault"
+
+// PhysicalRanges are the readings a working sensor can report for each
+// raw field. Anything outside them is a fault, not a measurement. Air is
+// never perfectly dry, so a humidity sensor reading 0% is broken.
+var PhysicalRanges = map[string]Range{
+	FieldTemperature: {Min: floatPtr(-40), Max: floatPtr(80)},
+	FieldHumidity:    {Min: floatPtr(0.1), Max: floatPtr(100)},
+	"heat_index":     {Min: floatPtr(-40), Max: floatPtr(100)},
+}
+
+// Faults configures the data-quality checks run before a Condition.
+// Physical range validation always runs; the rest are opt-in.
+type Faults struct {
+	// Stuck flags a Series whose value hasn't changed for this long.
+	Stuck Duration `json:"stuck,omitempty"`
+	// Spikes drops outliers before the Condition sees them.
+	Spikes *SpikeFilter `json:"spikes,omitempty"`
+}
+
+// SpikeFilter drops Points that differ from the median of the Window
+// Points around them by more than Tolerance, in the field's own units.
+type SpikeFilter struct {
+	Window    int     `json:"window"`
+	Tolerance float64 `json:"tolerance"`
+}
+
+// Validate reports whether the Faults config is usable.
+func (f *Faults) Validate() error {
+	if f.Stuck < 0 {
+		return fmt.Errorf("stuck must not be negative")
+	}
+	if f.Spikes != nil {
+		if f.Spikes.Window < 3 || f.Spikes.Window%2 == 0 {
+			return fmt.Errorf("spike window must be an odd number of at least 3")
+		}
+		if f.Spikes.Tolerance <= 0 {
+			return fmt.Errorf("spike tolerance must be positive")
+		}
+	}
+	return nil
+}
+
+// Wrap returns cond guarded by the data-quality checks. A fault fails
+// the check with a sensor_fault Violation instead of running cond.
+func (f *Faults) Wrap(cond Condition) Condition {
+	return func(now time.Time, series []Series) (bool, error) {
+		if v := f.Detect(series); v != nil {
+			return false, v
+		}
+		if f.Spikes != nil {
+			series = f.Spikes.Filter(series)
+		}
+		return cond(now, series)
+	}
+}
+
+// Detect returns a sensor_fault Violation for the first impossible or
+// stuck reading in series, or nil if the data looks sane.
+func (f *Faults) Detect(series []Series) *Violation {
+	for _, s := range series {
+		if r, ok := PhysicalRanges[s.Field]; ok {
+			for _, p := range s.Points {
+				v := p.Value
+				if p.Raw != nil {
+					v = *p.Raw
+				}
+				if (r.Min != nil && v < *r.Min) || (r.Max != nil && v > *r.Max) {
+					return &Violation{
+						Kind:   KindSensorFault,
+						Field:  s.Field,
+						Tags:   s.Tags,
+						Time:   p.Time,
+						Value:  v,
+						Min:    r.Min,
+						Max:    r.Max,
+						Reason: fmt.Sprintf("sensor fault: %s reads %g, outside its physical range %s", s.Field, v, bounds(r.Min, r.Max)),
+					}
+				}
+			}
+		}
+		if f.Stuck > 0 {
+			if v := stuck(s, time.Duration(f.Stuck)); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// stuck returns a Violation if the Series' latest value has been
+// reported unchanged for at least d.
+func stuck(s Series, d time.Duration) *Violation {
+	last, ok := s.Last()
+	if !ok {
+		return nil
+	}
+	since := last.Time
+	for i := len(s.Points) - 2; i >= 0 && s.Points[i].Value == last.Value; i-- {
+		since = s.Points[i].Time
+	}
+	if last.Time.Sub(since) < d {
+		return nil
+	}
+	return &Violation{
+		Kind:   KindSensorFault,
+		Field:  s.Field,
+		Tags:   s.Tags,
+		Time:   last.Time,
+		Value:  last.Value,
+		Raw:    last.Raw,
+		Reason: fmt.Sprintf("sensor fault: %s has read %g since %s", s.Field, last.Value, since.Format(time.RFC3339)),
+	}
+}
+
+// Filter returns a copy of series without the spikes.
+func (f *SpikeFilter) Filter(series []Series) []Series {
+	out := make([]Series, len(series))
+	half := f.Window / 2
+	for i, s := range series {
+		out[i] = s
+		if len(s.Points) < f.Window {
+			continue
+		}
+		kept := make([]Point, 0, len(s.Points))
+		for j, p := range s.Points {
+			lo, hi := j-half, j+half+1
+			if lo < 0 {
+				lo, hi = 0, f.Window
+			}
+			if hi > len(s.Points) {
+				lo, hi = len(s.Points)-f.Window, len(s.Points)
+			}
+			if abs(p.Value-median(s.Points[lo:hi])) <= f.Tolerance {
+				kept = append(kept, p)
+			}
+		}
+		out[i].Points = kept
+	}
+	return out
+}
+
+// median returns the median value of points.
+func median(points []Point) float64 {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.Value
+	}
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
@@ -0,0 +1,62 @@
+package alerts
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestFaults(t *testing.T) {
+	// readings returns a humidity Series with one Point per 10 minutes.
+	readings := func(values ...float64) []Series {
+		s := Series{Measurement: "environment", Field: FieldHumidity, Tags: map[string]string{DeviceTag: "gro-1"}}
+		for i, v := range values {
+			s.Points = append(s.Points, Point{Time: epoch.Add(time.Duration(i) * 10 * time.Minute), Value: v})
+		}
+		return []Series{s}
+	}
+	tests := []struct {
+		name   string
+		spec   string
+		series []Series
+		ok     bool
+		fault  bool
+	}{
+		{name: "healthy", spec: `{"type": "threshold", "field": "humidity", "max": 70}`, series: readings(55, 56, 55), ok: true},
+		{name: "impossible humidity", spec: `{"type": "threshold", "field": "humidity", "max": 70}`, series: readings(55, 150), fault: true},
+		{name: "zero humidity", spec: `{"type": "threshold", "field": "humidity", "min": 40}`, series: readings(55, 0), fault: true},
+		{name: "fresh ignores values by default", spec: `{"type": "fresh", "window": "1h"}`, series: readings(55, 150), ok: true},
+		{name: "fresh checks faults when asked", spec: `{"type": "fresh", "window": "1h", "faults": {}}`, series: readings(55, 150), fault: true},
+		{name: "stuck", spec: `{"type": "threshold", "field": "humidity", "max": 70, "faults": {"stuck": "30m"}}`, series: readings(55, 60, 60, 60, 60), fault: true},
+		{name: "not stuck long enough", spec: `{"type": "threshold", "field": "humidity", "max": 70, "faults": {"stuck": "1h"}}`, series: readings(55, 60, 60, 60, 60), ok: true},
+		{name: "spike alerts without filter", spec: `{"type": "threshold", "field": "humidity", "max": 70}`, series: readings(55, 56, 55, 56, 95)},
+		{name: "spike rejected", spec: `{"type": "threshold", "field": "humidity", "max": 70, "faults": {"spikes": {"window": 5, "tolerance": 5}}}`, series: readings(55, 56, 55, 56, 95), ok: true},
+		{name: "sustained rise isn't a spike", spec: `{"type": "threshold", "field": "humidity", "max": 70, "faults": {"spikes": {"window": 3, "tolerance": 5}}}`, series: readings(55, 56, 85, 86, 85)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			cond, err := ParseCondition([]byte(tt.spec), nil)
+			is.NoErr(err)
+			ok, err := cond(epoch.Add(time.Hour), tt.series)
+			is.Equal(ok, tt.ok)
+			var v *Violation
+			is.Equal(errors.As(err, &v) && v.Kind == KindSensorFault, tt.fault)
+		})
+	}
+}
+
+func TestFaultsValidate(t *testing.T) {
+	is := is.New(t)
+	for _, spec := range []string{
+		`{"type": "threshold", "field": "humidity", "max": 70, "faults": {"spikes": {"window": 4, "tolerance": 5}}}`,
+		`{"type": "threshold", "field": "humidity", "max": 70, "faults": {"spikes": {"window": 5}}}`,
+		`{"type": "threshold", "field": "humidity", "max": 70, "faults": {"stuck": "-1h"}}`,
+		`{"type": "threshold", "field": "humidity", "max": 70, "faults": {"stuk": "1h"}}`,
+	} {
+		_, err := ParseCondition([]byte(spec), nil)
+		is.True(err != nil) // spec should be rejected
+	}
+}
@@ -0,0 +1,232 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Forecast models.
+const (
+	// ModelLinear fits a least squares line through the Points.
+	ModelLinear = "linear"
+	// ModelHoltWinters runs additive Holt-Winters exponential smoothing
+	// over the Points, with a seasonal component if Season is set.
+	ModelHoltWinters = "holt-winters"
+)
+
+// Forecast fails when the latest Points of Field are predicted to cross
+// Min or Max within Horizon of now.
+type Forecast struct {
+	Field string   `json:"field"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	// Horizon is how far ahead a crossing is worth alerting about.
+	Horizon Duration `json:"horizon"`
+	// Model is linear or holt-winters. It defaults to linear.
+	Model string `json:"model,omitempty"`
+	// Points is how many of the latest Points to fit. It defaults to 12.
+	Points int `json:"points,omitempty"`
+	// Alpha, Beta and Gamma are the Holt-Winters smoothing factors for the
+	// level, trend and season, each in (0, 1]. They default to 0.5, 0.3
+	// and 0.1.
+	Alpha float64 `json:"alpha,omitempty"`
+	Beta  float64 `json:"beta,omitempty"`
+	Gamma float64 `json:"gamma,omitempty"`
+	// Season is the Holt-Winters season length in Points, e.g. 24 for a
+	// day of hourly Points. Without it the model has no seasonal component.
+	Season int `json:"season,omitempty"`
+}
+
+// Validate reports whether the Forecast can be evaluated, and fills in defaults.
+func (f *Forecast) Validate() error {
+	if f.Field == "" {
+		return fmt.Errorf("forecast needs a field")
+	}
+	if f.Min == nil && f.Max == nil {
+		return fmt.Errorf("forecast needs a min or a max")
+	}
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		return fmt.Errorf("forecast min %g is above max %g", *f.Min, *f.Max)
+	}
+	if f.Horizon <= 0 {
+		return fmt.Errorf("forecast needs a positive horizon")
+	}
+	switch f.Model {
+	case "":
+		f.Model = ModelLinear
+	case ModelLinear, ModelHoltWinters:
+	default:
+		return fmt.Errorf("forecast model must be %s or %s, not %q", ModelLinear, ModelHoltWinters, f.Model)
+	}
+	for _, factor := range []float64{f.Alpha, f.Beta, f.Gamma} {
+		if factor < 0 || factor > 1 {
+			return fmt.Errorf("forecast alpha, beta and gamma must be between 0 and 1")
+		}
+	}
+	if f.Points < 0 || f.Season < 0 {
+		return fmt.Errorf("forecast points and season must not be negative")
+	}
+	if f.Season > 0 && f.Model != ModelHoltWinters {
+		return fmt.Errorf("forecast season only applies to the %s model", ModelHoltWinters)
+	}
+	if f.Points == 0 {
+		f.Points = 12
+	}
+	if f.Season > 0 && f.Points < 2*f.Season {
+		return fmt.Errorf("forecast needs at least two seasons of points, %d", 2*f.Season)
+	}
+	if f.Alpha == 0 {
+		f.Alpha = 0.5
+	}
+	if f.Beta == 0 {
+		f.Beta = 0.3
+	}
+	if f.Gamma == 0 {
+		f.Gamma = 0.1
+	}
+	return nil
+}
+
+// Condition returns the Forecast as a Condition.
+func (f *Forecast) Condition() Condition {
+	return func(now time.Time, series []Series) (bool, error) {
+		found := false
+		for _, s := range series {
+			if s.Field != f.Field || len(s.Points) < 3 {
+				continue
+			}
+			points := s.Points
+			if len(points) > f.Points {
+				points = points[len(points)-f.Points:]
+			}
+			if f.Season > 0 && len(points) < 2*f.Season {
+				continue
+			}
+			found = true
+			if v := f.crossing(now, points); v != nil {
+				v.Tags = s.Tags
+				return false, v
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("not enough %s data to forecast", f.Field)
+		}
+		return true, nil
+	}
+}
+
+// crossing steps the fitted model forward through the horizon and returns
+// a Violation at the first predicted value outside the bounds.
+func (f *Forecast) crossing(now time.Time, points []Point) *Violation {
+	last := points[len(points)-1]
+	step := last.Time.Sub(points[0].Time) / time.Duration(len(points)-1)
+	if step <= 0 {
+		return nil
+	}
+	predict := f.fit(points, step)
+	end := now.Add(time.Duration(f.Horizon))
+	for h := 1; !last.Time.Add(time.Duration(h) * step).After(end); h++ {
+		at := last.Time.Add(time.Duration(h) * step)
+		v := predict(h)
+		var bound string
+		switch {
+		case f.Max != nil && v > *f.Max:
+			bound = fmt.Sprintf("above %g", *f.Max)
+		case f.Min != nil && v < *f.Min:
+			bound = fmt.Sprintf("below %g", *f.Min)
+		default:
+			continue
+		}
+		return &Violation{
+			Kind:   "forecast",
+			Field:  f.Field,
+			Time:   at,
+			Value:  v,
+			Min:    f.Min,
+			Max:    f.Max,
+			Reason: fmt.Sprintf("%s is forecast to be %.3g at %s, %s", f.Field, v, at.Format(time.RFC3339), bound),
+		}
+	}
+	return nil
+}
+
+// fit returns a function that predicts the value h steps after the last Point.
+func (f *Forecast) fit(points []Point, step time.Duration) func(h int) float64 {
+	if f.Model == ModelHoltWinters {
+		return f.holtWinters(points)
+	}
+
+	// least squares on time since the first Point, in steps
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(len(points))
+	for _, p := range points {
+		x := float64(p.Time.Sub(points[0].Time)) / float64(step)
+		sumX += x
+		sumY += p.Value
+		sumXY += x * p.Value
+		sumXX += x * x
+	}
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	intercept := (sumY - slope*sumX) / n
+	lastX := float64(points[len(points)-1].Time.Sub(points[0].Time)) / float64(step)
+	return func(h int) float64 {
+		return intercept + slope*(lastX+float64(h))
+	}
+}
+
+// holtWinters runs additive Holt-Winters smoothing over points, which are
+// assumed to be evenly spaced.
+func (f *Forecast) holtWinters(points []Point) func(h int) float64 {
+	m := f.Season
+	season := make([]float64, m)
+	level, trend := points[0].Value, points[1].Value-points[0].Value
+	if m > 0 {
+		// start from the first season's mean and the average change
+		// between the first two seasons
+		var first, second float64
+		for i := 0; i < m; i++ {
+			first += points[i].Value
+			second += points[m+i].Value
+		}
+		first, second = first/float64(m), second/float64(m)
+		level, trend = first, (second-first)/float64(m)
+		for i := 0; i < m; i++ {
+			season[i] = points[i].Value - first
+		}
+	}
+	for i, p := range points[1:] {
+		i++
+		var s float64
+		if m > 0 {
+			s = season[i%m]
+		}
+		prev := level
+		level = f.Alpha*(p.Value-s) + (1-f.Alpha)*(level+trend)
+		trend = f.Beta*(level-prev) + (1-f.Beta)*trend
+		if m > 0 {
+			season[i%m] = f.Gamma*(p.Value-level) + (1-f.Gamma)*s
+		}
+	}
+	n := len(points)
+	return func(h int) float64 {
+		v := level + float64(h)*trend
+		if m > 0 {
+			v += season[(n-1+h)%m]
+		}
+		return v
+	}
+}
+
+func init() {
+	conditions["forecast"] = func(spec json.RawMessage, env *Env) (Condition, error) {
+		var f Forecast
+		if err := strictUnmarshal(spec, &f); err != nil {
+			return nil, err
+		}
+		if err := f.Validate(); err != nil {
+			return nil, err
+		}
+		return f.Condition(), nil
+	}
+}
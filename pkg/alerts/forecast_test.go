@@ -0,0 +1,59 @@
+package alerts
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestForecast(t *testing.T) {
+	// every10m returns a temperature Series with a Point every 10 minutes
+	// ending at epoch.
+	every10m := func(value func(i int) float64, n int) []Series {
+		s := Series{Measurement: "environment", Field: FieldTemperature}
+		for i := 0; i < n; i++ {
+			at := epoch.Add(time.Duration(i-n+1) * 10 * time.Minute)
+			s.Points = append(s.Points, Point{Time: at, Value: value(i)})
+		}
+		return []Series{s}
+	}
+	rising := func(i int) float64 { return 26 + 0.5*float64(i) }          // +3°C an hour
+	steady := func(i int) float64 { return 26 + 0.1*float64(i%2) }        // flat
+	daily := func(i int) float64 { return 28 + 3*math.Sin(float64(i)/3) } // a short cycle
+
+	tests := []struct {
+		name   string
+		spec   string
+		series []Series
+		ok     bool
+		// at is when the crossing should be predicted, if it is.
+		at time.Time
+	}{
+		{name: "steady", spec: `{"type": "forecast", "field": "temperature", "max": 32, "horizon": "1h"}`, series: every10m(steady, 12), ok: true},
+		{name: "rising too far off", spec: `{"type": "forecast", "field": "temperature", "max": 34, "horizon": "50m"}`, series: every10m(rising, 12), ok: true},
+		{name: "rising within horizon", spec: `{"type": "forecast", "field": "temperature", "max": 34, "horizon": "1h"}`, series: every10m(rising, 12), at: epoch.Add(time.Hour)},
+		{name: "falling below min", spec: `{"type": "forecast", "field": "temperature", "min": 18, "horizon": "30m"}`, series: every10m(func(i int) float64 { return 50 - rising(i) }, 12), at: epoch.Add(20 * time.Minute)},
+		{name: "holt-winters trend", spec: `{"type": "forecast", "field": "temperature", "max": 34, "horizon": "1h", "model": "holt-winters"}`, series: every10m(rising, 12), at: epoch.Add(time.Hour)},
+		{name: "holt-winters season", spec: `{"type": "forecast", "field": "temperature", "max": 30.5, "horizon": "1h", "model": "holt-winters", "points": 57, "season": 19}`, series: every10m(daily, 57), at: epoch.Add(40 * time.Minute)},
+		{name: "too few points", spec: `{"type": "forecast", "field": "temperature", "max": 32, "horizon": "1h"}`, series: every10m(rising, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			cond, err := ParseCondition([]byte(tt.spec), nil)
+			is.NoErr(err)
+			ok, err := cond(epoch, tt.series)
+			is.Equal(ok, tt.ok)
+			var v *Violation
+			if errors.As(err, &v) {
+				is.Equal(v.Kind, "forecast")
+				if !tt.at.IsZero() {
+					is.Equal(v.Time, tt.at)
+				}
+			}
+		})
+	}
+}
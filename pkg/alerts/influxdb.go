@@ -2,79 +2,319 @@ package alerts
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
 )
 
 ///////////////////////////
 // INFLUXDB IMPLEMENTATION
 ///////////////////////////
 
-// InfluxClient holds methods for querying it and creating Alerts.
+const (
+	// DefaultInfluxBucket is the bucket growmon devices write to.
+	DefaultInfluxBucket = "growmon"
+	// DefaultInfluxTimeout bounds each request to InfluxDB.
+	DefaultInfluxTimeout = 30 * time.Second
+	// influxReconnectInterval is the least time between reconnects, so a
+	// down InfluxDB isn't hammered with new connections.
+	influxReconnectInterval = 10 * time.Second
+)
+
+// ErrInfluxClosed is returned by an InfluxClient after it's been closed.
+var ErrInfluxClosed = errors.New("ErrInfluxClosed")
+
+// InfluxConfig is how to reach InfluxDB.
+type InfluxConfig struct {
+	URL   string
+	Token string
+	// Org is the ID of the organization queries run in.
+	Org string
+	// Bucket is where device data is, and the default bucket of templates.
+	Bucket string
+	// Timeout bounds each request. It defaults to DefaultInfluxTimeout.
+	Timeout time.Duration
+}
+
+// InfluxConfigFromEnv reads an InfluxConfig from INFLUX_URL, INFLUX_TOKEN,
+// INFLUX_ORGID, INFLUX_BUCKET and INFLUX_TIMEOUT.
+func InfluxConfigFromEnv() (InfluxConfig, error) {
+	c := InfluxConfig{
+		URL:    os.Getenv("INFLUX_URL"),
+		Token:  os.Getenv("INFLUX_TOKEN"),
+		Org:    os.Getenv("INFLUX_ORGID"),
+		Bucket: os.Getenv("INFLUX_BUCKET"),
+	}
+	if c.Bucket == "" {
+		c.Bucket = DefaultInfluxBucket
+	}
+	if v := os.Getenv("INFLUX_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid INFLUX_TIMEOUT: %w", err)
+		}
+		c.Timeout = d
+	}
+	return c, nil
+}
+
+// Validate returns an error naming everything wrong with the config.
+func (c InfluxConfig) Validate() error {
+	var problems []string
+	if u, err := url.Parse(c.URL); c.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("INFLUX_URL %q must be an http or https URL", c.URL))
+	}
+	if c.Token == "" {
+		problems = append(problems, "INFLUX_TOKEN is required")
+	}
+	if c.Org == "" {
+		problems = append(problems, "INFLUX_ORGID is required")
+	}
+	if c.Bucket == "" {
+		problems = append(problems, "a bucket is required")
+	}
+	if c.Timeout < 0 {
+		problems = append(problems, "INFLUX_TIMEOUT can't be negative")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("ErrInvalidInfluxConfig: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// timeout returns the config's Timeout or its default.
+func (c InfluxConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultInfluxTimeout
+	}
+	return c.Timeout
+}
+
+// InfluxClient is the one connection to InfluxDB, shared by everything
+// that reads from it. It bounds every request by the config's Timeout,
+// reconnects when the connection fails, and fails with ErrInfluxClosed
+// once it's been closed.
 type InfluxClient struct {
-	client influxdb2.Client
+	config InfluxConfig
+
+	mu         sync.Mutex
+	client     influxdb2.Client
+	closed     bool
+	reconnects int
+	connected  time.Time // when client was made
+}
+
+// NewInfluxClient validates config and creates a client for it. It
+// doesn't talk to InfluxDB, so it succeeds while InfluxDB is down.
+func NewInfluxClient(config InfluxConfig) (*InfluxClient, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	i := &InfluxClient{config: config}
+	i.client = i.connect()
+	return i, nil
 }
 
-// NewInfluxClient creates a new InfluxDB client or returns an error.
-func NewInfluxClient(ctx context.Context) (*InfluxClient, error) {
-	influxURL := os.Getenv("INFLUX_URL")
-	influxToken := os.Getenv("INFLUX_TOKEN")
-	client := influxdb2.NewClient(influxURL, influxToken)
+// connect makes a new influxdb2 client for the config.
+func (i *InfluxClient) connect() influxdb2.Client {
+	i.connected = time.Now()
+	seconds := uint(i.config.timeout() / time.Second)
+	if seconds == 0 {
+		seconds = 1
+	}
+	opts := influxdb2.DefaultOptions().SetHTTPRequestTimeout(seconds)
+	return influxdb2.NewClientWithOptions(i.config.URL, i.config.Token, opts)
+}
 
-	go func(c context.Context) {
-		<-c.Done()
-		log.Printf("context cancellation detected")
-		// TODO: Handle client closure correctly
-		// defer client.Close()
-	}(ctx)
+// Config returns the config the client was made with.
+func (i *InfluxClient) Config() InfluxConfig {
+	return i.config
+}
 
-	return &InfluxClient{
-		client: client,
-	}, nil
+// get returns the current client, or ErrInfluxClosed.
+func (i *InfluxClient) get() (influxdb2.Client, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return nil, ErrInfluxClosed
+	}
+	return i.client, nil
+}
+
+// failed replaces the client after a request on it failed to reach
+// InfluxDB, at most once every influxReconnectInterval. Requests still
+// running on the old client finish on it.
+func (i *InfluxClient) failed(client influxdb2.Client, err error) {
+	var netErr net.Error
+	if !errors.As(err, &netErr) {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed || i.client != client || time.Since(i.connected) < influxReconnectInterval {
+		return
+	}
+	log.Printf("reconnecting to influxdb after: %v", err)
+	i.client = i.connect()
+	i.reconnects++
+	client.Close()
+}
+
+// Close closes the connection. It's safe to call more than once.
+func (i *InfluxClient) Close() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return
+	}
+	i.closed = true
+	i.client.Close()
+}
+
+// Query implements DataSource by running a Flux query and collecting
+// each numeric table in the result into a Series.
+func (i *InfluxClient) Query(ctx context.Context, query string) ([]Series, error) {
+	client, err := i.get()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, i.config.timeout())
+	defer cancel()
+	result, err := client.QueryAPI(i.config.Org).Query(ctx, query)
+	if err != nil {
+		i.failed(client, err)
+		return nil, err
+	}
+	defer result.Close()
+
+	var series []Series
+	index := map[int]int{} // flux table number to index in series
+	for result.Next() {
+		r := result.Record()
+		v, ok := toFloat(r.Value())
+		if !ok {
+			continue
+		}
+		idx, ok := index[r.Table()]
+		if !ok {
+			tags := map[string]string{}
+			for k, tv := range r.Values() {
+				if strings.HasPrefix(k, "_") || k == "result" || k == "table" {
+					continue
+				}
+				if s, ok := tv.(string); ok {
+					tags[k] = s
+				}
+			}
+			series = append(series, Series{
+				Measurement: r.Measurement(),
+				Field:       r.Field(),
+				Tags:        tags,
+			})
+			idx = len(series) - 1
+			index[r.Table()] = idx
+		}
+		series[idx].Points = append(series[idx].Points, Point{Time: r.Time(), Value: v})
+	}
+	return series, result.Err()
+}
+
+// Health returns an error unless InfluxDB is reachable and reports that
+// it's healthy.
+func (i *InfluxClient) Health(ctx context.Context) error {
+	client, err := i.get()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, i.config.timeout())
+	defer cancel()
+	hc, err := client.Health(ctx)
+	if err != nil {
+		i.failed(client, err)
+		return err
+	}
+	if hc.Status != domain.HealthCheckStatusPass {
+		msg := ""
+		if hc.Message != nil {
+			msg = ": " + *hc.Message
+		}
+		return fmt.Errorf("influxdb health check is %s%s", hc.Status, msg)
+	}
+	return nil
+}
+
+// Buckets lists the buckets the token can see.
+func (i *InfluxClient) Buckets(ctx context.Context) ([]domain.Bucket, error) {
+	client, err := i.get()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, i.config.timeout())
+	defer cancel()
+	buckets, err := client.BucketsAPI().GetBuckets(ctx)
+	if err != nil {
+		i.failed(client, err)
+		return nil, err
+	}
+	return *buckets, nil
+}
+
+// AsOf rewrites a Flux query to run as if it were t, so that relative
+// ranges like range(start: -1h) end at t. The now option goes after any
+// imports, where Flux requires options to be.
+func AsOf(query string, t time.Time) string {
+	lines := strings.Split(query, "\n")
+	i := 0
+	for i < len(lines) {
+		line := strings.TrimSpace(lines[i])
+		if line != "" && !strings.HasPrefix(line, "import ") {
+			break
+		}
+		i++
+	}
+	option := fmt.Sprintf("option now = () => %s", t.UTC().Format(time.RFC3339Nano))
+	return strings.Join(append(lines[:i:i], append([]string{option}, lines[i:]...)...), "\n")
+}
+
+// toFloat converts the numeric values Flux can return to a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
 }
 
 // create makes a new Monitor on the given DataSource.
 func (i *InfluxClient) create(ctx context.Context, query string) (*Monitor, error) {
-	// pass the client the oragnizationID must be
-	orgID := os.Getenv("INFLUX_ORGID")
-	if orgID == "" {
-		return nil, fmt.Errorf("ErrInvalidOrgID")
+	rule := &Rule{
+		Source: i,
+		Query:  query,
+		// TODO: check some configurable upper and lower bounds.
+		Condition: Fresh(time.Minute * 15),
 	}
-	api := i.client.QueryAPI(orgID) // TODO: get from env?
 	m := &Monitor{
-		Alert: func(ctx context.Context, err error) {
+		Source: "influxdb",
+		Alert: Notify("log", func(ctx context.Context, err error) error {
 			log.Printf("ERROR: monitor alerted: %+v", err)
-		},
+			return nil
+		}),
 		Interval: time.Minute * 15,
-		Check: func(ctx context.Context) (bool, error) {
-			result, err := api.Query(ctx, query)
-			if err != nil {
-				log.Printf("ERROR QUERYING INFLUXDB %+v", err)
-			}
-			defer result.Close()
-
-			// loop over until we prove our monitor correct.
-			// TODO: check some configurable upper and lower bounds.
-			ok := false
-			for result.Next() {
-				r := result.Record()
-				// fmt.Printf("r.Values(): %v\n", r.Values())
-				// fmt.Printf("r.Result(): %v\n", r.Result())
-				// fmt.Printf("r.Table(): %v\n", r.Table())
-				// fmt.Printf("r.Value(): %v\n", r.Value())
-				// fmt.Printf("r.Time(): %v\n", r.Time())
-				fmt.Printf("r.Values(): %v\n", r.Values())
-				then := time.Now().Add(-time.Minute * 15)
-				if r.Start().After(then) {
-					ok = true
-				}
-			}
-			return ok, err
-		},
+		Check:    rule.Check,
 	}
 	return m, nil
 }
@@ -0,0 +1,108 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestInfluxConfig(t *testing.T) {
+	valid := InfluxConfig{URL: "http://localhost:8086", Token: "token", Org: "org", Bucket: "growmon"}
+	tests := []struct {
+		name   string
+		modify func(c *InfluxConfig)
+		err    string
+	}{
+		{name: "valid", modify: func(c *InfluxConfig) {}},
+		{name: "no url", modify: func(c *InfluxConfig) { c.URL = "" }, err: "INFLUX_URL"},
+		{name: "not http", modify: func(c *InfluxConfig) { c.URL = "localhost:8086" }, err: "INFLUX_URL"},
+		{name: "no token", modify: func(c *InfluxConfig) { c.Token = "" }, err: "INFLUX_TOKEN"},
+		{name: "no org", modify: func(c *InfluxConfig) { c.Org = "" }, err: "INFLUX_ORGID"},
+		{name: "no bucket", modify: func(c *InfluxConfig) { c.Bucket = "" }, err: "bucket"},
+		{name: "negative timeout", modify: func(c *InfluxConfig) { c.Timeout = -time.Second }, err: "INFLUX_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			c := valid
+			tt.modify(&c)
+			err := c.Validate()
+			if tt.err == "" {
+				is.NoErr(err)
+				return
+			}
+			is.True(err != nil)
+			is.True(strings.Contains(err.Error(), tt.err))
+		})
+	}
+
+	t.Run("should read the env", func(t *testing.T) {
+		is := is.New(t)
+		t.Setenv("INFLUX_URL", "https://influx.example.com")
+		t.Setenv("INFLUX_TOKEN", "token")
+		t.Setenv("INFLUX_ORGID", "org")
+		t.Setenv("INFLUX_BUCKET", "")
+		t.Setenv("INFLUX_TIMEOUT", "5s")
+		c, err := InfluxConfigFromEnv()
+		is.NoErr(err)
+		is.Equal(c, InfluxConfig{URL: "https://influx.example.com", Token: "token", Org: "org", Bucket: DefaultInfluxBucket, Timeout: 5 * time.Second})
+
+		t.Setenv("INFLUX_TIMEOUT", "soon")
+		_, err = InfluxConfigFromEnv()
+		is.True(err != nil)
+	})
+}
+
+func TestInfluxClient(t *testing.T) {
+	// nothing listens on a port that was just closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	config := InfluxConfig{URL: "http://" + addr, Token: "token", Org: "org", Bucket: "growmon", Timeout: time.Second}
+
+	t.Run("should reconnect when InfluxDB can't be reached", func(t *testing.T) {
+		is := is.New(t)
+		i, err := NewInfluxClient(config)
+		is.NoErr(err)
+		defer i.Close()
+
+		i.mu.Lock()
+		i.connected = time.Now().Add(-influxReconnectInterval)
+		i.mu.Unlock()
+		is.True(i.Health(context.Background()) != nil)
+		is.Equal(i.reconnects, 1)
+
+		// not again until influxReconnectInterval has passed
+		_, err = i.Query(context.Background(), `from(bucket: "growmon") |> range(start: -1h)`)
+		is.True(err != nil)
+		is.Equal(i.reconnects, 1)
+	})
+
+	t.Run("should fail once closed", func(t *testing.T) {
+		is := is.New(t)
+		i, err := NewInfluxClient(config)
+		is.NoErr(err)
+		i.Close()
+		i.Close()
+
+		_, err = i.Query(context.Background(), `from(bucket: "growmon")`)
+		is.True(errors.Is(err, ErrInfluxClosed))
+		is.True(errors.Is(i.Health(context.Background()), ErrInfluxClosed))
+		_, err = i.Buckets(context.Background())
+		is.True(errors.Is(err, ErrInfluxClosed))
+	})
+
+	t.Run("should reject an invalid config", func(t *testing.T) {
+		is := is.New(t)
+		_, err := NewInfluxClient(InfluxConfig{})
+		is.True(err != nil)
+	})
+}
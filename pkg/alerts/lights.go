@@ -0,0 +1,110 @@
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSuppressed is returned by Checks that deliberately didn't judge the
+// data, e.g. while readings settle after the lights switch. Monitors keep
+// their current State instead of treating it as a failure.
+var ErrSuppressed = errors.New("ErrSuppressed")
+
+// day is the length of the cycle a LightSchedule repeats on.
+const day = 24 * time.Hour
+
+// TimeOfDay is an offset from midnight, written in JSON as "HH:MM".
+type TimeOfDay time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *TimeOfDay) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("time of day must be a string like \"06:00\": %w", err)
+	}
+	v, err := ParseTimeOfDay(s)
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (t TimeOfDay) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// String formats the TimeOfDay as "HH:MM".
+func (t TimeOfDay) String() string {
+	d := time.Duration(t)
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// ParseTimeOfDay parses "HH:MM" on a 24 hour clock.
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return TimeOfDay(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute), nil
+}
+
+// LightSchedule is when a room or device's lights are on. Lights come on
+// at On and go off at Off every day; if On equals Off they never go off.
+type LightSchedule struct {
+	On  TimeOfDay `json:"on"`
+	Off TimeOfDay `json:"off"`
+	// Location is the timezone On and Off are in. It defaults to UTC.
+	Location *time.Location `json:"-"`
+	// Settle is how long to suppress checks after the lights switch
+	// while temperature and humidity swing to their new levels.
+	Settle Duration `json:"settle"`
+}
+
+// sinceMidnight returns the wall clock time of t in the schedule's
+// Location, as a time since midnight. It's read off the clock rather than
+// measured from midnight, so that On and Off keep their wall clock times
+// on days that DST makes 23 or 25 hours long.
+func (l *LightSchedule) sinceMidnight(t time.Time) time.Duration {
+	loc := l.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second +
+		time.Duration(t.Nanosecond())
+}
+
+// IsDay reports whether the lights are on at t.
+func (l *LightSchedule) IsDay(t time.Time) bool {
+	on, off := time.Duration(l.On), time.Duration(l.Off)
+	m := l.sinceMidnight(t)
+	switch {
+	case on == off:
+		return true
+	case on < off:
+		return m >= on && m < off
+	default: // the light period runs over midnight
+		return m >= on || m < off
+	}
+}
+
+// Settling reports whether t is within Settle of the lights switching.
+func (l *LightSchedule) Settling(t time.Time) bool {
+	if l.Settle <= 0 || l.On == l.Off {
+		return false
+	}
+	m := l.sinceMidnight(t)
+	for _, switched := range []TimeOfDay{l.On, l.Off} {
+		since := (m - time.Duration(switched) + day) % day
+		if since < time.Duration(l.Settle) {
+			return true
+		}
+	}
+	return false
+}
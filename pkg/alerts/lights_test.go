@@ -0,0 +1,113 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+	_ "time/tzdata" // for the DST test's location
+
+	"github.com/matryer/is"
+)
+
+func TestLightSchedule(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		d, err := ParseTimeOfDay(hhmm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2022, 9, 9, 0, 0, 0, 0, time.UTC).Add(time.Duration(d))
+	}
+	tests := []struct {
+		name     string
+		schedule string
+		at       string
+		day      bool
+		settling bool
+	}{
+		{name: "veg 18/6 morning", schedule: `{"on": "06:00", "off": "00:00", "settle": "20m"}`, at: "09:00", day: true},
+		{name: "veg 18/6 night", schedule: `{"on": "06:00", "off": "00:00", "settle": "20m"}`, at: "03:00", day: false},
+		{name: "lights just came on", schedule: `{"on": "06:00", "off": "00:00", "settle": "20m"}`, at: "06:10", day: true, settling: true},
+		{name: "lights just went off", schedule: `{"on": "06:00", "off": "00:00", "settle": "20m"}`, at: "00:19", day: false, settling: true},
+		{name: "settled", schedule: `{"on": "06:00", "off": "00:00", "settle": "20m"}`, at: "06:20", day: true},
+		{name: "flower 12/12 over midnight", schedule: `{"on": "20:00", "off": "08:00"}`, at: "02:00", day: true},
+		{name: "flower 12/12 dark", schedule: `{"on": "20:00", "off": "08:00"}`, at: "12:00", day: false},
+		{name: "24 hours of light", schedule: `{"on": "00:00", "off": "00:00", "settle": "20m"}`, at: "00:05", day: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			var l LightSchedule
+			is.NoErr(json.Unmarshal([]byte(tt.schedule), &l))
+			is.Equal(l.IsDay(at(tt.at)), tt.day)
+			is.Equal(l.Settling(at(tt.at)), tt.settling)
+		})
+	}
+}
+
+func TestLightScheduleDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		at   time.Time
+		day  bool
+	}{
+		// the clocks skip 02:00-03:00, so 06:30 is 5h30m after midnight
+		{name: "spring forward", at: time.Date(2022, 3, 13, 6, 30, 0, 0, ny), day: true},
+		{name: "spring forward dark", at: time.Date(2022, 3, 13, 5, 30, 0, 0, ny), day: false},
+		// the clocks repeat 01:00-02:00, so 05:30 is 6h30m after midnight
+		{name: "fall back", at: time.Date(2022, 11, 6, 5, 30, 0, 0, ny), day: false},
+		{name: "fall back light", at: time.Date(2022, 11, 6, 6, 30, 0, 0, ny), day: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			var l LightSchedule
+			is.NoErr(json.Unmarshal([]byte(`{"on": "06:00", "off": "18:00"}`), &l))
+			l.Location = ny
+			is.Equal(l.IsDay(tt.at.UTC()), tt.day)
+		})
+	}
+}
+
+func TestThresholdPhotoperiod(t *testing.T) {
+	is := is.New(t)
+	lights := &LightSchedule{On: TimeOfDay(6 * time.Hour), Off: 0, Settle: Duration(20 * time.Minute)}
+	cond, err := ParseCondition([]byte(`{
+		"type": "threshold", "field": "temperature",
+		"min": 22, "max": 28, "night": {"min": 17, "max": 21}
+	}`), &Env{Lights: lights})
+	is.NoErr(err)
+
+	midnight := time.Date(2022, 9, 9, 0, 0, 0, 0, time.UTC)
+	temp := []Series{{Field: FieldTemperature, Points: []Point{{Time: midnight, Value: 20}}}}
+
+	ok, _ := cond(midnight.Add(12*time.Hour), temp)
+	is.True(!ok) // 20 is too cold for the day
+	ok, _ = cond(midnight.Add(3*time.Hour), temp)
+	is.True(ok) // but fine at night
+	_, err = cond(midnight.Add(6*time.Hour+5*time.Minute), temp)
+	is.Equal(err, ErrSuppressed) // lights just came on
+
+	t.Run("suppressed checks keep the monitor's state", func(t *testing.T) {
+		is := is.New(t)
+		results := []error{nil, ErrSuppressed}
+		mon := &Monitor{
+			Alert: func(ctx context.Context, err error) {},
+			Check: func(ctx context.Context) (bool, error) {
+				err := results[0]
+				results = results[1:]
+				return false, err
+			},
+			Clock: NewFakeClock(epoch),
+		}
+		state, _ := mon.Evaluate(context.Background())
+		is.Equal(state, StateFiring)
+		state, err := mon.Evaluate(context.Background())
+		is.Equal(err, ErrSuppressed)
+		is.Equal(state, StateFiring)
+	})
+}
@@ -0,0 +1,141 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default Prometheus registry, which
+// the server exposes at /metrics.
+var (
+	checkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "growalert",
+		Name:      "check_duration_seconds",
+		Help:      "How long Checks take to run, by monitor and datasource.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"monitor", "datasource"})
+
+	checkResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "growalert",
+		Name:      "checks_total",
+		Help:      "Check outcomes by monitor and result (pass, degraded, fail, suppressed or unknown).",
+	}, []string{"monitor", "result"})
+
+	alertsFiring = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "growalert",
+		Name:      "alerts_firing",
+		Help:      "Number of Monitors currently in the firing state, counted where each Monitor Counts.",
+	})
+
+	notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "growalert",
+		Name:      "notifications_total",
+		Help:      "Notification deliveries by channel and result (success or failure).",
+	}, []string{"channel", "result"})
+
+	schedulerLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "growalert",
+		Name:      "scheduler_lag_seconds",
+		Help:      "How late Checks start compared to when they were scheduled.",
+		Buckets:   []float64{.001, .01, .1, .5, 1, 5, 15, 60},
+	})
+
+	monitorsLoaded = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "growalert",
+		Name:      "monitors",
+		Help:      "Number of Monitors loaded into the Siren.",
+	})
+
+	sharedQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "growalert",
+		Name:      "shared_queries_total",
+		Help:      "Queries through a Shared datasource by result: miss (ran the query), shared (waited for the same query in flight) or cached.",
+	}, []string{"result"})
+
+	batchDevices = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "growalert",
+		Name:      "batch_devices",
+		Help:      "Number of devices each batched query ran for.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, 100},
+	})
+
+	datasourceUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "growalert",
+		Name:      "datasource_up",
+		Help:      "Whether a datasource's circuit breaker is closed (1) or open (0).",
+	}, []string{"datasource"})
+
+	batchQueriesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "growalert",
+		Name:      "batch_queries_saved_total",
+		Help:      "Per-device queries that didn't have to run because they were merged into a batch.",
+	})
+)
+
+// result names the outcome of a Check for the checks_total metric.
+func result(ok bool, err error) string {
+	switch {
+	case errors.Is(err, ErrSuppressed):
+		return "suppressed"
+	case errors.Is(err, ErrUnknown):
+		return "unknown"
+	case ok && err != nil:
+		return "degraded"
+	case ok:
+		return "pass"
+	default:
+		return "fail"
+	}
+}
+
+// recount keeps the firing gauge in step with whether the Monitor is
+// firing and Counts here.
+func (m *Monitor) recount() {
+	counts := m.Counts == nil || m.Counts()
+	m.mu.Lock()
+	was := m.counted
+	m.counted = counts && m.state == StateFiring
+	now := m.counted
+	m.mu.Unlock()
+	switch {
+	case !was && now:
+		alertsFiring.Inc()
+	case was && !now:
+		alertsFiring.Dec()
+	}
+}
+
+// uncount takes the Monitor out of the firing gauge, e.g. once it's removed.
+func (m *Monitor) uncount() {
+	m.mu.Lock()
+	was := m.counted
+	m.counted = false
+	m.mu.Unlock()
+	if was {
+		alertsFiring.Dec()
+	}
+}
+
+// Notify adapts a fallible send func for the named channel into an Alert.
+// Since Alerts can't fail, delivery errors are counted in the
+// notifications_total metric instead of being returned.
+func Notify(channel string, send func(ctx context.Context, err error) error) Alert {
+	return func(ctx context.Context, err error) {
+		if sendErr := send(ctx, err); sendErr != nil {
+			log.Printf("failed to notify channel %s: %v", channel, sendErr)
+			notifications.WithLabelValues(channel, "failure").Inc()
+			return
+		}
+		notifications.WithLabelValues(channel, "success").Inc()
+	}
+}
+
+// since returns the seconds elapsed from start on clock.
+func since(clock Clock, start time.Time) float64 {
+	return clock.Now().Sub(start).Seconds()
+}
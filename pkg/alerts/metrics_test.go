@@ -0,0 +1,75 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("should count notification deliveries per channel", func(t *testing.T) {
+		is := is.New(t)
+		ok := Notify("test-ok", func(ctx context.Context, err error) error { return nil })
+		bad := Notify("test-bad", func(ctx context.Context, err error) error { return fmt.Errorf("ErrMock") })
+
+		ok(context.Background(), nil)
+		ok(context.Background(), nil)
+		bad(context.Background(), nil)
+
+		is.Equal(testutil.ToFloat64(notifications.WithLabelValues("test-ok", "success")), 2.0)
+		is.Equal(testutil.ToFloat64(notifications.WithLabelValues("test-bad", "failure")), 1.0)
+	})
+
+	t.Run("should track firing monitors and check results", func(t *testing.T) {
+		is := is.New(t)
+		firing := testutil.ToFloat64(alertsFiring)
+
+		sc := &script{clock: NewFakeClock(epoch), results: []bool{false, false, true}}
+		mon := &Monitor{
+			Name:  "metrics-test",
+			Alert: func(ctx context.Context, err error) {},
+			Check: sc.Check,
+			Clock: sc.clock,
+		}
+		ctx := context.Background()
+
+		mon.Evaluate(ctx)
+		is.Equal(testutil.ToFloat64(alertsFiring), firing+1)
+		mon.Evaluate(ctx)
+		is.Equal(testutil.ToFloat64(alertsFiring), firing+1)
+		mon.Evaluate(ctx)
+		is.Equal(testutil.ToFloat64(alertsFiring), firing)
+
+		is.Equal(testutil.ToFloat64(checkResults.WithLabelValues("metrics-test", "fail")), 2.0)
+		is.Equal(testutil.ToFloat64(checkResults.WithLabelValues("metrics-test", "pass")), 1.0)
+	})
+
+	t.Run("should count firing monitors only where they count", func(t *testing.T) {
+		is := is.New(t)
+		firing := testutil.ToFloat64(alertsFiring)
+
+		owned := false
+		mon := &Monitor{Name: "metrics-owned", Counts: func() bool { return owned }}
+		siren := &Siren{External: true}
+		is.NoErr(siren.Add(context.Background(), mon))
+
+		mon.Restore(Progress{State: StateFiring, Since: epoch, Failures: 3})
+		is.Equal(testutil.ToFloat64(alertsFiring), firing) // another instance owns it
+
+		owned = true
+		mon.Restore(mon.Progress())
+		is.Equal(testutil.ToFloat64(alertsFiring), firing+1)
+
+		owned = false
+		mon.Restore(mon.Progress())
+		is.Equal(testutil.ToFloat64(alertsFiring), firing) // handed off
+
+		owned = true
+		mon.Restore(mon.Progress())
+		siren.Remove(mon.Name)
+		is.Equal(testutil.ToFloat64(alertsFiring), firing)
+	})
+}
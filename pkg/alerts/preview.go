@@ -0,0 +1,91 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Summary aggregates one Series for a Preview.
+type Summary struct {
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Count       int               `json:"count"`
+	Min         float64           `json:"min"`
+	Max         float64           `json:"max"`
+	Mean        float64           `json:"mean"`
+	Last        *Point            `json:"last,omitempty"`
+}
+
+// Summarize aggregates each Series.
+func Summarize(series []Series) []Summary {
+	summaries := make([]Summary, len(series))
+	for i, s := range series {
+		sum := Summary{Measurement: s.Measurement, Field: s.Field, Tags: s.Tags, Count: len(s.Points)}
+		if last, ok := s.Last(); ok {
+			sum.Last = &last
+			sum.Min = aggregates["min"](s.Points)
+			sum.Max = aggregates["max"](s.Points)
+			sum.Mean = aggregates["mean"](s.Points)
+		}
+		summaries[i] = sum
+	}
+	return summaries
+}
+
+// Preview is the outcome of a dry run of a Rule.
+type Preview struct {
+	Series    []Series  `json:"series"`
+	Summaries []Summary `json:"summaries"`
+	// State is what a Monitor without a hold would be in after the
+	// Check: ok, firing, suppressed if the Condition didn't judge, or
+	// unknown if the datasource is down.
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Violation *Violation `json:"violation,omitempty"`
+	QueryTime Duration   `json:"queryTime"`
+	EvalTime  Duration   `json:"evalTime"`
+}
+
+// Preview runs the Rule's query and Condition once, like Check, and
+// reports what it found without alerting anyone.
+func (r *Rule) Preview(ctx context.Context) *Preview {
+	clock := clockOrDefault(r.Clock)
+	p := &Preview{Series: []Series{}, Summaries: []Summary{}}
+
+	start := time.Now()
+	var series []Series
+	if r.Query != "" {
+		var err error
+		series, err = r.Source.Query(ctx, r.Query)
+		p.QueryTime = Duration(time.Since(start))
+		if err != nil {
+			p.State = StateFiring.String()
+			if errors.Is(err, ErrUnknown) {
+				p.State = "unknown"
+			}
+			p.Error = "failed to query datasource: " + err.Error()
+			return p
+		}
+		p.Series = series
+		p.Summaries = Summarize(series)
+	}
+
+	start = time.Now()
+	ok, err := r.Condition(clock.Now(), series)
+	p.EvalTime = Duration(time.Since(start))
+	switch {
+	case errors.Is(err, ErrSuppressed):
+		p.State = "suppressed"
+	case ok:
+		p.State = StateOK.String()
+	default:
+		p.State = StateFiring.String()
+	}
+	if err != nil {
+		p.Error = err.Error()
+		errors.As(err, &p.Violation)
+	}
+	return p
+}
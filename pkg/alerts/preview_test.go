@@ -0,0 +1,40 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestRulePreview(t *testing.T) {
+	is := is.New(t)
+	src := NewMemorySource()
+	src.Set("q", Series{Field: FieldTemperature, Points: []Point{
+		{Time: epoch, Value: 27}, {Time: epoch.Add(time.Minute), Value: 31},
+	}})
+	clock := NewFakeClock(epoch)
+	rule := &Rule{Source: src, Query: "q", Condition: (&Threshold{Field: FieldTemperature, Max: float(29)}).Condition(), Clock: clock}
+
+	p := rule.Preview(context.Background())
+	is.Equal(p.State, "firing")
+	is.Equal(len(p.Series), 1)
+	is.Equal(p.Summaries[0].Count, 2)
+	is.Equal(p.Summaries[0].Mean, 29.0)
+	is.Equal(p.Summaries[0].Last.Value, 31.0)
+	is.Equal(p.Violation.Value, 31.0)
+	is.Equal(p.Error, "temperature is 31, outside [-inf, 29]")
+
+	rule.Condition = (&Threshold{Field: FieldTemperature, Max: float(32)}).Condition()
+	p = rule.Preview(context.Background())
+	is.Equal(p.State, "ok")
+	is.Equal(p.Error, "")
+
+	src.Fail(errors.New("ErrDown"))
+	p = rule.Preview(context.Background())
+	is.Equal(p.State, "firing")
+	is.Equal(p.Error, "failed to query datasource: ErrDown")
+	is.Equal(len(p.Series), 0)
+}
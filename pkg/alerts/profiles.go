@@ -0,0 +1,104 @@
+package alerts
+
+import (
+	"fmt"
+	"time"
+)
+
+// Range is an inclusive range of acceptable values. Either end may be nil.
+type Range struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// Targets are the ranges a metric should stay in during a Stage.
+// Night falls back to Day when it isn't set.
+type Targets struct {
+	Day   Range  `json:"day"`
+	Night *Range `json:"night,omitempty"`
+}
+
+// Stage is one phase of a grow, e.g. seedling, veg or flower.
+type Stage struct {
+	Name     string             `json:"name"`
+	Duration Duration           `json:"duration"`
+	Targets  map[string]Targets `json:"targets"` // keyed by field, e.g. vpd
+}
+
+// Profile is the plan for a crop: its Stages in order.
+type Profile struct {
+	Name   string  `json:"name"`
+	Stages []Stage `json:"stages"`
+}
+
+// Validate reports whether the Profile is usable.
+func (p *Profile) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("profile needs a name")
+	}
+	if len(p.Stages) == 0 {
+		return fmt.Errorf("profile %q needs at least one stage", p.Name)
+	}
+	for i, s := range p.Stages {
+		if s.Name == "" {
+			return fmt.Errorf("stage %d needs a name", i)
+		}
+		if s.Duration <= 0 {
+			return fmt.Errorf("stage %q needs a positive duration", s.Name)
+		}
+		for field, t := range s.Targets {
+			ranges := []Range{t.Day}
+			if t.Night != nil {
+				ranges = append(ranges, *t.Night)
+			}
+			for _, r := range ranges {
+				if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+					return fmt.Errorf("stage %q %s target min %g is above max %g", s.Name, field, *r.Min, *r.Max)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Grow is a Profile running in a room or on a device since Start.
+type Grow struct {
+	Profile *Profile
+	Start   time.Time
+	// IsDay reports whether the lights are on at a time. Without it
+	// the day targets always apply.
+	IsDay func(t time.Time) bool
+}
+
+// Stage returns the index of the Stage the Grow is in at now, or -1 if it
+// hasn't started. The last Stage lasts until the Grow is ended.
+func (g *Grow) Stage(now time.Time) int {
+	if now.Before(g.Start) {
+		return -1
+	}
+	end := g.Start
+	for i, s := range g.Profile.Stages {
+		end = end.Add(time.Duration(s.Duration))
+		if now.Before(end) {
+			return i
+		}
+	}
+	return len(g.Profile.Stages) - 1
+}
+
+// Bounds returns the range field should be in at now, and false if the
+// current Stage has no target for it.
+func (g *Grow) Bounds(field string, now time.Time) (Range, bool) {
+	i := g.Stage(now)
+	if i < 0 {
+		return Range{}, false
+	}
+	t, ok := g.Profile.Stages[i].Targets[field]
+	if !ok {
+		return Range{}, false
+	}
+	if t.Night != nil && g.IsDay != nil && !g.IsDay(now) {
+		return *t.Night, true
+	}
+	return t.Day, true
+}
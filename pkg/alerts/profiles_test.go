@@ -0,0 +1,74 @@
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// tomato is a two-stage profile with day and night temperature targets.
+const tomato = `{
+	"name": "tomato",
+	"stages": [
+		{"name": "veg", "duration": "336h", "targets": {
+			"temperature": {"day": {"min": 22, "max": 28}, "night": {"min": 18, "max": 22}},
+			"vpd": {"day": {"min": 0.8, "max": 1.2}}
+		}},
+		{"name": "flower", "duration": "1344h", "targets": {
+			"temperature": {"day": {"min": 20, "max": 26}}
+		}}
+	]
+}`
+
+func TestGrowProfiles(t *testing.T) {
+	is := is.New(t)
+	var p Profile
+	is.NoErr(json.Unmarshal([]byte(tomato), &p))
+	is.NoErr(p.Validate())
+
+	day := 24 * time.Hour
+	night := false
+	g := &Grow{Profile: &p, Start: epoch, IsDay: func(time.Time) bool { return !night }}
+
+	t.Run("should find the active stage", func(t *testing.T) {
+		is := is.New(t)
+		is.Equal(g.Stage(epoch.Add(-time.Hour)), -1)
+		is.Equal(g.Stage(epoch), 0)
+		is.Equal(g.Stage(epoch.Add(13*day)), 0)
+		is.Equal(g.Stage(epoch.Add(14*day)), 1)
+		is.Equal(g.Stage(epoch.Add(400*day)), 1) // the last stage lasts until the grow ends
+	})
+
+	t.Run("should take threshold bounds from the active stage", func(t *testing.T) {
+		is := is.New(t)
+		cond, err := ParseCondition([]byte(`{"type": "threshold", "field": "temperature"}`), &Env{Grow: g})
+		is.NoErr(err)
+		temp := func(v float64) []Series {
+			return []Series{{Field: FieldTemperature, Points: []Point{{Time: epoch, Value: v}}}}
+		}
+
+		ok, _ := cond(epoch.Add(day), temp(27))
+		is.True(ok) // within veg's 22-28
+		ok, err = cond(epoch.Add(20*day), temp(27))
+		is.True(!ok) // above flower's 26
+		var v *Violation
+		is.True(errors.As(err, &v))
+		is.Equal(*v.Max, 26.0)
+
+		night = true
+		defer func() { night = false }()
+		ok, _ = cond(epoch.Add(day), temp(24))
+		is.True(!ok) // above veg's night 22
+		ok, _ = cond(epoch.Add(20*day), temp(24))
+		is.True(ok) // flower has no night target, so day applies
+	})
+
+	t.Run("should need bounds without a grow", func(t *testing.T) {
+		is := is.New(t)
+		_, err := ParseCondition([]byte(`{"type": "threshold", "field": "temperature"}`), nil)
+		is.True(err != nil)
+	})
+}
@@ -0,0 +1,239 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleTest is a regression test for a monitor, in the spirit of promtool
+// test rules. It declares synthetic input Series, the monitor under test,
+// and the State the monitor must be in at given times. Times are offsets
+// from the start of the test.
+type RuleTest struct {
+	Name string `json:"name"`
+	// Interval is the time between input values. It defaults to 1m.
+	Interval Duration        `json:"interval,omitempty"`
+	Monitor  RuleTestMonitor `json:"monitor"`
+	Series   []InputSeries   `json:"series"`
+	Expect   []ExpectedState `json:"expect"`
+}
+
+// RuleTestMonitor is the monitor under test. Its keys are the same as the
+// matching fields of a monitor definition for /monitors.
+type RuleTestMonitor struct {
+	Name string `json:"name"`
+	// Interval is how often the monitor checks. It defaults to the test's.
+	Interval   Duration        `json:"interval,omitempty"`
+	For        Duration        `json:"for,omitempty"`
+	Condition  json.RawMessage `json:"condition"`
+	LeafOffset float64         `json:"leafOffset,omitempty"`
+}
+
+// InputSeries is a synthetic Series with one value per test Interval,
+// starting at the start of the test. Values uses promtool's expanding
+// notation: "1 2 3", "1+2x3" for 1 3 5 7, "5-1x2" for 5 4 3, "1x3" for
+// 1 1 1 1, and "_" or "_x3" to skip one or three intervals.
+type InputSeries struct {
+	Measurement string            `json:"measurement,omitempty"`
+	Field       string            `json:"field"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Values      string            `json:"values"`
+}
+
+// ExpectedState is the State the monitor must be in after its Check At
+// an offset. If Reason is set, the Check's error must contain it.
+type ExpectedState struct {
+	At     Duration `json:"at"`
+	State  string   `json:"state"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// LoadRuleTest reads a RuleTest from a JSON file, rejecting unknown keys.
+func LoadRuleTest(path string) (*RuleTest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var t RuleTest
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if t.Name == "" {
+		t.Name = path
+	}
+	return &t, nil
+}
+
+// Run replays the monitor over the input Series from a MemorySource and
+// returns one error per expectation it didn't meet.
+func (t *RuleTest) Run(ctx context.Context) ([]error, error) {
+	interval := time.Duration(t.Interval)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	every := time.Duration(t.Monitor.Interval)
+	if every <= 0 {
+		every = interval
+	}
+	if len(t.Expect) == 0 {
+		return nil, fmt.Errorf("%s expects nothing", t.Name)
+	}
+
+	start := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	src := NewMemorySource()
+	var series []Series
+	for i, in := range t.Series {
+		s, err := in.series(start, interval)
+		if err != nil {
+			return nil, fmt.Errorf("series %d: %w", i+1, err)
+		}
+		series = append(series, s)
+	}
+	src.Set(t.Name, series...)
+
+	cond := Fresh(every)
+	if len(t.Monitor.Condition) > 0 {
+		var err error
+		if cond, err = ParseCondition(t.Monitor.Condition, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	type check struct {
+		state State
+		err   error
+	}
+	checks := map[time.Duration]check{}
+	end := time.Duration(0)
+	for _, e := range t.Expect {
+		if _, err := ParseState(e.State); err != nil {
+			return nil, fmt.Errorf("expectation at %s: %w", time.Duration(e.At), err)
+		}
+		if time.Duration(e.At) > end {
+			end = time.Duration(e.At)
+		}
+	}
+
+	derived := &Derived{LeafOffset: t.Monitor.LeafOffset}
+	b := &Backtest{
+		Query: func(ctx context.Context, at time.Time) ([]Series, error) {
+			all, err := src.Query(ctx, t.Name)
+			if err != nil {
+				return nil, err
+			}
+			return derived.Derive(until(all, at)), nil
+		},
+		Condition: cond,
+		Interval:  every,
+		For:       time.Duration(t.Monitor.For),
+		Start:     start,
+		End:       start.Add(end),
+		OnCheck: func(at time.Time, state State, err error) {
+			checks[at.Sub(start)] = check{state, err}
+		},
+	}
+	if _, err := b.Run(ctx); err != nil {
+		return nil, err
+	}
+
+	var failures []error
+	for _, e := range t.Expect {
+		at := time.Duration(e.At)
+		c, ok := checks[at]
+		switch {
+		case !ok:
+			failures = append(failures, fmt.Errorf("at %s: the monitor didn't check, it checks every %s", at, every))
+		case c.state.String() != e.State:
+			failures = append(failures, fmt.Errorf("at %s: state is %s, want %s (%v)", at, c.state, e.State, c.err))
+		case e.Reason != "" && (c.err == nil || !strings.Contains(c.err.Error(), e.Reason)):
+			failures = append(failures, fmt.Errorf("at %s: reason is %v, want it to contain %q", at, c.err, e.Reason))
+		}
+	}
+	return failures, nil
+}
+
+// until returns a copy of series without the Points after t.
+func until(series []Series, t time.Time) []Series {
+	out := make([]Series, len(series))
+	for i, s := range series {
+		out[i] = s
+		n := 0
+		for n < len(s.Points) && !s.Points[n].Time.After(t) {
+			n++
+		}
+		out[i].Points = s.Points[:n]
+	}
+	return out
+}
+
+// series expands the InputSeries into a Series starting at start.
+func (in *InputSeries) series(start time.Time, interval time.Duration) (Series, error) {
+	s := Series{Measurement: in.Measurement, Field: in.Field, Tags: in.Tags}
+	if in.Field == "" {
+		return s, fmt.Errorf("series needs a field")
+	}
+	i := 0
+	for _, term := range strings.Fields(in.Values) {
+		values, err := expandValues(term)
+		if err != nil {
+			return s, err
+		}
+		for _, v := range values {
+			if v != nil {
+				s.Points = append(s.Points, Point{Time: start.Add(time.Duration(i) * interval), Value: *v})
+			}
+			i++
+		}
+	}
+	return s, nil
+}
+
+// expandValues expands one term of promtool's series notation. Skipped
+// intervals are nil.
+func expandValues(term string) ([]*float64, error) {
+	base, times, repeated := term, 0, false
+	if i := strings.LastIndex(term, "x"); i > 0 {
+		n, err := strconv.Atoi(term[i+1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid repeat in %q", term)
+		}
+		base, times, repeated = term[:i], n, true
+	}
+	if base == "_" {
+		// like promtool, "_" skips one interval and "_x3" skips three
+		if !repeated {
+			times = 1
+		}
+		return make([]*float64, times), nil
+	}
+
+	step := 0.0
+	if i := strings.LastIndexAny(base, "+-"); i > 0 && base[i-1] != 'e' && base[i-1] != 'E' {
+		s, err := strconv.ParseFloat(base[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step in %q", term)
+		}
+		if base[i] == '-' {
+			s = -s
+		}
+		base, step = base[:i], s
+	}
+	first, err := strconv.ParseFloat(base, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", term)
+	}
+	values := make([]*float64, times+1)
+	for i := range values {
+		v := first + float64(i)*step
+		values[i] = &v
+	}
+	return values, nil
+}
@@ -0,0 +1,97 @@
+package alerts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// TestRuleFiles runs every rule test in testdata/rules, and any matched by
+// the RULE_TESTS glob, e.g. RULE_TESTS='../../monitors/*.json'.
+func TestRuleFiles(t *testing.T) {
+	paths, err := filepath.Glob("testdata/rules/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if glob := os.Getenv("RULE_TESTS"); glob != "" {
+		more, err := filepath.Glob(glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, more...)
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			rt, err := LoadRuleTest(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failures, err := rt.Run(context.Background())
+			if err != nil {
+				t.Fatalf("%s: %v", rt.Name, err)
+			}
+			for _, f := range failures {
+				t.Errorf("%s: %v", rt.Name, f)
+			}
+		})
+	}
+}
+
+func TestExpandValues(t *testing.T) {
+	tests := []struct {
+		values string
+		want   []float64 // -1 marks a skipped interval
+		err    bool
+	}{
+		{values: "1 2 3", want: []float64{1, 2, 3}},
+		{values: "1+2x3", want: []float64{1, 3, 5, 7}},
+		{values: "5-1x2 _ 7", want: []float64{5, 4, 3, -1, 7}},
+		{values: "_x2 -3+0.5x1", want: []float64{-1, -1, -3, -2.5}},
+		{values: "_x0 1", want: []float64{1}},
+		{values: "1e-3", want: []float64{0.001}},
+		{values: "5x3", want: []float64{5, 5, 5, 5}},
+		{values: "5x", err: true},
+		{values: "abc", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.values, func(t *testing.T) {
+			is := is.New(t)
+			in := InputSeries{Field: "f", Values: tt.values}
+			s, err := in.series(epoch, time.Second)
+			if tt.err {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			got := make([]float64, len(tt.want))
+			for i := range got {
+				got[i] = -1
+			}
+			for _, p := range s.Points {
+				got[p.Time.Sub(epoch)/time.Second] = p.Value
+			}
+			is.Equal(got, tt.want)
+		})
+	}
+}
+
+func TestRuleTestFailures(t *testing.T) {
+	is := is.New(t)
+	rt := &RuleTest{
+		Name:    "wrong expectations",
+		Monitor: RuleTestMonitor{Condition: []byte(`{"type": "threshold", "field": "humidity", "min": 40}`)},
+		Series:  []InputSeries{{Field: "humidity", Values: "50 30"}},
+		Expect: []ExpectedState{
+			{At: Duration(time.Minute), State: "ok"},
+			{At: Duration(90 * time.Second), State: "firing"},
+		},
+	}
+	failures, err := rt.Run(context.Background())
+	is.NoErr(err)
+	is.Equal(len(failures), 2)
+	is.Equal(failures[0].Error(), "at 1m0s: state is firing, want ok (humidity is 30, outside [40, +inf])")
+}
@@ -0,0 +1,161 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shared is a DataSource that runs each query once for everyone who asks
+// for it at the same time, and caches results for TTL. Queries are keyed
+// by NormalizeQuery, so queries that only differ in whitespace and
+// comments share results. Errors are never cached.
+type Shared struct {
+	Source DataSource
+	// TTL is how long results are reused. Zero only shares queries that
+	// are in flight.
+	TTL time.Duration
+	// Clock defaults to the wall clock.
+	Clock Clock
+
+	mu    sync.Mutex
+	calls map[string]*sharedCall
+	cache map[string]cachedResult
+}
+
+// sharedCall is a query in flight. done is closed once it has a result.
+type sharedCall struct {
+	done   chan struct{}
+	series []Series
+	err    error
+}
+
+// cachedResult is a query's result and when it stops being reused.
+type cachedResult struct {
+	series  []Series
+	expires time.Time
+}
+
+// Query implements DataSource.
+func (s *Shared) Query(ctx context.Context, query string) ([]Series, error) {
+	clock := clockOrDefault(s.Clock)
+	key := NormalizeQuery(query)
+	for {
+		s.mu.Lock()
+		if s.calls == nil {
+			s.calls = map[string]*sharedCall{}
+			s.cache = map[string]cachedResult{}
+		}
+		if c, ok := s.cache[key]; ok && clock.Now().Before(c.expires) {
+			s.mu.Unlock()
+			sharedQueries.WithLabelValues("cached").Inc()
+			return copySeries(c.series), nil
+		}
+		call, ok := s.calls[key]
+		if !ok {
+			break
+		}
+		s.mu.Unlock()
+
+		sharedQueries.WithLabelValues("shared").Inc()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-call.done:
+		}
+		// NB: the caller that ran the query may have been cancelled
+		// without us, in which case we run it ourselves
+		if call.err != nil && ctx.Err() == nil && (errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded)) {
+			continue
+		}
+		return copySeries(call.series), call.err
+	}
+
+	call := &sharedCall{done: make(chan struct{})}
+	s.calls[key] = call
+	s.mu.Unlock()
+
+	sharedQueries.WithLabelValues("miss").Inc()
+	call.series, call.err = s.Source.Query(ctx, query)
+
+	s.mu.Lock()
+	delete(s.calls, key)
+	if call.err == nil && s.TTL > 0 {
+		now := clock.Now()
+		for k, c := range s.cache {
+			if !now.Before(c.expires) {
+				delete(s.cache, k)
+			}
+		}
+		s.cache[key] = cachedResult{series: call.series, expires: now.Add(s.TTL)}
+	}
+	s.mu.Unlock()
+	close(call.done)
+	return copySeries(call.series), call.err
+}
+
+// copySeries copies series deeply enough that callers can modify their
+// Series and Points without affecting each other.
+func copySeries(series []Series) []Series {
+	if series == nil {
+		return nil
+	}
+	out := make([]Series, len(series))
+	for i, s := range series {
+		out[i] = s
+		out[i].Points = append([]Point(nil), s.Points...)
+		if s.Tags != nil {
+			out[i].Tags = make(map[string]string, len(s.Tags))
+			for k, v := range s.Tags {
+				out[i].Tags[k] = v
+			}
+		}
+	}
+	return out
+}
+
+// NormalizeQuery returns a Flux query without its comments and with each
+// run of whitespace outside of strings collapsed to a single space.
+func NormalizeQuery(query string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '"':
+			// copy the string literal as is
+			j := i + 1
+			for j < len(query) && query[j] != '"' {
+				if query[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(query) {
+				j = len(query) - 1
+			}
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteString(query[i : j+1])
+			i = j
+		case c == '/' && i+1 < len(query) && query[i+1] == '/':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			space = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+		default:
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
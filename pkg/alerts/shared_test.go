@@ -0,0 +1,144 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingSource is a DataSource whose queries wait for release.
+type blockingSource struct {
+	*MemorySource
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingSource) Query(ctx context.Context, query string) ([]Series, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.MemorySource.Query(ctx, query)
+}
+
+func TestShared(t *testing.T) {
+	series := Series{Field: FieldTemperature, Points: []Point{{Time: epoch, Value: 21}}}
+
+	t.Run("should cache results for the TTL", func(t *testing.T) {
+		is := is.New(t)
+		src := NewMemorySource()
+		src.Set("from(bucket: \"growmon\") |> last()", series)
+		clock := NewFakeClock(epoch)
+		shared := &Shared{Source: src, TTL: 30 * time.Second, Clock: clock}
+		ctx := context.Background()
+
+		got, err := shared.Query(ctx, "from(bucket: \"growmon\") |> last()")
+		is.NoErr(err)
+		is.Equal(got, []Series{series})
+		_, err = shared.Query(ctx, "from(bucket: \"growmon\")\n  // the latest value\n  |> last()")
+		is.NoErr(err)
+		is.Equal(src.Calls(), 1) // the same query after normalizing
+
+		clock.Advance(30 * time.Second)
+		_, err = shared.Query(ctx, "from(bucket: \"growmon\") |> last()")
+		is.NoErr(err)
+		is.Equal(src.Calls(), 2)
+	})
+
+	t.Run("should not cache errors", func(t *testing.T) {
+		is := is.New(t)
+		src := NewMemorySource()
+		src.Fail(fmt.Errorf("ErrMock"))
+		shared := &Shared{Source: src, TTL: time.Minute, Clock: NewFakeClock(epoch)}
+
+		_, err := shared.Query(context.Background(), "q")
+		is.True(err != nil)
+		src.Fail(nil)
+		src.Set("q", series)
+		got, err := shared.Query(context.Background(), "q")
+		is.NoErr(err)
+		is.Equal(got, []Series{series})
+		is.Equal(src.Calls(), 2)
+	})
+
+	t.Run("should run a query in flight once for everyone", func(t *testing.T) {
+		is := is.New(t)
+		src := &blockingSource{MemorySource: NewMemorySource(), entered: make(chan struct{}, 1), release: make(chan struct{})}
+		src.Set("q", series)
+		shared := &Shared{Source: src}
+		waiting := testutil.ToFloat64(sharedQueries.WithLabelValues("shared"))
+
+		var wg sync.WaitGroup
+		results := make([][]Series, 5)
+		query := func(i int) {
+			defer wg.Done()
+			got, err := shared.Query(context.Background(), "q")
+			is.NoErr(err)
+			results[i] = got
+		}
+		wg.Add(1)
+		go query(0)
+		<-src.entered
+		for i := 1; i < len(results); i++ {
+			wg.Add(1)
+			go query(i)
+		}
+		for testutil.ToFloat64(sharedQueries.WithLabelValues("shared")) < waiting+4 {
+			time.Sleep(time.Millisecond)
+		}
+		close(src.release)
+		wg.Wait()
+
+		is.Equal(src.Calls(), 1)
+		for _, got := range results {
+			is.Equal(got, []Series{series})
+		}
+	})
+
+	t.Run("should give every caller its own copy", func(t *testing.T) {
+		is := is.New(t)
+		src := NewMemorySource()
+		src.Set("q", series)
+		shared := &Shared{Source: src, TTL: time.Minute, Clock: NewFakeClock(epoch)}
+
+		got, err := shared.Query(context.Background(), "q")
+		is.NoErr(err)
+		got[0].Points[0].Value = 99
+		got, err = shared.Query(context.Background(), "q")
+		is.NoErr(err)
+		is.Equal(got[0].Points[0].Value, 21.0)
+	})
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "collapses whitespace",
+			query: "from(bucket: \"growmon\")\n\t|>  range(start: -1h)\n",
+			want:  "from(bucket: \"growmon\") |> range(start: -1h)",
+		},
+		{
+			name:  "drops comments",
+			query: "// tent 1\nfrom(bucket: \"growmon\") // the bucket\n|> last()",
+			want:  "from(bucket: \"growmon\") |> last()",
+		},
+		{
+			name:  "keeps strings as they are",
+			query: "filter(fn: (r) => r.UUID == \"UUID:  00-00-01 // \\\"a\\\"\")",
+			want:  "filter(fn: (r) => r.UUID == \"UUID:  00-00-01 // \\\"a\\\"\")",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(NormalizeQuery(tt.query), tt.want)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Template parameter types. Each renders as a Flux literal that user input
+// can't break out of.
+const (
+	// ParamString is a JSON string, rendered as a quoted Flux string.
+	ParamString = "string"
+	// ParamStrings is a JSON array of strings, rendered as a Flux array.
+	ParamStrings = "strings"
+	// ParamDuration is a Flux duration like "30m" or "1h30m".
+	ParamDuration = "duration"
+	// ParamNumber is a JSON number.
+	ParamNumber = "number"
+	// ParamEnum is one of the Param's Options, rendered as is, e.g. an
+	// aggregate function name.
+	ParamEnum = "enum"
+)
+
+var (
+	// placeholder matches a {{param}} in a template's Text.
+	placeholder  = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+	fluxDuration = regexp.MustCompile(`^([0-9]+(ns|us|µs|ms|s|m|h|d|w|mo|y))+$`)
+	identifier   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Param is a typed parameter of a QueryTemplate.
+type Param struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Options are the values an enum allows.
+	Options []string `json:"options,omitempty"`
+	// Default is used when no value is given. Params without one are required.
+	Default json.RawMessage `json:"default,omitempty"`
+}
+
+// QueryTemplate is a reusable Flux query whose Text has a {{name}}
+// placeholder for each of its Params.
+type QueryTemplate struct {
+	Name   string  `json:"name"`
+	Text   string  `json:"text"`
+	Params []Param `json:"params"`
+}
+
+// BuiltinTemplates are the templates every monitor can use. Their names
+// are reserved.
+var BuiltinTemplates = map[string]*QueryTemplate{
+	"device": {
+		Name: "device",
+		Text: `from(bucket: {{bucket}})
+  |> range(start: -{{window}})
+  |> filter(fn: (r) => r["_measurement"] == {{measurement}})
+  |> filter(fn: (r) => r["UUID"] == {{device}})
+  |> filter(fn: (r) => contains(value: r["_field"], set: {{fields}}))
+  |> aggregateWindow(every: {{every}}, fn: {{aggregate}}, createEmpty: false)`,
+		Params: []Param{
+			{Name: "bucket", Type: ParamString, Default: json.RawMessage(`"growmon"`)},
+			{Name: "measurement", Type: ParamString, Default: json.RawMessage(`"STBProto"`)},
+			{Name: "device", Type: ParamString},
+			{Name: "fields", Type: ParamStrings, Default: json.RawMessage(`["temperature", "humidity", "heat_index"]`)},
+			{Name: "window", Type: ParamDuration, Default: json.RawMessage(`"1h"`)},
+			{Name: "every", Type: ParamDuration, Default: json.RawMessage(`"5m"`)},
+			{Name: "aggregate", Type: ParamEnum, Options: []string{"mean", "median", "min", "max", "first", "last", "sum", "count"}, Default: json.RawMessage(`"mean"`)},
+		},
+	},
+}
+
+// Validate reports whether the template is well formed: every placeholder
+// is a declared Param, every Param is used, and defaults are valid.
+func (t *QueryTemplate) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("template needs a name")
+	}
+	params := map[string]bool{}
+	for _, p := range t.Params {
+		if !identifier.MatchString(p.Name) {
+			return fmt.Errorf("param name %q must be letters, digits and underscores", p.Name)
+		}
+		if params[p.Name] {
+			return fmt.Errorf("param %q is declared twice", p.Name)
+		}
+		params[p.Name] = true
+		switch p.Type {
+		case ParamString, ParamStrings, ParamDuration, ParamNumber:
+		case ParamEnum:
+			if len(p.Options) == 0 {
+				return fmt.Errorf("enum param %q needs options", p.Name)
+			}
+			for _, o := range p.Options {
+				if !identifier.MatchString(o) {
+					return fmt.Errorf("enum param %q option %q must be letters, digits and underscores", p.Name, o)
+				}
+			}
+		default:
+			return fmt.Errorf("param %q has unknown type %q, want one of %s, %s, %s, %s or %s",
+				p.Name, p.Type, ParamString, ParamStrings, ParamDuration, ParamNumber, ParamEnum)
+		}
+		if p.Default != nil {
+			if _, err := p.literal(p.Default); err != nil {
+				return fmt.Errorf("param %q has an invalid default: %w", p.Name, err)
+			}
+		}
+	}
+
+	used := map[string]bool{}
+	for _, m := range placeholder.FindAllStringSubmatch(t.Text, -1) {
+		if !params[m[1]] {
+			return fmt.Errorf("template uses undeclared param %q", m[1])
+		}
+		used[m[1]] = true
+	}
+	for name := range params {
+		if !used[name] {
+			return fmt.Errorf("param %q isn't used in the template", name)
+		}
+	}
+	if rest := placeholder.ReplaceAllString(t.Text, ""); strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return fmt.Errorf("template has a malformed placeholder")
+	}
+	return nil
+}
+
+// Render returns the template's Flux with values substituted for its
+// placeholders. Each value is checked against its Param's type and
+// rendered as a Flux literal.
+func (t *QueryTemplate) Render(values map[string]json.RawMessage) (string, error) {
+	literals := map[string]string{}
+	for _, p := range t.Params {
+		raw, ok := values[p.Name]
+		if !ok {
+			raw = p.Default
+		}
+		if raw == nil {
+			return "", fmt.Errorf("template %s needs a value for %q", t.Name, p.Name)
+		}
+		lit, err := p.literal(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %w", p.Name, err)
+		}
+		literals[p.Name] = lit
+	}
+	var unknown []string
+	for name := range values {
+		if _, ok := literals[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return "", fmt.Errorf("template %s has no params %s", t.Name, strings.Join(unknown, ", "))
+	}
+	return placeholder.ReplaceAllStringFunc(t.Text, func(m string) string {
+		return literals[placeholder.FindStringSubmatch(m)[1]]
+	}), nil
+}
+
+// literal checks raw against the Param's type and returns it as Flux.
+func (p *Param) literal(raw json.RawMessage) (string, error) {
+	switch p.Type {
+	case ParamString:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", fmt.Errorf("want a string")
+		}
+		return fluxString(s), nil
+	case ParamStrings:
+		var ss []string
+		if err := json.Unmarshal(raw, &ss); err != nil || len(ss) == 0 {
+			return "", fmt.Errorf("want a list of strings")
+		}
+		quoted := make([]string, len(ss))
+		for i, s := range ss {
+			quoted[i] = fluxString(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]", nil
+	case ParamDuration:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil || !fluxDuration.MatchString(s) {
+			return "", fmt.Errorf("want a duration like \"30m\"")
+		}
+		return s, nil
+	case ParamNumber:
+		var f float64
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return "", fmt.Errorf("want a number")
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case ParamEnum:
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			for _, o := range p.Options {
+				if s == o {
+					return s, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("want one of %s", strings.Join(p.Options, ", "))
+	}
+	return "", fmt.Errorf("unknown type %q", p.Type)
+}
+
+// fluxString quotes s as a Flux string literal, escaping the characters
+// that could end it or interpolate into it.
+func fluxString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `${`, `\${`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,102 @@
+package alerts
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestDeviceTemplate(t *testing.T) {
+	is := is.New(t)
+	tmpl := BuiltinTemplates["device"]
+	is.NoErr(tmpl.Validate())
+
+	query, err := tmpl.Render(map[string]json.RawMessage{
+		"device": json.RawMessage(`"UUID: 00-00-01"`),
+		"window": json.RawMessage(`"30m"`),
+	})
+	is.NoErr(err)
+	is.Equal(query, `from(bucket: "growmon")
+  |> range(start: -30m)
+  |> filter(fn: (r) => r["_measurement"] == "STBProto")
+  |> filter(fn: (r) => r["UUID"] == "UUID: 00-00-01")
+  |> filter(fn: (r) => contains(value: r["_field"], set: ["temperature", "humidity", "heat_index"]))
+  |> aggregateWindow(every: 5m, fn: mean, createEmpty: false)`)
+}
+
+func TestTemplateRejectsInjection(t *testing.T) {
+	tmpl := BuiltinTemplates["device"]
+	tests := []struct {
+		name   string
+		values string
+		err    string
+	}{
+		{name: "missing device", values: `{}`, err: `template device needs a value for "device"`},
+		{name: "unknown param", values: `{"device": "a", "devcie": "b"}`, err: "template device has no params devcie"},
+		{name: "duration with flux", values: `{"device": "a", "window": "1h) |> drop(columns: [\"x\"]"}`, err: `invalid window: want a duration like "30m"`},
+		{name: "aggregate with flux", values: `{"device": "a", "aggregate": "mean) |> yield(name: \"x\""}`, err: "invalid aggregate: want one of mean, median, min, max, first, last, sum, count"},
+		{name: "number for a string", values: `{"device": 1}`, err: "invalid device: want a string"},
+		{name: "empty fields", values: `{"device": "a", "fields": []}`, err: "invalid fields: want a list of strings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			var values map[string]json.RawMessage
+			is.NoErr(json.Unmarshal([]byte(tt.values), &values))
+			_, err := tmpl.Render(values)
+			is.True(err != nil)
+			is.Equal(err.Error(), tt.err)
+		})
+	}
+}
+
+func TestFluxString(t *testing.T) {
+	is := is.New(t)
+	is.Equal(fluxString(`a") |> drop(columns: ["_value"]) |> yield(name: "b`), `"a\") |> drop(columns: [\"_value\"]) |> yield(name: \"b"`)
+	is.Equal(fluxString(`${r._value}`), `"\${r._value}"`)
+	is.Equal(fluxString(`a\`), `"a\\"`)
+}
+
+func TestTemplateValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		tmpl QueryTemplate
+		err  string
+	}{
+		{name: "undeclared", tmpl: QueryTemplate{Name: "t", Text: `from(bucket: {{bucket}})`}, err: `template uses undeclared param "bucket"`},
+		{name: "unused", tmpl: QueryTemplate{Name: "t", Text: `from(bucket: "b")`, Params: []Param{{Name: "bucket", Type: ParamString}}}, err: `param "bucket" isn't used in the template`},
+		{name: "bad type", tmpl: QueryTemplate{Name: "t", Text: `{{x}}`, Params: []Param{{Name: "x", Type: "flux"}}}, err: `param "x" has unknown type "flux", want one of string, strings, duration, number or enum`},
+		{name: "bad default", tmpl: QueryTemplate{Name: "t", Text: `{{x}}`, Params: []Param{{Name: "x", Type: ParamDuration, Default: json.RawMessage(`"soon"`)}}}, err: `param "x" has an invalid default: want a duration like "30m"`},
+		{name: "malformed", tmpl: QueryTemplate{Name: "t", Text: `{{x}} {{ y-z }}`, Params: []Param{{Name: "x", Type: ParamNumber}}}, err: "template has a malformed placeholder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			err := tt.tmpl.Validate()
+			is.True(err != nil)
+			is.Equal(err.Error(), tt.err)
+		})
+	}
+}
+
+func TestNumberParam(t *testing.T) {
+	tmpl := &QueryTemplate{Name: "t", Text: `{{x}}`, Params: []Param{{Name: "x", Type: ParamNumber}}}
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: `5`, want: `5`},
+		{value: `-0.25`, want: `-0.25`},
+		{value: `1e6`, want: `1000000`},
+		{value: `1.5e-7`, want: `0.00000015`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			is := is.New(t)
+			query, err := tmpl.Render(map[string]json.RawMessage{"x": json.RawMessage(tt.value)})
+			is.NoErr(err)
+			is.Equal(query, tt.want) // Flux has no exponent notation
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// Cluster coordinates the server instances sharing a Postgres database.
+// Leases are checked against the database's clock so that instances with
+// skewed clocks still agree on who holds them.
+
+// DefaultLeaseTTL is how long a leader holds its lease without renewing it,
+// and so roughly how long failover takes when a leader dies.
+const DefaultLeaseTTL = 15 * time.Second
+
+// InstanceID returns an identifier for this server instance. It prefers
+// the Fly allocation ID and falls back to the hostname and PID.
+func InstanceID() string {
+	if id := os.Getenv("FLY_ALLOC_ID"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Elector campaigns for a named lease so that exactly one instance
+// is leader at a time.
+type Elector struct {
+	DB   *gorm.DB
+	Name string // name of the lease, e.g. "scheduler"
+	ID   string // this instance's ID
+	TTL  time.Duration
+
+	mu     sync.Mutex
+	leader bool
+}
+
+// NewElector returns an Elector for the named lease on behalf of instance id.
+func NewElector(conn *gorm.DB, name, id string) *Elector {
+	return &Elector{
+		DB:   conn,
+		Name: name,
+		ID:   id,
+		TTL:  DefaultLeaseTTL,
+	}
+}
+
+// Run campaigns for the lease, renewing it every third of its TTL, until
+// ctx is cancelled. On the way out it releases the lease if held so that
+// another instance can take over without waiting for it to expire.
+func (e *Elector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+	for {
+		ok, err := e.acquire(ctx)
+		if err != nil {
+			log.Printf("failed to acquire %s lease: %v", e.Name, err)
+		}
+		e.setLeader(ok)
+
+		select {
+		case <-ctx.Done():
+			e.setLeader(false)
+			if err := e.release(); err != nil {
+				log.Printf("failed to release %s lease: %v", e.Name, err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsLeader reports whether this instance held the lease at its last renewal.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Leader returns the lease's current holder and when the lease expires.
+// The holder is empty if nobody holds an unexpired lease.
+func (e *Elector) Leader(ctx context.Context) (*db.Lease, error) {
+	var lease db.Lease
+	tx := e.DB.WithContext(ctx).
+		Where("name = ? AND expires_at > now()", e.Name).
+		Limit(1).
+		Find(&lease)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &lease, nil
+}
+
+func (e *Elector) setLeader(ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ok != e.leader {
+		log.Printf("instance %s leadership of %s: %t", e.ID, e.Name, ok)
+	}
+	e.leader = ok
+}
+
+// acquire takes the lease if it is free or expired, or renews it if we
+// already hold it. It reports whether we hold the lease afterwards.
+func (e *Elector) acquire(ctx context.Context) (bool, error) {
+	tx := e.DB.WithContext(ctx).Exec(`
+		INSERT INTO leases (name, holder, expires_at)
+		VALUES (?, ?, now() + ? * interval '1 millisecond')
+		ON CONFLICT (name) DO UPDATE
+		SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE leases.holder = EXCLUDED.holder OR leases.expires_at < now()`,
+		e.Name, e.ID, e.TTL.Milliseconds())
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return tx.RowsAffected == 1, nil
+}
+
+// release gives up the lease if we hold it.
+func (e *Elector) release() error {
+	return e.DB.
+		Where("name = ? AND holder = ?", e.Name, e.ID).
+		Delete(&db.Lease{}).Error
+}
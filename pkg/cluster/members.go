@@ -0,0 +1,141 @@
+package cluster
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// DefaultHeartbeatTTL is how long a member stays live without a heartbeat.
+const DefaultHeartbeatTTL = 30 * time.Second
+
+var shardMonitors = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "growalert",
+	Name:      "shard_monitors",
+	Help:      "Number of Monitors owned by this instance's shard.",
+}, []string{"instance"})
+
+// Membership tracks the live instances through heartbeats in the members
+// table and shards keys between them on a Ring.
+type Membership struct {
+	DB  *gorm.DB
+	ID  string // this instance's ID
+	TTL time.Duration
+	// Keys returns every key being sharded, so that each instance can
+	// report how many it owns.
+	Keys func() []string
+
+	mu   sync.Mutex
+	ring *Ring
+}
+
+// NewMembership returns a Membership for instance id. Until its first
+// heartbeat the instance considers itself the only member.
+func NewMembership(conn *gorm.DB, id string, keys func() []string) *Membership {
+	return &Membership{
+		DB:   conn,
+		ID:   id,
+		TTL:  DefaultHeartbeatTTL,
+		Keys: keys,
+		ring: NewRing([]string{id}, DefaultReplicas),
+	}
+}
+
+// Run heartbeats and refreshes the Ring every third of the TTL until ctx is
+// cancelled, then leaves the cluster so its keys move right away.
+func (m *Membership) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.TTL / 3)
+	defer ticker.Stop()
+	for {
+		if err := m.refresh(ctx); err != nil {
+			log.Printf("failed to refresh cluster membership: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := m.DB.Delete(&db.Member{}, "id = ?", m.ID).Error; err != nil {
+				log.Printf("failed to leave cluster: %v", err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Owns reports whether this instance owns key.
+func (m *Membership) Owns(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ring.Owner(key) == m.ID
+}
+
+// Members returns the live members as of the last refresh.
+func (m *Membership) Members(ctx context.Context) ([]db.Member, error) {
+	var members []db.Member
+	tx := m.DB.WithContext(ctx).
+		Where("heartbeat_at > now() - ? * interval '1 millisecond'", m.TTL.Milliseconds()).
+		Order("id").
+		Find(&members)
+	return members, tx.Error
+}
+
+// refresh records a heartbeat with this instance's load, then rebuilds
+// the Ring from the live members.
+func (m *Membership) refresh(ctx context.Context) error {
+	owned := 0
+	if m.Keys != nil {
+		for _, k := range m.Keys() {
+			if m.Owns(k) {
+				owned++
+			}
+		}
+	}
+	shardMonitors.WithLabelValues(m.ID).Set(float64(owned))
+
+	tx := m.DB.WithContext(ctx).Exec(`
+		INSERT INTO members (id, heartbeat_at, monitors)
+		VALUES (?, now(), ?)
+		ON CONFLICT (id) DO UPDATE
+		SET heartbeat_at = EXCLUDED.heartbeat_at, monitors = EXCLUDED.monitors`,
+		m.ID, owned)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	members, err := m.Members(ctx)
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for _, mem := range members {
+		ids = append(ids, mem.ID)
+	}
+	ring := NewRing(ids, DefaultReplicas)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !equal(ring.Members(), m.ring.Members()) {
+		log.Printf("cluster membership changed: %v", ids)
+	}
+	m.ring = ring
+	return nil
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// DefaultReplicas is how many points each member gets on a Ring.
+// More points spread keys more evenly between members.
+const DefaultReplicas = 64
+
+// Ring assigns keys to members by consistent hashing, so that when a
+// member joins or leaves only the keys on its part of the ring move.
+type Ring struct {
+	points  []uint32
+	owners  map[uint32]string
+	members []string
+}
+
+// NewRing builds a Ring of members with replicas points each.
+func NewRing(members []string, replicas int) *Ring {
+	r := &Ring{owners: map[uint32]string{}}
+	for _, m := range members {
+		r.members = append(r.members, m)
+		for i := 0; i < replicas; i++ {
+			h := hash(fmt.Sprintf("%s#%d", m, i))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = m
+			r.points = append(r.points, h)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	sort.Strings(r.members)
+	return r
+}
+
+// Owner returns the member that owns key, or "" if the Ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Members returns the Ring's members in sorted order.
+func (r *Ring) Members() []string {
+	return append([]string(nil), r.members...)
+}
+
+// hash places s on the ring. SHA-1 spreads the similar names of
+// members' replicas far more evenly than the cheaper hashes do.
+func hash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
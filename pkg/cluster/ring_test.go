@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestRing(t *testing.T) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("monitor-%d", i)
+	}
+
+	t.Run("should own nothing when empty", func(t *testing.T) {
+		is := is.New(t)
+		is.Equal(NewRing(nil, DefaultReplicas).Owner("monitor-1"), "")
+	})
+
+	t.Run("should spread keys between members", func(t *testing.T) {
+		is := is.New(t)
+		r := NewRing([]string{"a", "b", "c"}, DefaultReplicas)
+		load := map[string]int{}
+		for _, k := range keys {
+			load[r.Owner(k)]++
+		}
+		is.Equal(len(load), 3)
+		for _, n := range load {
+			is.True(n > 150) // each member takes a fair share
+		}
+	})
+
+	t.Run("should only move the leaving member's keys", func(t *testing.T) {
+		is := is.New(t)
+		before := NewRing([]string{"a", "b", "c"}, DefaultReplicas)
+		after := NewRing([]string{"a", "b"}, DefaultReplicas)
+		for _, k := range keys {
+			if owner := before.Owner(k); owner != "c" {
+				is.Equal(after.Owner(k), owner)
+			}
+		}
+	})
+
+	t.Run("should only take keys for the joining member", func(t *testing.T) {
+		is := is.New(t)
+		before := NewRing([]string{"a", "b"}, DefaultReplicas)
+		after := NewRing([]string{"a", "b", "c"}, DefaultReplicas)
+		for _, k := range keys {
+			if owner := after.Owner(k); owner != "c" {
+				is.Equal(before.Owner(k), owner)
+			}
+		}
+	})
+}
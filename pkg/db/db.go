@@ -19,9 +19,38 @@ import (
 type Monitor struct {
 	gorm.Model
 
-	Name        string
+	// Name is unique among monitors that haven't been deleted.
+	Name     string `gorm:"uniqueIndex:idx_monitors_name,where:deleted_at IS NULL"`
+	Query    string // Flux query the monitor's check runs
+	Interval string // how often to check, e.g. "15m"; defaults to 15m
+	For      string // how long checks must fail before alerting, e.g. "10m"
+	// Template names a query template to run instead of Query, and Params
+	// are its parameter values, e.g. {"device": "UUID: 00-00-01"}.
+	Template string
+	Params   datatypes.JSON
+	// Condition is the JSON spec of the condition the query results must
+	// meet, e.g. {"type": "threshold", "field": "vpd", "min": 0.8, "max": 1.2}.
+	// Without one the monitor only checks that data is arriving.
+	Condition  datatypes.JSON
+	LeafOffset float64 // leaf minus air temperature in °C, used to derive VPD
+	Device     string  // UUID of the device the monitor watches, if any
+	Room       string  // room the monitor watches, if any
+	// Labels are free-form string pairs for grouping monitors, e.g.
+	// {"team": "grow-ops"}, and Channels name where its alerts are sent:
+	// "events" (the default) and "log".
+	Labels   datatypes.JSON
+	Channels datatypes.JSON
+	// ManagedBy is the monitor file a monitor is defined in, if any.
+	// Those monitors are read-only through /monitors.
+	ManagedBy   string
 	LastChecked time.Time
 	LastStatus  string
+	// State is ok, pending or firing after the last check. FailingSince
+	// and Failures are the run of failed checks that led there, so that
+	// any instance can carry on from it.
+	State        string
+	FailingSince time.Time
+	Failures     int
 }
 
 // User refers to any user of the application that must be tracked.
@@ -47,12 +76,102 @@ type Event struct {
 	gorm.Model
 
 	Code    uint   // error code, status code, etc...
-	Kind    string // alert, notification, warning, etc...
+	Kind    string // alert, sensor_fault, datasource_down, notification, warning, etc...
 	Message string // the message the Event contained, e.g. the alert's value
 	Source  string // foreign key to a Monitor.
 	Payload datatypes.JSON
 }
 
+// GrowProfile is a crop's plan: named stages with durations and per-metric
+// day and night target ranges.
+type GrowProfile struct {
+	gorm.Model
+
+	Name   string
+	Stages datatypes.JSON // []alerts.Stage
+}
+
+// Grow is a GrowProfile running in a room or on a device. Threshold
+// monitors on the same room or device take their bounds from its stage.
+type Grow struct {
+	gorm.Model
+
+	ProfileID uint
+	Room      string
+	Device    string
+	StartedAt time.Time
+	EndedAt   *time.Time // nil while the grow is running
+	Stage     int        `gorm:"default:-1"` // index of the last stage we notified about
+}
+
+// LightSchedule is when the lights are on in a room or on a device.
+// Threshold monitors there switch to their night bounds while the lights
+// are off, and skip checks while readings settle after a switch.
+type LightSchedule struct {
+	gorm.Model
+
+	Room     string
+	Device   string
+	On       string // time the lights come on, e.g. "06:00"
+	Off      string // time the lights go off, e.g. "00:00"
+	Timezone string // IANA timezone On and Off are in; defaults to UTC
+	Settle   string // how long to skip checks after a switch, e.g. "20m"
+}
+
+// QueryTemplate is a reusable Flux query with typed parameters that
+// monitors can refer to instead of writing Flux.
+type QueryTemplate struct {
+	gorm.Model
+
+	// Name is unique among templates that haven't been deleted.
+	Name   string         `gorm:"uniqueIndex:idx_query_templates_name,where:deleted_at IS NULL"`
+	Text   string         // Flux with a {{name}} placeholder per param
+	Params datatypes.JSON // the params' names, types and defaults
+}
+
+// Calibration corrects one field of one device's readings:
+// the calibrated value is raw*Scale + Offset.
+type Calibration struct {
+	gorm.Model
+
+	Device string  `gorm:"index"` // the device's UUID tag
+	Field  string  // e.g. temperature
+	Offset float64 // added after scaling
+	Scale  float64 `gorm:"default:1"` // zero is treated as 1
+}
+
+// Lease is a named, expiring lock held by one server instance.
+// It's used to elect the instance that owns scheduling.
+type Lease struct {
+	Name      string `gorm:"primaryKey"`
+	Holder    string // the instance ID currently holding the lease
+	ExpiresAt time.Time
+}
+
+// Member is a live server instance, kept alive by its heartbeats.
+// Monitors are sharded between the live Members.
+type Member struct {
+	ID          string `gorm:"primaryKey"`
+	HeartbeatAt time.Time
+	Monitors    int // how many monitors the instance owned at its last heartbeat
+}
+
+// Job is one scheduled run of a Monitor's check, queued in Postgres so
+// that any instance's worker can claim it.
+type Job struct {
+	gorm.Model
+
+	MonitorID   uint      `gorm:"index"`
+	RunAt       time.Time `gorm:"index"` // when the job becomes claimable
+	Status      string    `gorm:"index"` // queued, running, done or failed
+	Attempts    int       // how many times a worker has claimed the job
+	MaxAttempts int
+	LockedBy    string    // the worker that claimed the job
+	LockedUntil time.Time // the claim expires and the job can be reclaimed after this
+	Result      string    // the monitor's state after the check, e.g. ok or firing
+	Error       string    // the last error the check or worker returned
+}
+
 ////////////////
 // CONNECTION //
 ////////////////
@@ -76,7 +195,7 @@ func New() *gorm.DB {
 		log.Fatalf("failed to get pg connection: %v", err)
 	}
 
-	db.AutoMigrate(&Monitor{}, &User{}, &Product{}, &Event{})
+	db.AutoMigrate(&Monitor{}, &User{}, &Product{}, &Event{}, &Lease{}, &Member{}, &Job{}, &GrowProfile{}, &Grow{}, &LightSchedule{}, &Calibration{}, &QueryTemplate{})
 
 	return db
 }
@@ -0,0 +1,315 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// Jobs is a durable queue of check runs stored in Postgres.
+// Workers claim jobs with FOR UPDATE SKIP LOCKED so that many workers can
+// poll the same table without blocking each other or claiming the same job.
+// A claim only lasts for the Queue's Visibility timeout, so the jobs of a
+// worker that crashes mid-check are picked up again by another worker.
+// Finished jobs are pruned once they're older than the Queue's Retention.
+
+// Job statuses.
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+const (
+	// DefaultVisibility is how long a worker's claim on a job lasts.
+	DefaultVisibility = 2 * time.Minute
+	// DefaultMaxAttempts is how many times a job is tried before it fails.
+	DefaultMaxAttempts = 3
+	// DefaultRetryDelay is multiplied by the attempt count to space out retries.
+	DefaultRetryDelay = 30 * time.Second
+	// DefaultRetention is how long finished jobs are kept.
+	DefaultRetention = 7 * 24 * time.Hour
+)
+
+// ErrLost is returned when finishing a job whose claim has expired and
+// been taken by another worker.
+var ErrLost = errors.New("ErrLost: job claim expired")
+
+// Queue enqueues, claims and finishes Jobs.
+type Queue struct {
+	DB          *gorm.DB
+	Visibility  time.Duration
+	MaxAttempts int
+	RetryDelay  time.Duration
+	Retention   time.Duration
+	// Now returns the time jobs fall due and claims expire by.
+	Now func(ctx context.Context) (time.Time, error)
+}
+
+// New returns a Queue with the default timeouts that goes by the
+// database's clock, so that workers whose own clocks disagree still agree
+// on when jobs are due.
+func New(conn *gorm.DB) *Queue {
+	return &Queue{
+		DB:          conn,
+		Visibility:  DefaultVisibility,
+		MaxAttempts: DefaultMaxAttempts,
+		RetryDelay:  DefaultRetryDelay,
+		Retention:   DefaultRetention,
+		Now: func(ctx context.Context) (time.Time, error) {
+			var now time.Time
+			err := conn.WithContext(ctx).Raw("SELECT now()").Scan(&now).Error
+			return now, err
+		},
+	}
+}
+
+// Enqueue schedules a check of the monitor at runAt, unless the monitor
+// already has a queued or running job. It reports whether a job was added.
+func (q *Queue) Enqueue(ctx context.Context, monitorID uint, runAt time.Time) (bool, error) {
+	now, err := q.Now(ctx)
+	if err != nil {
+		return false, err
+	}
+	tx := q.DB.WithContext(ctx).Exec(`
+		INSERT INTO jobs (created_at, updated_at, monitor_id, run_at, status, attempts, max_attempts)
+		SELECT ?, ?, ?, ?, ?, 0, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM jobs
+			WHERE monitor_id = ? AND status IN (?, ?) AND deleted_at IS NULL
+		)`,
+		now, now, monitorID, runAt, StatusQueued, q.MaxAttempts,
+		monitorID, StatusQueued, StatusRunning)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return tx.RowsAffected == 1, nil
+}
+
+// Claim takes the next due job for worker, or returns nil if none is due.
+// A job is due if it is queued and its RunAt has passed, or if it is
+// running but its claim has expired.
+func (q *Queue) Claim(ctx context.Context, worker string) (*db.Job, error) {
+	now, err := q.Now(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var job *db.Job
+	err = q.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var found db.Job
+		res := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("((status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?))",
+				StatusQueued, now, StatusRunning, now).
+			Where("attempts < max_attempts").
+			Order("run_at").
+			Limit(1).
+			Find(&found)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		err := tx.Model(&found).Updates(map[string]interface{}{
+			"status":       StatusRunning,
+			"attempts":     gorm.Expr("attempts + 1"),
+			"locked_by":    worker,
+			"locked_until": now.Add(q.Visibility),
+		}).Error
+		if err != nil {
+			return err
+		}
+		found.Status = StatusRunning
+		found.Attempts++
+		found.LockedBy = worker
+		found.LockedUntil = now.Add(q.Visibility)
+		job = &found
+		return nil
+	})
+	return job, err
+}
+
+// Complete records a job's result. It returns ErrLost if the worker's
+// claim expired and another worker has since claimed the job.
+func (q *Queue) Complete(ctx context.Context, job *db.Job, result string) error {
+	return q.finish(ctx, job, map[string]interface{}{
+		"status": StatusDone,
+		"result": result,
+		"error":  "",
+	})
+}
+
+// Fail records a job's error and requeues it with a delay, or marks it
+// failed once it has used all of its attempts.
+func (q *Queue) Fail(ctx context.Context, job *db.Job, cause error) error {
+	if job.Attempts >= job.MaxAttempts {
+		return q.finish(ctx, job, map[string]interface{}{
+			"status": StatusFailed,
+			"error":  cause.Error(),
+		})
+	}
+	now, err := q.Now(ctx)
+	if err != nil {
+		return err
+	}
+	delay := q.RetryDelay * time.Duration(job.Attempts)
+	return q.finish(ctx, job, map[string]interface{}{
+		"status": StatusQueued,
+		"error":  cause.Error(),
+		"run_at": now.Add(delay),
+	})
+}
+
+// finish updates a running job that the worker still holds.
+func (q *Queue) finish(ctx context.Context, job *db.Job, updates map[string]interface{}) error {
+	tx := q.DB.WithContext(ctx).Model(&db.Job{}).
+		Where("id = ? AND status = ? AND locked_by = ? AND attempts = ?",
+			job.ID, StatusRunning, job.LockedBy, job.Attempts).
+		Updates(updates)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrLost
+	}
+	return nil
+}
+
+// Reap fails running jobs whose claims expired on their last attempt, since
+// Claim will never pick them up again. It returns how many it failed.
+func (q *Queue) Reap(ctx context.Context) (int64, error) {
+	now, err := q.Now(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx := q.DB.WithContext(ctx).Model(&db.Job{}).
+		Where("status = ? AND locked_until < ? AND attempts >= max_attempts", StatusRunning, now).
+		Updates(map[string]interface{}{
+			"status": StatusFailed,
+			"error":  "claim expired on the last attempt",
+		})
+	return tx.RowsAffected, tx.Error
+}
+
+// Prune deletes done and failed jobs that finished more than the Queue's
+// Retention ago. It returns how many it deleted.
+func (q *Queue) Prune(ctx context.Context) (int64, error) {
+	now, err := q.Now(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx := q.DB.WithContext(ctx).Unscoped().
+		Where("status IN (?, ?) AND updated_at < ?", StatusDone, StatusFailed, now.Add(-q.Retention)).
+		Delete(&db.Job{})
+	return tx.RowsAffected, tx.Error
+}
+
+// Stats summarizes the queue.
+type Stats struct {
+	Counts map[string]int64 `json:"counts"` // jobs by status
+	// Backlog is how many queued jobs are already due.
+	Backlog int64 `json:"backlog"`
+	// OldestDue is when the longest-waiting due job was due.
+	OldestDue *time.Time `json:"oldestDue,omitempty"`
+}
+
+// Stats counts jobs by status and measures the backlog of due jobs.
+func (q *Queue) Stats(ctx context.Context) (*Stats, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	conn := q.DB.WithContext(ctx)
+	tx := conn.Model(&db.Job{}).Select("status, count(*) AS count").Group("status").Scan(&rows)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	stats := &Stats{Counts: map[string]int64{}}
+	for _, r := range rows {
+		stats.Counts[r.Status] = r.Count
+	}
+
+	now, err := q.Now(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var backlog struct {
+		Count  int64
+		Oldest *time.Time
+	}
+	tx = conn.Model(&db.Job{}).
+		Select("count(*) AS count, min(run_at) AS oldest").
+		Where("status = ? AND run_at <= ?", StatusQueued, now).
+		Scan(&backlog)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	stats.Backlog = backlog.Count
+	stats.OldestDue = backlog.Oldest
+	return stats, nil
+}
+
+// List returns the most recently updated jobs, optionally filtered by
+// status and monitor.
+func (q *Queue) List(ctx context.Context, status string, monitorID uint, limit int) ([]db.Job, error) {
+	tx := q.DB.WithContext(ctx).Order("updated_at DESC").Limit(limit)
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if monitorID != 0 {
+		tx = tx.Where("monitor_id = ?", monitorID)
+	}
+	var jobs []db.Job
+	return jobs, tx.Find(&jobs).Error
+}
+
+// Worker claims jobs from a Queue and runs them until its context is
+// cancelled.
+type Worker struct {
+	Queue *Queue
+	ID    string
+	// Run checks the job's monitor and returns its resulting state.
+	Run func(ctx context.Context, job *db.Job) (string, error)
+	// Poll is how long to wait when no job is due.
+	Poll time.Duration
+}
+
+// Start runs jobs until ctx is cancelled.
+func (w *Worker) Start(ctx context.Context) error {
+	for {
+		job, err := w.Queue.Claim(ctx, w.ID)
+		if err != nil {
+			log.Printf("worker %s failed to claim job: %v", w.ID, err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(w.Poll):
+			}
+			continue
+		}
+		w.run(ctx, job)
+	}
+}
+
+// run runs one job and records how it went.
+func (w *Worker) run(ctx context.Context, job *db.Job) {
+	jctx, cancel := context.WithTimeout(ctx, w.Queue.Visibility)
+	defer cancel()
+
+	result, err := w.Run(jctx, job)
+	if err != nil {
+		err = w.Queue.Fail(ctx, job, err)
+	} else {
+		err = w.Queue.Complete(ctx, job, result)
+	}
+	if err != nil {
+		log.Printf("worker %s failed to finish job %d: %v", w.ID, job.ID, err)
+	}
+}
@@ -0,0 +1,252 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+var epoch = time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+
+// testQueue returns a Queue on a fresh in-memory database whose clock is
+// *now. SQLite has no row locks, so gorm drops Claim's FOR UPDATE SKIP
+// LOCKED there: these tests cover the queue's bookkeeping, and
+// TestClaimConcurrent covers exclusive claims on Postgres.
+func testQueue(t *testing.T, now *time.Time) *Queue {
+	t.Helper()
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	conn, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestQueue(t, conn, now)
+}
+
+// newTestQueue migrates conn and returns a Queue on it whose clock is *now.
+func newTestQueue(t *testing.T, conn *gorm.DB, now *time.Time) *Queue {
+	t.Helper()
+	if err := conn.AutoMigrate(&db.Job{}); err != nil {
+		t.Fatal(err)
+	}
+	q := New(conn)
+	q.Now = func(ctx context.Context) (time.Time, error) { return *now, nil }
+	return q
+}
+
+func TestClaim(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	now := epoch
+	q := testQueue(t, &now)
+
+	added, err := q.Enqueue(ctx, 1, epoch.Add(time.Minute))
+	is.NoErr(err)
+	is.True(added)
+	added, err = q.Enqueue(ctx, 1, epoch)
+	is.NoErr(err)
+	is.True(!added) // the monitor already has a queued job
+	added, err = q.Enqueue(ctx, 2, epoch.Add(-time.Minute))
+	is.NoErr(err)
+	is.True(added)
+
+	job, err := q.Claim(ctx, "a")
+	is.NoErr(err)
+	is.Equal(job.MonitorID, uint(2)) // the only due job
+	is.Equal(job.Status, StatusRunning)
+	is.Equal(job.Attempts, 1)
+	is.Equal(job.LockedBy, "a")
+	is.True(job.LockedUntil.Equal(now.Add(q.Visibility)))
+
+	job, err = q.Claim(ctx, "b")
+	is.NoErr(err)
+	is.Equal(job, nil) // monitor 1 isn't due yet
+
+	now = epoch.Add(time.Minute)
+	job, err = q.Claim(ctx, "b")
+	is.NoErr(err)
+	is.Equal(job.MonitorID, uint(1))
+	is.NoErr(q.Complete(ctx, job, "ok"))
+
+	added, err = q.Enqueue(ctx, 1, now)
+	is.NoErr(err)
+	is.True(added) // its last job is done
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	now := epoch
+	q := testQueue(t, &now)
+
+	_, err := q.Enqueue(ctx, 1, epoch)
+	is.NoErr(err)
+	first, err := q.Claim(ctx, "a")
+	is.NoErr(err)
+
+	now = epoch.Add(q.Visibility)
+	job, err := q.Claim(ctx, "b")
+	is.NoErr(err)
+	is.Equal(job, nil) // a's claim lasts until its visibility timeout
+
+	now = epoch.Add(q.Visibility + time.Second)
+	second, err := q.Claim(ctx, "b")
+	is.NoErr(err)
+	is.Equal(second.ID, first.ID) // reclaimed once a's claim expired
+	is.Equal(second.Attempts, 2)
+
+	err = q.Complete(ctx, first, "ok")
+	is.True(errors.Is(err, ErrLost)) // a lost the job to b
+	is.NoErr(q.Fail(ctx, second, errors.New("influxdb is down")))
+
+	var stored db.Job
+	is.NoErr(q.DB.First(&stored, first.ID).Error)
+	is.Equal(stored.Status, StatusQueued) // retried after a delay
+	is.Equal(stored.Error, "influxdb is down")
+	is.True(stored.RunAt.Equal(now.Add(2 * q.RetryDelay)))
+}
+
+func TestReap(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	now := epoch
+	q := testQueue(t, &now)
+	q.MaxAttempts = 1
+
+	_, err := q.Enqueue(ctx, 1, epoch)
+	is.NoErr(err)
+	job, err := q.Claim(ctx, "a")
+	is.NoErr(err)
+
+	n, err := q.Reap(ctx)
+	is.NoErr(err)
+	is.Equal(n, int64(0)) // the claim hasn't expired
+
+	now = epoch.Add(q.Visibility + time.Second)
+	again, err := q.Claim(ctx, "b")
+	is.NoErr(err)
+	is.Equal(again, nil) // no attempts left to reclaim it with
+	n, err = q.Reap(ctx)
+	is.NoErr(err)
+	is.Equal(n, int64(1))
+
+	var stored db.Job
+	is.NoErr(q.DB.First(&stored, job.ID).Error)
+	is.Equal(stored.Status, StatusFailed)
+	is.Equal(stored.Error, "claim expired on the last attempt")
+}
+
+func TestPrune(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	now := time.Now()
+	q := testQueue(t, &now)
+
+	for id := uint(1); id <= 3; id++ {
+		_, err := q.Enqueue(ctx, id, now)
+		is.NoErr(err)
+	}
+	done, err := q.Claim(ctx, "a")
+	is.NoErr(err)
+	is.NoErr(q.Complete(ctx, done, "ok"))
+	running, err := q.Claim(ctx, "a")
+	is.NoErr(err)
+
+	n, err := q.Prune(ctx)
+	is.NoErr(err)
+	is.Equal(n, int64(0)) // the done job is recent
+
+	now = now.Add(q.Retention + time.Hour)
+	n, err = q.Prune(ctx)
+	is.NoErr(err)
+	is.Equal(n, int64(1))
+
+	var left []db.Job
+	is.NoErr(q.DB.Unscoped().Find(&left).Error)
+	is.Equal(len(left), 2) // unfinished jobs are kept
+	for _, job := range left {
+		is.True(job.ID != done.ID)
+	}
+	is.NoErr(q.Complete(ctx, running, "ok"))
+}
+
+// TestClaimConcurrent claims jobs from many workers at once, which only
+// means something where Claim's row locks do, so it runs on the Postgres
+// database named by JOBS_TEST_DSN and is skipped without one. It empties
+// the jobs table.
+func TestClaimConcurrent(t *testing.T) {
+	dsn := os.Getenv("JOBS_TEST_DSN")
+	if dsn == "" {
+		t.Skip("JOBS_TEST_DSN isn't set")
+	}
+	is := is.New(t)
+	ctx := context.Background()
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	is.NoErr(err)
+	now := epoch
+	q := newTestQueue(t, conn, &now)
+	is.NoErr(conn.Unscoped().Where("1 = 1").Delete(&db.Job{}).Error)
+
+	const monitors, workers = 50, 8
+	for id := uint(1); id <= monitors; id++ {
+		_, err := q.Enqueue(ctx, id, epoch)
+		is.NoErr(err)
+	}
+
+	// claimAll has every worker claim until nothing is due, and returns
+	// how often each job was claimed
+	claimAll := func() map[uint]int {
+		var mu sync.Mutex
+		claims := map[uint]int{}
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(worker string) {
+				defer wg.Done()
+				for {
+					job, err := q.Claim(ctx, worker)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if job == nil {
+						return
+					}
+					mu.Lock()
+					claims[job.ID]++
+					mu.Unlock()
+				}
+			}(fmt.Sprintf("w%d", w))
+		}
+		wg.Wait()
+		return claims
+	}
+
+	claims := claimAll()
+	is.Equal(len(claims), monitors)
+	for _, n := range claims {
+		is.Equal(n, 1) // claimed by a single worker
+	}
+
+	// once every claim has expired each job is reclaimed exactly once
+	now = epoch.Add(q.Visibility + time.Second)
+	claims = claimAll()
+	is.Equal(len(claims), monitors)
+	for _, n := range claims {
+		is.Equal(n, 1)
+	}
+	var attempts []int
+	is.NoErr(conn.Model(&db.Job{}).Distinct().Pluck("attempts", &attempts).Error)
+	is.Equal(attempts, []int{2})
+}
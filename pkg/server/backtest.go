@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// backtestTimeout bounds how long a backtest may spend querying InfluxDB.
+const backtestTimeout = time.Minute
+
+// backtestRequest picks a stored monitor by ID, or gives a definition to
+// try, and the past time range to replay it over.
+type backtestRequest struct {
+	ID      uint        `json:"id"`
+	Monitor *db.Monitor `json:"monitor"`
+	Start   time.Time   `json:"start"`
+	End     time.Time   `json:"end"`
+}
+
+// backtestHandler replays a monitor's query and condition over a past
+// time range and reports how often it would have alerted.
+func (s *S) backtestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req backtestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m := req.Monitor
+	switch {
+	case req.ID != 0 && m != nil:
+		http.Error(w, "backtest needs an id or a monitor, not both", http.StatusBadRequest)
+		return
+	case req.ID != 0:
+		m = &db.Monitor{}
+		if tx := s.db.First(m, req.ID); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusNotFound)
+			return
+		}
+	case m == nil:
+		http.Error(w, "backtest needs an id or a monitor", http.StatusBadRequest)
+		return
+	}
+
+	b, err := s.newBacktest(m, req.Start, req.End)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), backtestTimeout)
+	defer cancel()
+	res, err := b.Run(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, fmt.Sprintf("backtest took longer than %s; use a shorter range or a longer interval", backtestTimeout), http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// newBacktest builds a Backtest of a stored monitor that runs its query
+// as of each check.
+func (s *S) newBacktest(m *db.Monitor, start, end time.Time) (*alerts.Backtest, error) {
+	interval, err := parseInterval(m)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := parseFor(m)
+	if err != nil {
+		return nil, err
+	}
+	query, err := s.monitorQuery(m)
+	if err != nil {
+		return nil, err
+	}
+	if query == "" {
+		return nil, fmt.Errorf("only monitors with a query can be backtested")
+	}
+	cond, err := s.backtestCondition(m, interval, start, end)
+	if err != nil {
+		return nil, err
+	}
+	source := &alerts.Derived{Source: s.source, LeafOffset: m.LeafOffset}
+	return &alerts.Backtest{
+		Query: func(ctx context.Context, at time.Time) ([]alerts.Series, error) {
+			return source.Query(ctx, alerts.AsOf(query, at))
+		},
+		Condition: cond,
+		Interval:  interval,
+		For:       hold,
+		Start:     start,
+		End:       end,
+	}, nil
+}
+
+// backtestCondition returns a stored monitor's Condition as it was at the
+// time of each check: with the grow that was running where the monitor is
+// then, rather than the one running now. Checks when there was no grow to
+// take bounds from are suppressed.
+func (s *S) backtestCondition(m *db.Monitor, interval time.Duration, start, end time.Time) (alerts.Condition, error) {
+	if len(m.Condition) == 0 {
+		return alerts.Fresh(interval), nil
+	}
+	lights, err := s.lightsFor(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find light schedule: %w", err)
+	}
+	// NB: a placeholder grow lets conditions that only take their bounds
+	// from grows validate before we know which grows they'll check with
+	placeholder := &alerts.Grow{Profile: &alerts.Profile{}}
+	if _, err := alerts.ParseCondition(m.Condition, &alerts.Env{Grow: placeholder, Lights: lights, State: s.monitorState}); err != nil {
+		return nil, err
+	}
+	grows, err := s.growsDuring(m, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find grows: %w", err)
+	}
+
+	type built struct {
+		cond alerts.Condition
+		err  error
+	}
+	byGrow := map[uint]built{} // 0 is no grow
+	return func(at time.Time, series []alerts.Series) (bool, error) {
+		g := growAt(grows, at)
+		var id uint
+		if g != nil {
+			id = g.ID
+		}
+		b, ok := byGrow[id]
+		if !ok {
+			env := &alerts.Env{Lights: lights, State: s.monitorState}
+			if g != nil {
+				env.Grow, b.err = s.toGrow(g)
+			}
+			if b.err == nil {
+				b.cond, b.err = alerts.ParseCondition(m.Condition, env)
+			}
+			if b.err != nil {
+				b.err = fmt.Errorf("%w: no grow to check with: %v", alerts.ErrSuppressed, b.err)
+			}
+			byGrow[id] = b
+		}
+		if b.err != nil {
+			return false, b.err
+		}
+		return b.cond(at, series)
+	}, nil
+}
+
+// growsDuring returns the grows on a stored monitor's device, then those
+// in its room, that ran at some point from start to end, newest first.
+func (s *S) growsDuring(m *db.Monitor, start, end time.Time) ([][]*db.Grow, error) {
+	var grows [][]*db.Grow
+	for _, on := range []struct{ column, value string }{
+		{"device", m.Device},
+		{"room", m.Room},
+	} {
+		if on.value == "" {
+			continue
+		}
+		var found []*db.Grow
+		tx := s.db.Where(on.column+" = ?", on.value).
+			Where("started_at <= ? AND (ended_at IS NULL OR ended_at > ?)", end, start).
+			Order("created_at DESC").Find(&found)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		grows = append(grows, found)
+	}
+	return grows, nil
+}
+
+// growAt returns the first grow from growsDuring that was running at t,
+// or nil if there was none.
+func growAt(grows [][]*db.Grow, t time.Time) *db.Grow {
+	for _, on := range grows {
+		for _, g := range on {
+			if !g.StartedAt.After(t) && (g.EndedAt == nil || g.EndedAt.After(t)) {
+				return g
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,632 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// bundleVersion is the version of the export format. Version 2 added
+// profiles, grows and lights. Bundles of a later version are rejected on
+// import.
+const bundleVersion = 2
+
+// bundle is an export of the monitors and what they're built from: the
+// query templates they use, and the grow profiles, running grows and
+// light schedules they take their bounds from. Monitors are in the same
+// form as in a monitor file, without IDs or state, so a bundle can be
+// imported into another deployment.
+type bundle struct {
+	Version    int                     `json:"version"`
+	ExportedAt time.Time               `json:"exportedAt"`
+	Templates  []*alerts.QueryTemplate `json:"templates"`
+	Profiles   []*alerts.Profile       `json:"profiles"`
+	Grows      []*growSpec             `json:"grows"`
+	Lights     []*lightSpec            `json:"lights"`
+	Monitors   []*monitorSpec          `json:"monitors"`
+}
+
+// growSpec is a running grow in a bundle. It names its profile, since
+// IDs differ between deployments.
+type growSpec struct {
+	Profile   string    `json:"profile"`
+	Room      string    `json:"room,omitempty"`
+	Device    string    `json:"device,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// lightSpec is a light schedule in a bundle.
+type lightSpec struct {
+	Room     string `json:"room,omitempty"`
+	Device   string `json:"device,omitempty"`
+	On       string `json:"on"`
+	Off      string `json:"off"`
+	Timezone string `json:"timezone,omitempty"`
+	Settle   string `json:"settle,omitempty"`
+}
+
+// importChanges reports what an import did, or would do, to one kind of
+// resource. Conflicts are names that exist with a different definition.
+type importChanges struct {
+	Added       []string `json:"added"`
+	Overwritten []string `json:"overwritten"`
+	Skipped     []string `json:"skipped"`
+	Conflicts   []string `json:"conflicts"`
+	Unchanged   int      `json:"unchanged"`
+}
+
+// importDiff reports the outcome of an import.
+type importDiff struct {
+	DryRun    bool          `json:"dryRun"`
+	Conflict  string        `json:"conflict"`
+	Templates importChanges `json:"templates"`
+	Profiles  importChanges `json:"profiles"`
+	Grows     importChanges `json:"grows"`
+	Lights    importChanges `json:"lights"`
+	Monitors  importChanges `json:"monitors"`
+}
+
+// changed is how many things were added or overwritten.
+func (d *importDiff) changed() int {
+	return d.Templates.changed() + d.Profiles.changed() + d.Grows.changed() + d.Lights.changed() + d.Monitors.changed()
+}
+
+// conflicts is how many conflicts weren't resolved.
+func (d *importDiff) conflicts() int {
+	return len(d.Templates.Conflicts) + len(d.Profiles.Conflicts) + len(d.Grows.Conflicts) + len(d.Lights.Conflicts) + len(d.Monitors.Conflicts)
+}
+
+// errDryRun rolls back a dry run's transaction.
+var errDryRun = errors.New("dry run")
+
+// errConflict fails an import with conflicts that weren't resolved.
+var errConflict = errors.New("conflict")
+
+// exportHandler returns every stored query template, grow profile, running
+// grow, light schedule and monitor as a bundle.
+func (s *S) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	b := &bundle{
+		Version:    bundleVersion,
+		ExportedAt: time.Now().UTC(),
+		Templates:  []*alerts.QueryTemplate{},
+		Profiles:   []*alerts.Profile{},
+		Grows:      []*growSpec{},
+		Lights:     []*lightSpec{},
+		Monitors:   []*monitorSpec{},
+	}
+
+	var templates []*db.QueryTemplate
+	if tx := s.db.Order("name").Find(&templates); tx.Error != nil {
+		http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, t := range templates {
+		tmpl, err := toQueryTemplate(t)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("template %q: %s", t.Name, err), http.StatusInternalServerError)
+			return
+		}
+		b.Templates = append(b.Templates, tmpl)
+	}
+
+	var profiles []*db.GrowProfile
+	if tx := s.db.Order("name").Find(&profiles); tx.Error != nil {
+		http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	names := map[uint]string{}
+	for _, p := range profiles {
+		profile, err := toProfile(p)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("profile %q: %s", p.Name, err), http.StatusInternalServerError)
+			return
+		}
+		b.Profiles = append(b.Profiles, profile)
+		names[p.ID] = p.Name
+	}
+
+	var grows []*db.Grow
+	if tx := s.db.Where("ended_at IS NULL").Order("room, device").Find(&grows); tx.Error != nil {
+		http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, g := range grows {
+		b.Grows = append(b.Grows, &growSpec{Profile: names[g.ProfileID], Room: g.Room, Device: g.Device, StartedAt: g.StartedAt})
+	}
+
+	var lights []*db.LightSchedule
+	if tx := s.db.Order("room, device").Find(&lights); tx.Error != nil {
+		http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, l := range lights {
+		b.Lights = append(b.Lights, &lightSpec{Room: l.Room, Device: l.Device, On: l.On, Off: l.Off, Timezone: l.Timezone, Settle: l.Settle})
+	}
+
+	var monitors []*db.Monitor
+	if tx := s.db.Order("name").Find(&monitors); tx.Error != nil {
+		http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, m := range monitors {
+		spec, err := specFor(m)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("monitor %q: %s", m.Name, err), http.StatusInternalServerError)
+			return
+		}
+		b.Monitors = append(b.Monitors, spec)
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="growalert-export.json"`)
+	writeJSON(w, b, nil)
+}
+
+// importHandler imports a bundle. Templates, profiles and monitors are
+// matched to stored ones by name, and grows and light schedules by their
+// room and device. With ?dryRun=true it reports what it would do
+// without changing anything. ?conflict= says what to do with a name that
+// exists with a different definition: fail the whole import (the
+// default), skip it, or overwrite it. Monitors from monitor files are
+// never overwritten.
+func (s *S) importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	diff := &importDiff{
+		DryRun:    r.URL.Query().Get("dryRun") == "true",
+		Conflict:  r.URL.Query().Get("conflict"),
+		Templates: newImportChanges(),
+		Profiles:  newImportChanges(),
+		Grows:     newImportChanges(),
+		Lights:    newImportChanges(),
+		Monitors:  newImportChanges(),
+	}
+	switch diff.Conflict {
+	case "":
+		diff.Conflict = "fail"
+	case "fail", "skip", "overwrite":
+	default:
+		http.Error(w, fmt.Sprintf("unknown conflict mode %q, want fail, skip or overwrite", diff.Conflict), http.StatusBadRequest)
+		return
+	}
+
+	b, err := readBundle(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.applyBundle(r.Context(), b, diff)
+	switch {
+	case errors.Is(err, errConflict):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(diff)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !diff.DryRun && diff.changed() > 0 {
+		if err := s.reconcileMonitors(context.Background()); err != nil {
+			log.Printf("failed to reconcile monitors: %v", err)
+		}
+	}
+	writeJSON(w, diff, nil)
+}
+
+// readBundle decodes a bundle, rejecting unknown keys and other versions.
+func readBundle(r io.Reader) (*bundle, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	var b bundle
+	if err := dec.Decode(&b); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	if b.Version < 1 || b.Version > bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d, want 1 to %d", b.Version, bundleVersion)
+	}
+	return &b, nil
+}
+
+// applyBundle imports a bundle in one transaction, which is rolled back
+// if the import fails or is a dry run.
+func (s *S) applyBundle(ctx context.Context, b *bundle, diff *importDiff) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := s.importBundle(tx, b, diff); err != nil {
+			return err
+		}
+		if diff.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		return nil
+	}
+	return err
+}
+
+// importBundle applies a bundle in tx and records what it did in diff.
+// Everything it imports is validated against what tx holds, so monitors
+// can use templates and grows from the same bundle. Stored monitors built
+// from an overwritten template, profile, grow or light schedule are
+// validated too, and touched so that every instance rebuilds them.
+func (s *S) importBundle(tx *gorm.DB, b *bundle, diff *importDiff) error {
+	// NB: monitors are built and checked with a copy of the server that
+	// reads from the transaction
+	staged := *s
+	staged.db = tx
+
+	var affected affectedMonitors
+	seen := map[string]bool{}
+	for _, t := range b.Templates {
+		if seen[t.Name] {
+			return fmt.Errorf("template %q is in the bundle more than once", t.Name)
+		}
+		seen[t.Name] = true
+		if _, ok := alerts.BuiltinTemplates[t.Name]; ok {
+			return fmt.Errorf("template name %q is reserved", t.Name)
+		}
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("template %q: %w", t.Name, err)
+		}
+		params, err := json.Marshal(t.Params)
+		if err != nil {
+			return err
+		}
+		next := &db.QueryTemplate{Name: t.Name, Text: t.Text, Params: params}
+
+		var old db.QueryTemplate
+		found := tx.Where("name = ?", t.Name).Limit(1).Find(&old)
+		if found.Error != nil {
+			return found.Error
+		}
+		switch {
+		case found.RowsAffected == 0:
+			if err := tx.Create(next).Error; err != nil {
+				return err
+			}
+			diff.Templates.Added = append(diff.Templates.Added, t.Name)
+		case old.Text == next.Text && sameJSON(old.Params, next.Params):
+			diff.Templates.Unchanged++
+		default:
+			if !diff.Templates.resolve(diff.Conflict, t.Name, "") {
+				continue
+			}
+			next.Model = old.Model
+			if err := tx.Save(next).Error; err != nil {
+				return err
+			}
+			affected.templates = append(affected.templates, t.Name)
+		}
+	}
+	if err := importProfiles(tx, b, diff, &affected); err != nil {
+		return err
+	}
+	if err := importGrows(tx, b, diff, &affected); err != nil {
+		return err
+	}
+	if err := importLights(tx, b, diff, &affected); err != nil {
+		return err
+	}
+
+	seen = map[string]bool{}
+	var imported []*db.Monitor
+	for _, spec := range b.Monitors {
+		if seen[spec.Name] {
+			return fmt.Errorf("monitor %q is in the bundle more than once", spec.Name)
+		}
+		seen[spec.Name] = true
+		m, err := spec.monitor("")
+		if err != nil {
+			return err
+		}
+		if _, err := staged.newMonitor(m); err != nil {
+			return fmt.Errorf("monitor %q: %w", m.Name, err)
+		}
+
+		var old db.Monitor
+		found := tx.Where("name = ?", m.Name).Limit(1).Find(&old)
+		if found.Error != nil {
+			return found.Error
+		}
+		if found.RowsAffected == 0 {
+			if err := tx.Create(m).Error; err != nil {
+				return err
+			}
+			diff.Monitors.Added = append(diff.Monitors.Added, m.Name)
+			imported = append(imported, m)
+			continue
+		}
+		// a monitor from a file only differs if its definition does
+		cmp := *m
+		cmp.ManagedBy = old.ManagedBy
+		fields := changedFields(&old, &cmp)
+		if len(fields) == 0 {
+			diff.Monitors.Unchanged++
+			continue
+		}
+		if old.ManagedBy != "" {
+			// monitors from files are never overwritten
+			mode := diff.Conflict
+			if mode == "overwrite" {
+				mode = "fail"
+			}
+			diff.Monitors.resolve(mode, m.Name, "managed by "+old.ManagedBy)
+			continue
+		}
+		if !diff.Monitors.resolve(diff.Conflict, m.Name, strings.Join(fields, ", ")) {
+			continue
+		}
+		m.Model = old.Model
+		keepProgress(m, &old)
+		if err := tx.Save(m).Error; err != nil {
+			return err
+		}
+		imported = append(imported, m)
+	}
+
+	if diff.conflicts() > 0 {
+		return errConflict
+	}
+	// references are checked once every monitor is in, since monitors in
+	// the bundle can refer to each other
+	for _, m := range imported {
+		if err := staged.checkReferences(m); err != nil {
+			return fmt.Errorf("monitor %q: %w", m.Name, err)
+		}
+	}
+	return staged.rebuildAffected(&affected)
+}
+
+// affectedMonitors are what an import overwrote that stored monitors are
+// built from: the names of templates, and the places of grows and light
+// schedules.
+type affectedMonitors struct {
+	templates []string
+	places    []place
+}
+
+// rebuildAffected builds every stored monitor that uses an affected
+// template or is in an affected place, failing if any of them no longer
+// builds, and moves their updated_at.
+func (s *S) rebuildAffected(a *affectedMonitors) error {
+	if len(a.templates)+len(a.places) == 0 {
+		return nil
+	}
+	where := s.db.Where("1 = 0")
+	if len(a.templates) > 0 {
+		where = where.Or("template IN ?", a.templates)
+	}
+	for _, p := range a.places {
+		if p.room != "" {
+			where = where.Or("room = ?", p.room)
+		}
+		if p.device != "" {
+			where = where.Or("device = ?", p.device)
+		}
+	}
+	var monitors []*db.Monitor
+	if tx := s.db.Where(where).Find(&monitors); tx.Error != nil {
+		return tx.Error
+	}
+	var ids []uint
+	for _, m := range monitors {
+		if !hasCheck(m) {
+			continue
+		}
+		if _, err := s.newMonitor(m); err != nil {
+			return fmt.Errorf("monitor %q would no longer build: %w", m.Name, err)
+		}
+		ids = append(ids, m.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.db.Model(&db.Monitor{}).Where("id IN ?", ids).Update("updated_at", time.Now()).Error
+}
+
+// importProfiles applies a bundle's grow profiles in tx. Overwriting one
+// affects the places of the running grows that follow it.
+func importProfiles(tx *gorm.DB, b *bundle, diff *importDiff, affected *affectedMonitors) error {
+	seen := map[string]bool{}
+	for _, p := range b.Profiles {
+		if seen[p.Name] {
+			return fmt.Errorf("profile %q is in the bundle more than once", p.Name)
+		}
+		seen[p.Name] = true
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("profile %q: %w", p.Name, err)
+		}
+		stages, err := json.Marshal(p.Stages)
+		if err != nil {
+			return err
+		}
+		next := &db.GrowProfile{Name: p.Name, Stages: stages}
+
+		var old db.GrowProfile
+		found := tx.Where("name = ?", p.Name).Limit(1).Find(&old)
+		if found.Error != nil {
+			return found.Error
+		}
+		if found.RowsAffected == 0 {
+			if err := tx.Create(next).Error; err != nil {
+				return err
+			}
+			diff.Profiles.Added = append(diff.Profiles.Added, p.Name)
+			continue
+		}
+		// NB: compare decoded stages, since durations like 24h and
+		// 24h0m0s are the same
+		if stored, err := toProfile(&old); err == nil {
+			if same, _ := json.Marshal(stored.Stages); sameJSON(same, stages) {
+				diff.Profiles.Unchanged++
+				continue
+			}
+		}
+		if !diff.Profiles.resolve(diff.Conflict, p.Name, "") {
+			continue
+		}
+		next.Model = old.Model
+		if err := tx.Save(next).Error; err != nil {
+			return err
+		}
+		var grows []*db.Grow
+		if err := tx.Where("profile_id = ? AND ended_at IS NULL", old.ID).Find(&grows).Error; err != nil {
+			return err
+		}
+		for _, g := range grows {
+			affected.places = append(affected.places, place{g.Room, g.Device})
+		}
+	}
+	return nil
+}
+
+// importGrows applies a bundle's running grows in tx, after its profiles.
+// A grow matches the running grow in the same room and on the same device.
+func importGrows(tx *gorm.DB, b *bundle, diff *importDiff, affected *affectedMonitors) error {
+	seen := map[place]bool{}
+	for _, g := range b.Grows {
+		at := place{g.Room, g.Device}
+		if at.room == "" && at.device == "" {
+			return fmt.Errorf("grow of %q needs a room or a device", g.Profile)
+		}
+		if seen[at] {
+			return fmt.Errorf("grow on %s is in the bundle more than once", at)
+		}
+		seen[at] = true
+		var profile db.GrowProfile
+		found := tx.Where("name = ?", g.Profile).Limit(1).Find(&profile)
+		if found.Error != nil {
+			return found.Error
+		}
+		if found.RowsAffected == 0 {
+			return fmt.Errorf("grow on %s follows unknown profile %q", at, g.Profile)
+		}
+		next := &db.Grow{ProfileID: profile.ID, Room: g.Room, Device: g.Device, StartedAt: g.StartedAt, Stage: -1}
+
+		var old db.Grow
+		found = tx.Where("room = ? AND device = ? AND ended_at IS NULL", g.Room, g.Device).Order("created_at DESC").Limit(1).Find(&old)
+		if found.Error != nil {
+			return found.Error
+		}
+		switch {
+		case found.RowsAffected == 0:
+			if err := tx.Create(next).Error; err != nil {
+				return err
+			}
+			diff.Grows.Added = append(diff.Grows.Added, at.String())
+		case old.ProfileID == next.ProfileID && old.StartedAt.Equal(next.StartedAt):
+			diff.Grows.Unchanged++
+			continue
+		default:
+			if !diff.Grows.resolve(diff.Conflict, at.String(), "") {
+				continue
+			}
+			next.Model = old.Model
+			if err := tx.Save(next).Error; err != nil {
+				return err
+			}
+		}
+		affected.places = append(affected.places, at)
+	}
+	return nil
+}
+
+// importLights applies a bundle's light schedules in tx. A schedule
+// matches the newest one in the same room and on the same device.
+func importLights(tx *gorm.DB, b *bundle, diff *importDiff, affected *affectedMonitors) error {
+	seen := map[place]bool{}
+	for _, l := range b.Lights {
+		at := place{l.Room, l.Device}
+		if at.room == "" && at.device == "" {
+			return fmt.Errorf("light schedule needs a room or a device")
+		}
+		if seen[at] {
+			return fmt.Errorf("light schedule on %s is in the bundle more than once", at)
+		}
+		seen[at] = true
+		next := &db.LightSchedule{Room: l.Room, Device: l.Device, On: l.On, Off: l.Off, Timezone: l.Timezone, Settle: l.Settle}
+		if _, err := toLightSchedule(next); err != nil {
+			return fmt.Errorf("light schedule on %s: %w", at, err)
+		}
+
+		var old db.LightSchedule
+		found := tx.Where("room = ? AND device = ?", l.Room, l.Device).Order("created_at DESC").Limit(1).Find(&old)
+		if found.Error != nil {
+			return found.Error
+		}
+		switch {
+		case found.RowsAffected == 0:
+			if err := tx.Create(next).Error; err != nil {
+				return err
+			}
+			diff.Lights.Added = append(diff.Lights.Added, at.String())
+		case old.On == next.On && old.Off == next.Off && old.Timezone == next.Timezone && old.Settle == next.Settle:
+			diff.Lights.Unchanged++
+			continue
+		default:
+			if !diff.Lights.resolve(diff.Conflict, at.String(), "") {
+				continue
+			}
+			next.Model = old.Model
+			if err := tx.Save(next).Error; err != nil {
+				return err
+			}
+		}
+		affected.places = append(affected.places, at)
+	}
+	return nil
+}
+
+// newImportChanges returns importChanges with empty lists, so they're
+// encoded as [] rather than null.
+func newImportChanges() importChanges {
+	return importChanges{Added: []string{}, Overwritten: []string{}, Skipped: []string{}, Conflicts: []string{}}
+}
+
+// resolve records a conflict on name according to the conflict mode, and
+// reports whether it should be overwritten.
+func (c *importChanges) resolve(mode, name, detail string) bool {
+	if detail != "" {
+		name = fmt.Sprintf("%s (%s)", name, detail)
+	}
+	switch mode {
+	case "overwrite":
+		c.Overwritten = append(c.Overwritten, name)
+		return true
+	case "skip":
+		c.Skipped = append(c.Skipped, name)
+	default:
+		c.Conflicts = append(c.Conflicts, name)
+	}
+	return false
+}
+
+// changed is how many names were added or overwritten.
+func (c *importChanges) changed() int {
+	return len(c.Added) + len(c.Overwritten)
+}
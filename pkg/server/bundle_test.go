@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"gorm.io/datatypes"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/cluster"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// testServer returns a server on a fresh in-memory database, whose Siren
+// leaves scheduling checks to the test.
+func testServer(t *testing.T) *S {
+	t.Helper()
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"))
+	conn, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.AutoMigrate(&db.Monitor{}, &db.QueryTemplate{}, &db.GrowProfile{}, &db.Grow{}, &db.LightSchedule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testInstance(conn, "a")
+}
+
+// testInstance returns a server with the given instance ID on conn.
+func testInstance(conn *gorm.DB, id string) *S {
+	return &S{
+		db:      conn,
+		siren:   &alerts.Siren{External: true},
+		members: cluster.NewMembership(conn, id, func() []string { return nil }),
+		loaded:  &loadedMonitors{byID: map[uint]loadedMonitor{}},
+	}
+}
+
+// seedBundleTest stores a template, a monitor using it, and a monitor from
+// a file.
+func seedBundleTest(t *testing.T, s *S) {
+	t.Helper()
+	for _, v := range []interface{}{
+		&db.QueryTemplate{
+			Name:   "window",
+			Text:   `from(bucket: "growmon") |> range(start: -{{window}})`,
+			Params: datatypes.JSON(`[{"name": "window", "type": "duration"}]`),
+		},
+		&db.Monitor{Name: "api", Template: "window", Params: datatypes.JSON(`{"window": "1h"}`), Interval: "5m"},
+		&db.Monitor{Name: "filed", Query: `from(bucket: "growmon")`, ManagedBy: "f.yaml"},
+	} {
+		if err := s.db.Create(v).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// importJSON imports a bundle the way POST /import does.
+func importJSON(s *S, body, conflict string, dryRun bool) (*importDiff, error) {
+	b, err := readBundle(strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	diff := &importDiff{
+		DryRun:    dryRun,
+		Conflict:  conflict,
+		Templates: newImportChanges(),
+		Profiles:  newImportChanges(),
+		Grows:     newImportChanges(),
+		Lights:    newImportChanges(),
+		Monitors:  newImportChanges(),
+	}
+	return diff, s.applyBundle(context.Background(), b, diff)
+}
+
+func TestImportBundleConflicts(t *testing.T) {
+	// the template gains a stage, api checks less often, and new is new
+	bundle := `{"version": 2, "templates": [
+		{"name": "window", "text": "from(bucket: \"growmon\") |> range(start: -{{window}}) |> last()", "params": [{"name": "window", "type": "duration"}]}
+	], "monitors": [
+		{"name": "api", "template": "window", "params": {"window": "1h"}, "interval": "10m"},
+		{"name": "new", "query": "from(bucket: \"growmon\")"}
+	]}`
+	tests := []struct {
+		name      string
+		conflict  string
+		dryRun    bool
+		err       error
+		templates importChanges
+		monitors  importChanges
+		interval  string // api's stored interval afterwards
+		stored    int    // how many monitors are stored afterwards
+	}{
+		{
+			name:      "fail",
+			conflict:  "fail",
+			err:       errConflict,
+			templates: importChanges{Conflicts: []string{"window"}},
+			monitors:  importChanges{Added: []string{"new"}, Conflicts: []string{"api (interval)"}},
+			interval:  "5m",
+			stored:    2,
+		},
+		{
+			name:      "skip",
+			conflict:  "skip",
+			templates: importChanges{Skipped: []string{"window"}},
+			monitors:  importChanges{Added: []string{"new"}, Skipped: []string{"api (interval)"}},
+			interval:  "5m",
+			stored:    3,
+		},
+		{
+			name:      "overwrite",
+			conflict:  "overwrite",
+			templates: importChanges{Overwritten: []string{"window"}},
+			monitors:  importChanges{Added: []string{"new"}, Overwritten: []string{"api (interval)"}},
+			interval:  "10m",
+			stored:    3,
+		},
+		{
+			name:      "dry run",
+			conflict:  "overwrite",
+			dryRun:    true,
+			templates: importChanges{Overwritten: []string{"window"}},
+			monitors:  importChanges{Added: []string{"new"}, Overwritten: []string{"api (interval)"}},
+			interval:  "5m",
+			stored:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			s := testServer(t)
+			seedBundleTest(t, s)
+
+			diff, err := importJSON(s, bundle, tt.conflict, tt.dryRun)
+			is.True(errors.Is(err, tt.err) || err == tt.err) // import error
+			is.Equal(fmt.Sprint(diff.Templates.Conflicts, diff.Templates.Skipped, diff.Templates.Overwritten),
+				fmt.Sprint(tt.templates.Conflicts, tt.templates.Skipped, tt.templates.Overwritten))
+			is.Equal(fmt.Sprint(diff.Monitors.Added, diff.Monitors.Conflicts, diff.Monitors.Skipped, diff.Monitors.Overwritten),
+				fmt.Sprint(tt.monitors.Added, tt.monitors.Conflicts, tt.monitors.Skipped, tt.monitors.Overwritten))
+
+			var api db.Monitor
+			is.NoErr(s.db.Where("name = ?", "api").First(&api).Error)
+			is.Equal(api.Interval, tt.interval)
+			var stored int64
+			is.NoErr(s.db.Model(&db.Monitor{}).Count(&stored).Error)
+			is.Equal(stored, int64(tt.stored))
+		})
+	}
+}
+
+func TestImportBundleFileMonitors(t *testing.T) {
+	is := is.New(t)
+	s := testServer(t)
+	seedBundleTest(t, s)
+
+	diff, err := importJSON(s, `{"version": 2, "monitors": [
+		{"name": "filed", "query": "from(bucket: \"other\")"}
+	]}`, "overwrite", false)
+	is.True(errors.Is(err, errConflict)) // monitors from files are never overwritten
+	is.Equal(diff.Monitors.Conflicts, []string{"filed (managed by f.yaml)"})
+}
+
+func TestImportBundleTemplateUsers(t *testing.T) {
+	is := is.New(t)
+	s := testServer(t)
+	seedBundleTest(t, s)
+
+	// api doesn't give the new required param
+	_, err := importJSON(s, `{"version": 2, "templates": [
+		{"name": "window", "text": "from(bucket: {{bucket}}) |> range(start: -{{window}})", "params": [
+			{"name": "bucket", "type": "string"}, {"name": "window", "type": "duration"}
+		]}
+	]}`, "overwrite", false)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), `monitor "api" would no longer build`))
+
+	var tmpl db.QueryTemplate
+	is.NoErr(s.db.Where("name = ?", "window").First(&tmpl).Error)
+	is.True(!strings.Contains(tmpl.Text, "{{bucket}}")) // nothing was imported
+}
+
+func TestImportBundleGrows(t *testing.T) {
+	monitor := `{"name": "tent-1-temp", "query": "from(bucket: \"growmon\")", "room": "tent-1",
+		"condition": {"type": "threshold", "field": "temperature"}}`
+	profile := `{"name": "tomato", "stages": [{"name": "veg", "duration": "720h",
+		"targets": {"temperature": {"day": {"min": 20, "max": 28}}}}]}`
+	tests := []struct {
+		name   string
+		bundle string
+		err    string
+		grows  int64
+	}{
+		{
+			name: "with its grow",
+			bundle: `{"version": 2, "profiles": [` + profile + `],
+				"grows": [{"profile": "tomato", "room": "tent-1", "startedAt": "2022-09-01T00:00:00Z"}],
+				"lights": [{"room": "tent-1", "on": "06:00", "off": "00:00"}],
+				"monitors": [` + monitor + `]}`,
+			grows: 1,
+		},
+		{
+			name:   "without its grow",
+			bundle: `{"version": 1, "monitors": [` + monitor + `]}`,
+			err:    "threshold needs a min or a max, or a running grow",
+		},
+		{
+			name: "grow of an unknown profile",
+			bundle: `{"version": 2,
+				"grows": [{"profile": "tomato", "room": "tent-1", "startedAt": "2022-09-01T00:00:00Z"}]}`,
+			err: `grow on room tent-1 follows unknown profile "tomato"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			s := testServer(t)
+
+			diff, err := importJSON(s, tt.bundle, "fail", false)
+			if tt.err != "" {
+				is.True(err != nil)
+				is.True(strings.Contains(err.Error(), tt.err)) // import error
+				return
+			}
+			is.NoErr(err)
+			is.Equal(diff.Grows.Added, []string{"room tent-1"})
+			is.Equal(diff.Lights.Added, []string{"room tent-1"})
+
+			var grows int64
+			is.NoErr(s.db.Model(&db.Grow{}).Count(&grows).Error)
+			is.Equal(grows, tt.grows)
+
+			// importing it again changes nothing
+			diff, err = importJSON(s, tt.bundle, "fail", false)
+			is.NoErr(err)
+			is.Equal(diff.changed(), 0)
+			is.Equal(diff.Profiles.Unchanged+diff.Grows.Unchanged+diff.Lights.Unchanged+diff.Monitors.Unchanged, 4)
+		})
+	}
+}
+
+func TestBundleChannels(t *testing.T) {
+	is := is.New(t)
+	s := testServer(t)
+	seedBundleTest(t, s)
+	is.NoErr(s.db.Model(&db.Monitor{}).Where("name = ?", "api").Update("channels", datatypes.JSON(`["events", "log"]`)).Error)
+
+	// a monitor's channels travel with it
+	w := serve(s.exportHandler, http.MethodGet, 0, "")
+	is.Equal(w.Code, http.StatusOK)
+	t.Run("imported elsewhere", func(t *testing.T) {
+		is := is.New(t)
+		other := testServer(t)
+		_, err := importJSON(other, w.Body.String(), "fail", false)
+		is.NoErr(err)
+		var api db.Monitor
+		is.NoErr(other.db.Where("name = ?", "api").First(&api).Error)
+		is.True(sameJSON(api.Channels, datatypes.JSON(`["events", "log"]`)))
+	})
+
+	// changing them is a conflict like changing any other field
+	diff, err := importJSON(s, `{"version": 2, "monitors": [
+		{"name": "api", "template": "window", "params": {"window": "1h"}, "interval": "5m", "channels": ["log"]}
+	]}`, "fail", false)
+	is.True(errors.Is(err, errConflict))
+	is.Equal(diff.Monitors.Conflicts, []string{"api (channels)"})
+
+	// and only known channels can be imported
+	_, err = importJSON(s, `{"version": 2, "monitors": [
+		{"name": "paged", "query": "from(bucket: \"growmon\")", "channels": ["pager"]}
+	]}`, "fail", false)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), `unknown channel "pager"`))
+}
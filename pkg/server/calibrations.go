@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// calibrationHandler declares the whole calibration route
+func (s *S) calibrationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var cals []*db.Calibration
+		query := s.db
+		if device := r.URL.Query().Get("device"); device != "" {
+			query = query.Where("device = ?", device)
+		}
+		if tx := query.Find(&cals); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&cals)
+		return
+	case http.MethodPost, http.MethodPut:
+		c := &db.Calibration{}
+		if err := json.NewDecoder(r.Body).Decode(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c.Device == "" || c.Field == "" {
+			http.Error(w, "calibration needs a device and a field", http.StatusBadRequest)
+			return
+		}
+		if c.Scale == 0 {
+			c.Scale = 1
+		}
+
+		if r.Method == http.MethodPut {
+			// NB: respect only route param id to prevent mismatched updates
+			id, err := routeID(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.ID = id
+		}
+		if tx := s.db.Save(&c); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(c)
+		return
+	case http.MethodDelete:
+		id, err := routeID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tx := s.db.Delete(&db.Calibration{}, id); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// calibrations loads every calibration for alerts.Calibrated. Later
+// rows win if a device and field are calibrated twice.
+func (s *S) calibrations(ctx context.Context) (map[alerts.CalibrationKey]alerts.Calibration, error) {
+	var cals []*db.Calibration
+	if tx := s.db.WithContext(ctx).Order("id").Find(&cals); tx.Error != nil {
+		return nil, tx.Error
+	}
+	out := map[alerts.CalibrationKey]alerts.Calibration{}
+	for _, c := range cals {
+		out[alerts.CalibrationKey{Device: c.Device, Field: c.Field}] = alerts.Calibration{
+			Offset: c.Offset,
+			Scale:  c.Scale,
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,544 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// monitorFilesInterval is how often the monitor files are checked for changes.
+const monitorFilesInterval = 10 * time.Second
+
+// monitorFile is a YAML or JSON file of monitor definitions.
+type monitorFile struct {
+	Monitors []monitorSpec `json:"monitors"`
+}
+
+// monitorSpec is a monitor as it's defined in a monitor file. Its keys
+// are the same as the matching fields of a monitor definition for /monitors.
+type monitorSpec struct {
+	Name string `json:"name"`
+	// Datasource is where the query runs. Only influxdb is supported.
+	Datasource string            `json:"datasource,omitempty"`
+	Query      string            `json:"query,omitempty"`
+	Template   string            `json:"template,omitempty"`
+	Params     json.RawMessage   `json:"params,omitempty"`
+	Condition  json.RawMessage   `json:"condition,omitempty"`
+	Interval   string            `json:"interval,omitempty"`
+	For        string            `json:"for,omitempty"`
+	Device     string            `json:"device,omitempty"`
+	Room       string            `json:"room,omitempty"`
+	LeafOffset float64           `json:"leafOffset,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Channels   []string          `json:"channels,omitempty"`
+}
+
+// monitorFiles tracks the monitor files in a directory and the outcome of
+// the last time they were loaded.
+type monitorFiles struct {
+	dir string
+
+	sync.Mutex
+	last *fileDiff
+}
+
+// fileDiff reports what loading the monitor files changed. Invalid files
+// and monitors are reported in Errors, and whatever they defined before
+// is left as it was.
+type fileDiff struct {
+	Dir       string    `json:"dir"`
+	LoadedAt  time.Time `json:"loadedAt"`
+	Added     []string  `json:"added"`
+	Changed   []string  `json:"changed"`
+	Removed   []string  `json:"removed"`
+	Unchanged int       `json:"unchanged"`
+	Errors    []string  `json:"errors"`
+}
+
+// empty reports whether loading the files changed nothing.
+func (d *fileDiff) empty() bool {
+	return len(d.Added)+len(d.Changed)+len(d.Removed)+len(d.Errors) == 0
+}
+
+// String summarizes the diff for the log.
+func (d *fileDiff) String() string {
+	parts := []string{fmt.Sprintf("%d unchanged", d.Unchanged)}
+	if len(d.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(d.Added, ", "))
+	}
+	if len(d.Changed) > 0 {
+		parts = append(parts, "changed "+strings.Join(d.Changed, ", "))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(d.Removed, ", "))
+	}
+	for _, err := range d.Errors {
+		parts = append(parts, "error: "+err)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// readMonitorFiles reads every .yaml, .yml and .json file in dir. It
+// returns the monitors they define, managed by their file's name, and
+// the names of the files it couldn't read.
+func readMonitorFiles(dir string) ([]*db.Monitor, map[string]error, error) {
+	paths, err := monitorFilePaths(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var monitors []*db.Monitor
+	broken := map[string]error{}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		f, err := readMonitorFile(path)
+		if err != nil {
+			broken[name] = err
+			continue
+		}
+		var defined []*db.Monitor
+		for i, spec := range f.Monitors {
+			m, err := spec.monitor(name)
+			if err != nil {
+				broken[name] = fmt.Errorf("monitor %d: %w", i+1, err)
+				break
+			}
+			defined = append(defined, m)
+		}
+		if broken[name] == nil {
+			monitors = append(monitors, defined...)
+		}
+	}
+	return monitors, broken, nil
+}
+
+// monitorFilePaths returns the monitor files in dir in name order.
+func monitorFilePaths(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml", ".json":
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// readMonitorFile decodes one monitor file, rejecting unknown keys. YAML
+// is converted to JSON first so that both are decoded the same way.
+func readMonitorFile(path string) (*monitorFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) != ".json" {
+		var v interface{}
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		if b, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var f monitorFile
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// monitor converts the spec to a stored monitor managed by file.
+func (spec *monitorSpec) monitor(file string) (*db.Monitor, error) {
+	if spec.Name == "" {
+		return nil, fmt.Errorf("monitor needs a name")
+	}
+	if spec.Datasource != "" && spec.Datasource != "influxdb" {
+		return nil, fmt.Errorf("%s: unknown datasource %q, only influxdb is supported", spec.Name, spec.Datasource)
+	}
+	m := &db.Monitor{
+		Name:       spec.Name,
+		Query:      spec.Query,
+		Template:   spec.Template,
+		Params:     datatypes.JSON(spec.Params),
+		Condition:  datatypes.JSON(spec.Condition),
+		Interval:   spec.Interval,
+		For:        spec.For,
+		Device:     spec.Device,
+		Room:       spec.Room,
+		LeafOffset: spec.LeafOffset,
+		ManagedBy:  file,
+	}
+	if len(spec.Labels) > 0 {
+		b, err := json.Marshal(spec.Labels)
+		if err != nil {
+			return nil, err
+		}
+		m.Labels = b
+	}
+	if len(spec.Channels) > 0 {
+		b, err := json.Marshal(spec.Channels)
+		if err != nil {
+			return nil, err
+		}
+		m.Channels = b
+	}
+	return m, nil
+}
+
+// specFor converts a stored monitor to its definition in a monitor file.
+func specFor(m *db.Monitor) (*monitorSpec, error) {
+	spec := &monitorSpec{
+		Name:       m.Name,
+		Query:      m.Query,
+		Template:   m.Template,
+		Params:     json.RawMessage(m.Params),
+		Condition:  json.RawMessage(m.Condition),
+		Interval:   m.Interval,
+		For:        m.For,
+		Device:     m.Device,
+		Room:       m.Room,
+		LeafOffset: m.LeafOffset,
+	}
+	if len(m.Labels) > 0 {
+		if err := json.Unmarshal(m.Labels, &spec.Labels); err != nil {
+			return nil, fmt.Errorf("invalid labels: %w", err)
+		}
+	}
+	if len(m.Channels) > 0 {
+		if err := json.Unmarshal(m.Channels, &spec.Channels); err != nil {
+			return nil, fmt.Errorf("invalid channels: %w", err)
+		}
+	}
+	return spec, nil
+}
+
+// syncMonitorFiles reconciles the stored monitors with the monitor files:
+// monitors are added, updated and removed to match them. It only touches
+// monitors managed by a file, and never ones whose file or definition is
+// invalid. The Siren is left alone.
+func (s *S) syncMonitorFiles(ctx context.Context) (*fileDiff, error) {
+	diff := &fileDiff{Dir: s.files.dir, LoadedAt: time.Now(), Added: []string{}, Changed: []string{}, Removed: []string{}, Errors: []string{}}
+	monitors, broken, err := readMonitorFiles(s.files.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range sortedKeys(broken) {
+		diff.Errors = append(diff.Errors, fmt.Sprintf("%s: %v", file, broken[file]))
+	}
+
+	// keep is every managed monitor that mustn't be removed, because it's
+	// defined or its definition couldn't be read
+	keep := map[string]bool{}
+	var valid []*db.Monitor
+	for _, m := range monitors {
+		if keep[m.Name] {
+			diff.Errors = append(diff.Errors, fmt.Sprintf("%s: monitor %q is defined more than once", m.ManagedBy, m.Name))
+			continue
+		}
+		keep[m.Name] = true
+		if _, err := s.newMonitor(m); err != nil {
+			diff.Errors = append(diff.Errors, fmt.Sprintf("%s: monitor %q: %v", m.ManagedBy, m.Name, err))
+			continue
+		}
+		valid = append(valid, m)
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// NB: every instance loads the same files, so only one of them
+		// reconciles at a time
+		if tx.Dialector.Name() == "postgres" {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('monitor files'))").Error; err != nil {
+				return err
+			}
+		}
+		var stored []*db.Monitor
+		if err := tx.Find(&stored).Error; err != nil {
+			return err
+		}
+		// managed monitors go when they're no longer defined, unless
+		// their file couldn't be read or a monitor that stays refers to them
+		var kept, removed []*db.Monitor
+		byName := map[string]*db.Monitor{}
+		for _, m := range stored {
+			byName[m.Name] = m
+			if m.ManagedBy != "" && !keep[m.Name] && broken[m.ManagedBy] == nil {
+				removed = append(removed, m)
+				continue
+			}
+			kept = append(kept, m)
+		}
+		kept, removed = checkRemovals(kept, removed, monitors, diff)
+		for _, m := range checkFileReferences(kept, valid, diff) {
+			old, ok := byName[m.Name]
+			switch {
+			case !ok:
+				if err := tx.Create(m).Error; err != nil {
+					return err
+				}
+				diff.Added = append(diff.Added, m.Name)
+			case old.ManagedBy == "":
+				diff.Errors = append(diff.Errors, fmt.Sprintf("%s: monitor %q is already managed through /monitors", m.ManagedBy, m.Name))
+			default:
+				fields := changedFields(old, m)
+				if len(fields) == 0 {
+					diff.Unchanged++
+					continue
+				}
+				m.Model = old.Model
+				keepProgress(m, old)
+				if err := tx.Save(m).Error; err != nil {
+					return err
+				}
+				diff.Changed = append(diff.Changed, fmt.Sprintf("%s (%s)", m.Name, strings.Join(fields, ", ")))
+			}
+		}
+		for _, old := range removed {
+			if err := tx.Delete(old).Error; err != nil {
+				return err
+			}
+			diff.Removed = append(diff.Removed, old.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.files.Lock()
+	s.files.last = diff
+	s.files.Unlock()
+	return diff, nil
+}
+
+// checkRemovals returns the monitors of removed that can go, because no
+// monitor that stays refers to them. Monitors that stay are the kept
+// ones, the ones defined in files, and removed ones that something that
+// stays refers to. Those are added to kept and reported in diff.
+func checkRemovals(kept, removed, defined []*db.Monitor, diff *fileDiff) ([]*db.Monitor, []*db.Monitor) {
+	users := map[string][]string{}
+	stay := func(m *db.Monitor) {
+		refs, _ := alerts.References(m.Condition)
+		for _, ref := range refs {
+			if ref != m.Name {
+				users[ref] = append(users[ref], m.Name)
+			}
+		}
+	}
+	for _, m := range kept {
+		stay(m)
+	}
+	for _, m := range defined {
+		stay(m)
+	}
+	for changed := true; changed; {
+		changed = false
+		var next []*db.Monitor
+		for _, m := range removed {
+			by := users[m.Name]
+			if len(by) == 0 {
+				next = append(next, m)
+				continue
+			}
+			diff.Errors = append(diff.Errors, fmt.Sprintf("%s: monitor %q is kept although it's no longer defined, it's used by %s", m.ManagedBy, m.Name, strings.Join(by, ", ")))
+			kept = append(kept, m)
+			stay(m)
+			changed = true
+		}
+		removed = next
+	}
+	return kept, removed
+}
+
+// checkFileReferences returns the monitors from files whose conditions
+// only refer to monitors that exist, without a cycle. The rest are
+// reported in diff.
+func checkFileReferences(stored, monitors []*db.Monitor, diff *fileDiff) []*db.Monitor {
+	deps := map[string][]string{}
+	for _, m := range stored {
+		refs, _ := alerts.References(m.Condition)
+		deps[m.Name] = refs
+	}
+	for _, m := range monitors {
+		refs, _ := alerts.References(m.Condition)
+		deps[m.Name] = refs
+	}
+	bad := map[string]bool{}
+	for _, m := range monitors {
+		for _, ref := range deps[m.Name] {
+			if _, ok := deps[ref]; !ok {
+				diff.Errors = append(diff.Errors, fmt.Sprintf("%s: monitor %q refers to unknown monitor %q", m.ManagedBy, m.Name, ref))
+				bad[m.Name] = true
+			}
+		}
+	}
+	if cycle := alerts.FindCycle(deps); cycle != nil {
+		diff.Errors = append(diff.Errors, fmt.Sprintf("monitors refer to each other in a cycle: %s", strings.Join(cycle, " -> ")))
+		for _, name := range cycle {
+			bad[name] = true
+		}
+	}
+	var ok []*db.Monitor
+	for _, m := range monitors {
+		if !bad[m.Name] {
+			ok = append(ok, m)
+		}
+	}
+	return ok
+}
+
+// changedFields names the fields of a stored monitor's definition that
+// differ between old and m. JSON fields are compared by value.
+func changedFields(old, m *db.Monitor) []string {
+	var fields []string
+	diff := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+	diff("file", old.ManagedBy != m.ManagedBy)
+	diff("query", old.Query != m.Query)
+	diff("template", old.Template != m.Template)
+	diff("params", !sameJSON(old.Params, m.Params))
+	diff("condition", !sameJSON(old.Condition, m.Condition))
+	diff("interval", old.Interval != m.Interval)
+	diff("for", old.For != m.For)
+	diff("device", old.Device != m.Device)
+	diff("room", old.Room != m.Room)
+	diff("leafOffset", old.LeafOffset != m.LeafOffset)
+	diff("labels", !sameJSON(old.Labels, m.Labels))
+	diff("channels", !sameJSON(old.Channels, m.Channels))
+	return fields
+}
+
+// sameJSON reports whether a and b hold the same JSON value, regardless
+// of key order and whitespace. Empty and null are the same.
+func sameJSON(a, b []byte) bool {
+	return canonicalJSON(a) == canonicalJSON(b)
+}
+
+// canonicalJSON re-encodes b with sorted keys.
+func canonicalJSON(b []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(bytes.TrimSpace(b))
+	}
+	if v == nil {
+		return ""
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// reloadMonitorFiles reconciles the monitor files and brings the Siren in
+// line with the stored monitors. Another instance may have stored what
+// the files changed first, so the Siren is reconciled even if this load
+// changed nothing.
+func (s *S) reloadMonitorFiles(ctx context.Context) {
+	diff, err := s.syncMonitorFiles(ctx)
+	if err != nil {
+		log.Printf("failed to load monitor files from %s: %v", s.files.dir, err)
+		return
+	}
+	if !diff.empty() {
+		log.Printf("loaded monitor files from %s: %s", s.files.dir, diff)
+	}
+
+	if err := s.reconcileMonitors(ctx); err != nil {
+		log.Printf("failed to reconcile monitors: %v", err)
+	}
+}
+
+// watchMonitorFiles reloads the monitor files on SIGHUP, or when any of
+// them has been added, removed or modified.
+func (s *S) watchMonitorFiles(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(monitorFilesInterval)
+	defer ticker.Stop()
+	last := s.files.fingerprint()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("reloading monitor files on SIGHUP")
+		case <-ticker.C:
+			if fp := s.files.fingerprint(); fp == last {
+				continue
+			}
+		}
+		last = s.files.fingerprint()
+		s.reloadMonitorFiles(ctx)
+	}
+}
+
+// fingerprint identifies the current version of every monitor file by its
+// name, size and modification time.
+func (f *monitorFiles) fingerprint() string {
+	paths, err := monitorFilePaths(f.dir)
+	if err != nil {
+		return err.Error()
+	}
+	var b strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// monitorFilesHandler reports the outcome of the last time the monitor
+// files were loaded.
+func (s *S) monitorFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if s.files == nil {
+		http.Error(w, "monitor files are disabled, set MONITORS_DIR", http.StatusNotFound)
+		return
+	}
+	s.files.Lock()
+	defer s.files.Unlock()
+	writeJSON(w, s.files.last, nil)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]error) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
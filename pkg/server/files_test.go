@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"gorm.io/datatypes"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// monitorOn returns a monitor whose condition refers to each of refs, or
+// that has none if there are no refs.
+func monitorOn(t *testing.T, name, file string, refs ...string) *db.Monitor {
+	t.Helper()
+	m := &db.Monitor{Name: name, ManagedBy: file, Query: "from(bucket: \"growmon\")"}
+	var parts []string
+	for _, ref := range refs {
+		parts = append(parts, fmt.Sprintf(`{"type": "monitor", "name": %q}`, ref))
+	}
+	switch len(parts) {
+	case 0:
+	case 1:
+		m.Condition = datatypes.JSON(parts[0])
+	default:
+		m.Condition = datatypes.JSON(`{"type": "and", "of": [` + strings.Join(parts, ", ") + `]}`)
+	}
+	if got, err := alerts.References(m.Condition); len(refs) > 0 && (err != nil || len(got) != len(refs)) {
+		t.Fatalf("monitor %q refers to %v, want %v (%v)", name, got, refs, err)
+	}
+	return m
+}
+
+// names returns the names of monitors in order.
+func names(monitors []*db.Monitor) []string {
+	out := []string{}
+	for _, m := range monitors {
+		out = append(out, m.Name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestSameJSON(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{`{"a": 1, "b": [1, 2]}`, `{"b":[1,2],"a":1}`, true},
+		{`{"a": 1}`, `{"a": 1.0}`, true},
+		{``, `null`, true},
+		{`{"a": 1}`, `{"a": 2}`, false},
+		{`[1, 2]`, `[2, 1]`, false},
+		{``, `{}`, false},
+		{`not json`, ` not json `, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(sameJSON([]byte(tt.a), []byte(tt.b)), tt.same)
+		})
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	base := func() *db.Monitor {
+		return &db.Monitor{
+			Name:      "tent-1",
+			ManagedBy: "tents.yaml",
+			Template:  "device",
+			Params:    datatypes.JSON(`{"device": "UUID: 00-00-01", "window": "30m"}`),
+			Condition: datatypes.JSON(`{"type": "threshold", "field": "vpd", "min": 0.8}`),
+			Interval:  "5m",
+			Labels:    datatypes.JSON(`{"team": "grow-ops"}`),
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(m *db.Monitor)
+		fields []string
+	}{
+		{name: "same", change: func(m *db.Monitor) {}},
+		{name: "reordered JSON", change: func(m *db.Monitor) {
+			m.Params = datatypes.JSON(`{"window": "30m", "device": "UUID: 00-00-01"}`)
+		}},
+		{name: "state isn't a field", change: func(m *db.Monitor) {
+			m.State, m.LastStatus, m.Failures = "firing", "failed", 3
+		}},
+		{name: "condition", change: func(m *db.Monitor) {
+			m.Condition = datatypes.JSON(`{"type": "threshold", "field": "vpd", "min": 0.9}`)
+		}, fields: []string{"condition"}},
+		{name: "several", change: func(m *db.Monitor) {
+			m.ManagedBy = "other.yaml"
+			m.Interval = "10m"
+			m.Labels = nil
+		}, fields: []string{"file", "interval", "labels"}},
+		{name: "query for template", change: func(m *db.Monitor) {
+			m.Template, m.Params, m.Query = "", nil, "from(bucket: \"growmon\")"
+		}, fields: []string{"query", "template", "params"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			m := base()
+			tt.change(m)
+			is.Equal(strings.Join(changedFields(base(), m), ","), strings.Join(tt.fields, ","))
+		})
+	}
+}
+
+func TestCheckFileReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  []*db.Monitor
+		defined []*db.Monitor
+		ok      []string
+		errors  int
+	}{
+		{
+			name:    "refers to stored and defined monitors",
+			stored:  []*db.Monitor{monitorOn(t, "api", "")},
+			defined: []*db.Monitor{monitorOn(t, "a", "f.yaml"), monitorOn(t, "both", "f.yaml", "a", "api")},
+			ok:      []string{"a", "both"},
+		},
+		{
+			name:    "unknown monitor",
+			defined: []*db.Monitor{monitorOn(t, "a", "f.yaml"), monitorOn(t, "b", "f.yaml", "missing")},
+			ok:      []string{"a"},
+			errors:  1,
+		},
+		{
+			name:    "one of several unknown",
+			stored:  []*db.Monitor{monitorOn(t, "api", "")},
+			defined: []*db.Monitor{monitorOn(t, "b", "f.yaml", "api", "missing")},
+			ok:      []string{},
+			errors:  1,
+		},
+		{
+			name:    "cycle",
+			defined: []*db.Monitor{monitorOn(t, "a", "f.yaml", "b"), monitorOn(t, "b", "f.yaml", "a"), monitorOn(t, "c", "f.yaml")},
+			ok:      []string{"c"},
+			errors:  1,
+		},
+		{
+			name:    "cycle through a stored monitor",
+			stored:  []*db.Monitor{monitorOn(t, "api", "", "a")},
+			defined: []*db.Monitor{monitorOn(t, "a", "f.yaml", "api")},
+			ok:      []string{},
+			errors:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			diff := &fileDiff{}
+			is.Equal(names(checkFileReferences(tt.stored, tt.defined, diff)), tt.ok)
+			is.Equal(len(diff.Errors), tt.errors)
+		})
+	}
+}
+
+func TestCheckRemovals(t *testing.T) {
+	tests := []struct {
+		name    string
+		kept    []*db.Monitor
+		removed []*db.Monitor
+		defined []*db.Monitor
+		remove  []string
+		errors  int
+	}{
+		{
+			name:    "unused",
+			kept:    []*db.Monitor{monitorOn(t, "api", "")},
+			removed: []*db.Monitor{monitorOn(t, "a", "f.yaml")},
+			remove:  []string{"a"},
+		},
+		{
+			name:    "used through /monitors",
+			kept:    []*db.Monitor{monitorOn(t, "api", "", "a")},
+			removed: []*db.Monitor{monitorOn(t, "a", "f.yaml"), monitorOn(t, "b", "f.yaml")},
+			remove:  []string{"b"},
+			errors:  1,
+		},
+		{
+			name:    "used by a file",
+			removed: []*db.Monitor{monitorOn(t, "a", "f.yaml")},
+			defined: []*db.Monitor{monitorOn(t, "b", "g.yaml", "a")},
+			remove:  []string{},
+			errors:  1,
+		},
+		{
+			name:    "used through another removed monitor",
+			kept:    []*db.Monitor{monitorOn(t, "api", "", "b")},
+			removed: []*db.Monitor{monitorOn(t, "a", "f.yaml"), monitorOn(t, "b", "f.yaml", "a")},
+			remove:  []string{},
+			errors:  2,
+		},
+		{
+			name:    "removed together",
+			removed: []*db.Monitor{monitorOn(t, "a", "f.yaml"), monitorOn(t, "b", "f.yaml", "a")},
+			remove:  []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			diff := &fileDiff{}
+			kept, removed := checkRemovals(tt.kept, tt.removed, tt.defined, diff)
+			is.Equal(names(removed), tt.remove)
+			is.Equal(len(kept)+len(removed), len(tt.kept)+len(tt.removed)) // every monitor is kept or removed
+			is.Equal(len(diff.Errors), tt.errors)
+		})
+	}
+}
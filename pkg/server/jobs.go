@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+	"github.com/dylanlott/ubiquitous-disco/pkg/jobs"
+)
+
+// scheduleInterval is how often the leader enqueues due checks when
+// the job queue is scheduling them.
+const scheduleInterval = 5 * time.Second
+
+// pruneInterval is how often the leader prunes finished jobs.
+const pruneInterval = time.Hour
+
+// schedule enqueues a job for every monitor that is due for a check,
+// fails jobs that ran out of attempts, and prunes old finished jobs. Only the leader schedules, but every
+// instance runs a worker.
+func (s *S) schedule(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	var pruned time.Time
+	for {
+		if s.elector.IsLeader() {
+			if err := s.enqueueDue(ctx); err != nil {
+				log.Printf("failed to enqueue checks: %v", err)
+			}
+			if n, err := s.queue.Reap(ctx); err != nil {
+				log.Printf("failed to reap jobs: %v", err)
+			} else if n > 0 {
+				log.Printf("failed %d jobs whose claims expired", n)
+			}
+			if time.Since(pruned) >= pruneInterval {
+				if n, err := s.queue.Prune(ctx); err != nil {
+					log.Printf("failed to prune jobs: %v", err)
+				} else {
+					pruned = time.Now()
+					if n > 0 {
+						log.Printf("pruned %d finished jobs", n)
+					}
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueueDue enqueues a check for each monitor at the first multiple of
+// its interval after it was last checked. Monitors with a job already
+// queued or running are skipped, as are monitors this instance couldn't
+// build or hasn't loaded yet, whose jobs could only fail.
+func (s *S) enqueueDue(ctx context.Context) error {
+	var monitors []*db.Monitor
+	if tx := s.db.Where("query <> '' OR template <> '' OR condition IS NOT NULL").Find(&monitors); tx.Error != nil {
+		return tx.Error
+	}
+	running := s.runningMonitors()
+	for _, m := range monitors {
+		if !running[m.ID] {
+			continue
+		}
+		interval, err := parseInterval(m)
+		if err != nil {
+			log.Printf("skipping monitor %d: %v", m.ID, err)
+			continue
+		}
+		// checks are due on multiples of their interval, like in the
+		// Siren, so monitors that share a query run it together
+		due := m.LastChecked.Add(interval).Truncate(interval)
+		if _, err := s.queue.Enqueue(ctx, m.ID, due); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runJob checks a job's monitor once and returns its resulting state.
+// Whichever instance runs the job, the monitor carries on from the
+// Progress recorded by its last check.
+func (s *S) runJob(ctx context.Context, job *db.Job) (string, error) {
+	var m db.Monitor
+	if tx := s.db.First(&m, job.MonitorID); tx.Error != nil {
+		return "", tx.Error
+	}
+	mon := s.siren.Get(m.Name)
+	if mon == nil {
+		// the monitor was added since this instance last reconciled, so
+		// leave the job to be retried once it has
+		return "", fmt.Errorf("ErrMonitorNotLoaded: %q", m.Name)
+	}
+	p, err := progressOf(&m)
+	if err != nil {
+		return "", err
+	}
+	mon.Restore(p)
+
+	state, err := mon.Evaluate(ctx)
+	if tx := s.db.Model(&m).UpdateColumn("last_checked", time.Now()); tx.Error != nil {
+		log.Printf("failed to record check of monitor %d: %v", m.ID, tx.Error)
+	}
+	switch {
+	case errors.Is(err, alerts.ErrUnknown) || ctx.Err() != nil:
+		// the check never judged the data, e.g. because InfluxDB is down,
+		// so fail the job and let the queue retry it
+		return "", err
+	case err != nil:
+		return fmt.Sprintf("%s: %v", state, err), nil
+	}
+	return state.String(), nil
+}
+
+// jobsHandler lists jobs, newest first, filtered by the status and
+// monitor query params.
+func (s *S) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if s.queue == nil {
+		http.Error(w, "job queue is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var monitorID uint
+	if v := query.Get("monitor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		monitorID = uint(n)
+	}
+
+	list, err := s.queue.List(r.Context(), query.Get("status"), monitorID, limit)
+	writeJSON(w, list, err)
+}
+
+// jobStatsHandler reports job counts by status and the backlog of due jobs.
+func (s *S) jobStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if s.queue == nil {
+		http.Error(w, "job queue is disabled", http.StatusNotFound)
+		return
+	}
+	stats, err := s.queue.Stats(r.Context())
+	writeJSON(w, stats, err)
+}
+
+// newWorker returns a job queue worker for this instance.
+func (s *S) newWorker() *jobs.Worker {
+	return &jobs.Worker{
+		Queue: s.queue,
+		ID:    s.elector.ID,
+		Run:   s.runJob,
+		Poll:  time.Second,
+	}
+}
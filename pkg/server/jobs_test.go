@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+	"github.com/dylanlott/ubiquitous-disco/pkg/jobs"
+)
+
+// testQueueServer returns a server on a fresh in-memory database with a
+// job queue.
+func testQueueServer(t *testing.T) *S {
+	t.Helper()
+	s := testServer(t)
+	if err := s.db.AutoMigrate(&db.Job{}); err != nil {
+		t.Fatal(err)
+	}
+	s.queue = jobs.New(s.db)
+	s.queue.Now = func(ctx context.Context) (time.Time, error) { return time.Now(), nil }
+	return s
+}
+
+func TestEnqueueDue(t *testing.T) {
+	is := is.New(t)
+	s := testQueueServer(t)
+
+	var ids []uint
+	for _, name := range []string{"running", "invalid", "unloaded"} {
+		m := &db.Monitor{Name: name, Query: `from(bucket: "growmon")`}
+		is.NoErr(s.db.Create(m).Error)
+		ids = append(ids, m.ID)
+	}
+	s.loaded.byID[ids[0]] = loadedMonitor{name: "running", running: true}
+	s.loaded.byID[ids[1]] = loadedMonitor{name: "invalid"} // failed to build
+
+	is.NoErr(s.enqueueDue(context.Background()))
+	var queued []db.Job
+	is.NoErr(s.db.Find(&queued).Error)
+	is.Equal(len(queued), 1) // only the monitor the Siren runs
+	is.Equal(queued[0].MonitorID, ids[0])
+}
+
+func TestRunJob(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(ctx context.Context) (bool, error)
+		load  bool
+		want  string
+		err   string
+	}{
+		{
+			name:  "passes",
+			check: func(ctx context.Context) (bool, error) { return true, nil },
+			load:  true,
+			want:  "ok",
+		},
+		{
+			name:  "fails",
+			check: func(ctx context.Context) (bool, error) { return false, errors.New("too hot") },
+			load:  true,
+			want:  "firing: too hot",
+		},
+		{
+			name: "datasource is down",
+			check: func(ctx context.Context) (bool, error) {
+				return false, fmt.Errorf("%w: datasource influxdb is down", alerts.ErrUnknown)
+			},
+			load: true,
+			err:  "datasource influxdb is down",
+		},
+		{
+			name: "not loaded",
+			err:  "ErrMonitorNotLoaded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			s := testQueueServer(t)
+			m := &db.Monitor{Name: "api", Query: `from(bucket: "growmon")`}
+			is.NoErr(s.db.Create(m).Error)
+			if tt.load {
+				is.NoErr(s.siren.Add(context.Background(), &alerts.Monitor{Name: "api", Check: tt.check, Alert: func(context.Context, error) {}}))
+			}
+
+			result, err := s.runJob(context.Background(), &db.Job{MonitorID: m.ID})
+			if tt.err != "" {
+				is.True(err != nil)
+				is.True(strings.Contains(err.Error(), tt.err)) // job error
+				return
+			}
+			is.NoErr(err)
+			is.Equal(result, tt.want)
+		})
+	}
+}
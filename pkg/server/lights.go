@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// lightsHandler declares the whole light schedule route
+func (s *S) lightsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var schedules []*db.LightSchedule
+		if tx := s.db.Find(&schedules); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&schedules)
+		return
+	case http.MethodPost, http.MethodPut:
+		l := &db.LightSchedule{}
+		if err := json.NewDecoder(r.Body).Decode(l); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if l.Room == "" && l.Device == "" {
+			http.Error(w, "light schedule needs a room or a device", http.StatusBadRequest)
+			return
+		}
+		if _, err := toLightSchedule(l); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			// NB: respect only route param id to prevent mismatched updates
+			id, err := routeID(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l.ID = id
+		}
+		// the schedule may move, so rebuild the monitors where it was too
+		var old db.LightSchedule
+		if l.ID != 0 {
+			if tx := s.db.Limit(1).Find(&old, l.ID); tx.Error != nil {
+				http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if tx := s.db.Save(&l); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.rebuildMonitorsOn(context.Background(),
+			place{old.Room, old.Device}, place{l.Room, l.Device})
+		json.NewEncoder(w).Encode(l)
+		return
+	case http.MethodDelete:
+		id, err := routeID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var l db.LightSchedule
+		if tx := s.db.Limit(1).Find(&l, id); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		if tx := s.db.Delete(&db.LightSchedule{}, id); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		s.rebuildMonitorsOn(context.Background(), place{l.Room, l.Device})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// toLightSchedule parses and validates a stored light schedule.
+func toLightSchedule(l *db.LightSchedule) (*alerts.LightSchedule, error) {
+	on, err := alerts.ParseTimeOfDay(l.On)
+	if err != nil {
+		return nil, fmt.Errorf("invalid on: %w", err)
+	}
+	off, err := alerts.ParseTimeOfDay(l.Off)
+	if err != nil {
+		return nil, fmt.Errorf("invalid off: %w", err)
+	}
+	loc := time.UTC
+	if l.Timezone != "" {
+		if loc, err = time.LoadLocation(l.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+	var settle time.Duration
+	if l.Settle != "" {
+		if settle, err = time.ParseDuration(l.Settle); err != nil {
+			return nil, fmt.Errorf("invalid settle: %w", err)
+		}
+	}
+	return &alerts.LightSchedule{
+		On:       on,
+		Off:      off,
+		Location: loc,
+		Settle:   alerts.Duration(settle),
+	}, nil
+}
+
+// lightsFor returns the light schedule on a monitor's device, or failing
+// that in its room, or nil if there is none.
+func (s *S) lightsFor(m *db.Monitor) (*alerts.LightSchedule, error) {
+	var l db.LightSchedule
+	found, err := s.attachedTo(m, &l, "")
+	if err != nil || !found {
+		return nil, err
+	}
+	return toLightSchedule(&l)
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/dylanlott/ubiquitous-disco/pkg/db"
 
@@ -27,8 +31,25 @@ func (s *S) monitorHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(&monitors)
 		return
 	case http.MethodPost:
-		var mon *db.Monitor
-		if err := json.NewDecoder(r.Body).Decode(&mon); err != nil {
+		mon, err := decodeMonitor(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// monitors can only be put under a file's management by the file
+		mon.ManagedBy = ""
+		if err := s.checkName(mon.Name, 0); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		// build the monitor first so invalid definitions are never saved
+		if _, err := s.newMonitor(mon); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.checkReferences(mon); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -40,13 +61,19 @@ func (s *S) monitorHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// start it here right away; other instances pick it up when they
+		// next reconcile
+		if err := s.reconcileMonitors(context.Background()); err != nil {
+			log.Printf("failed to reconcile monitors: %v", err)
+		}
+
 		json.NewEncoder(w).Encode(mon)
 		return
 	case http.MethodPut:
 		vars := mux.Vars(r)
 		if id, ok := vars["id"]; ok {
-			var m *db.Monitor
-			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			m, err := decodeMonitor(r)
+			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
@@ -59,12 +86,46 @@ func (s *S) monitorHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			m.ID = uint(d)
 
+			var old db.Monitor
+			if tx := s.db.First(&old, m.ID); tx.Error != nil {
+				http.Error(w, tx.Error.Error(), http.StatusNotFound)
+				return
+			}
+			if old.ManagedBy != "" {
+				http.Error(w, fmt.Sprintf("monitor %q is managed by %s, edit the file instead", old.Name, old.ManagedBy), http.StatusForbidden)
+				return
+			}
+			m.ManagedBy = ""
+			if err := s.checkName(m.Name, m.ID); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if m.Name != old.Name && !s.unused(w, old.Name, "renamed") {
+				return
+			}
+			if _, err := s.newMonitor(m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.checkReferences(m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// keep what the monitor's checks recorded
+			m.CreatedAt = old.CreatedAt
+			keepProgress(m, &old)
 			tx := s.db.Save(&m)
 			if tx.Error != nil {
 				http.Error(w, tx.Error.Error(), http.StatusBadRequest)
 				return
 			}
 
+			// restart the monitor with its new definition
+			if err := s.reconcileMonitors(context.Background()); err != nil {
+				log.Printf("failed to reconcile monitors: %v", err)
+			}
+
 			json.NewEncoder(w).Encode(&m)
 			return
 		}
@@ -73,11 +134,26 @@ func (s *S) monitorHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodDelete:
 		vars := mux.Vars(r)
 		if v, ok := vars["id"]; ok {
+			var old db.Monitor
+			if tx := s.db.First(&old, v); tx.Error != nil {
+				http.Error(w, tx.Error.Error(), http.StatusNotFound)
+				return
+			}
+			if old.ManagedBy != "" {
+				http.Error(w, fmt.Sprintf("monitor %q is managed by %s, remove it from the file instead", old.Name, old.ManagedBy), http.StatusForbidden)
+				return
+			}
+			if !s.unused(w, old.Name, "deleted") {
+				return
+			}
 			tx := s.db.Delete(&db.Monitor{}, v)
 			if tx.Error != nil {
 				http.Error(w, tx.Error.Error(), http.StatusBadRequest)
 				return
 			}
+			if err := s.reconcileMonitors(context.Background()); err != nil {
+				log.Printf("failed to reconcile monitors: %v", err)
+			}
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -90,3 +166,49 @@ func (s *S) monitorHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	return
 }
+
+// decodeMonitor decodes the monitor definition in a request's body. A
+// body of null is rejected rather than decoded into a nil monitor.
+func decodeMonitor(r *http.Request) (*db.Monitor, error) {
+	var m *db.Monitor
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("body must be a monitor, not null")
+	}
+	return m, nil
+}
+
+// checkName returns an error if a stored monitor other than the one with
+// id already has the name. Names must be unique so that the Siren and
+// composite conditions can refer to monitors by name.
+func (s *S) checkName(name string, id uint) error {
+	var other db.Monitor
+	tx := s.db.Where("name = ? AND id <> ?", name, id).Limit(1).Find(&other)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil
+	}
+	if other.ManagedBy != "" {
+		return fmt.Errorf("monitor %q is managed by a monitor file", name)
+	}
+	return fmt.Errorf("monitor %q already exists", name)
+}
+
+// unused reports whether no composite monitor refers to the named monitor,
+// which can only then be renamed or deleted. Otherwise it writes the error.
+func (s *S) unused(w http.ResponseWriter, name, action string) bool {
+	users, err := s.referrers(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if len(users) > 0 {
+		http.Error(w, fmt.Sprintf("monitor %q can't be %s, it's used by %s", name, action, strings.Join(users, ", ")), http.StatusConflict)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestNullMonitorBody(t *testing.T) {
+	s := testServer(t)
+	seedBundleTest(t, s)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+	}{
+		{name: "create", handler: s.monitorHandler, method: http.MethodPost},
+		{name: "update", handler: s.monitorHandler, method: http.MethodPut},
+		{name: "preview", handler: s.previewHandler, method: http.MethodPost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			w := serve(tt.handler, tt.method, 1, "null")
+			is.Equal(w.Code, http.StatusBadRequest)
+			is.Equal(w.Body.String(), "body must be a monitor, not null\n")
+		})
+	}
+}
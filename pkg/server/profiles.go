@@ -0,0 +1,329 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// stageInterval is how often running grows are checked for stage transitions.
+const stageInterval = time.Minute
+
+// profileHandler declares the whole grow profile route
+func (s *S) profileHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var profiles []*db.GrowProfile
+		if tx := s.db.Find(&profiles); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&profiles)
+		return
+	case http.MethodPost, http.MethodPut:
+		p := &db.GrowProfile{}
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := toProfile(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			// NB: respect only route param id to prevent mismatched updates
+			id, err := routeID(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.ID = id
+		}
+		// monitors where the profile's grows are attached are built with
+		// it, so the profile is only saved if they still build
+		var unbuilt error
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(&p).Error; err != nil {
+				return err
+			}
+			staged := *s
+			staged.db = tx
+			unbuilt = staged.rebuildAffected(&affectedMonitors{places: staged.growPlaces(p.ID)})
+			return unbuilt
+		})
+		switch {
+		case unbuilt != nil:
+			http.Error(w, unbuilt.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.reconcileMonitors(context.Background()); err != nil {
+			log.Printf("failed to reconcile monitors: %v", err)
+		}
+		json.NewEncoder(w).Encode(p)
+		return
+	case http.MethodDelete:
+		id, err := routeID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var running int64
+		if tx := s.db.Model(&db.Grow{}).Where("profile_id = ? AND ended_at IS NULL", id).Count(&running); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		if running > 0 {
+			http.Error(w, fmt.Sprintf("profile %d is followed by %d running grows", id, running), http.StatusConflict)
+			return
+		}
+		// NB: monitors are only built with running grows, so none of them
+		// need rebuilding
+		if tx := s.db.Delete(&db.GrowProfile{}, id); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// growHandler declares the whole grow route, which attaches profiles
+// to rooms and devices.
+func (s *S) growHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var grows []*db.Grow
+		if tx := s.db.Find(&grows); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&grows)
+		return
+	case http.MethodPost, http.MethodPut:
+		g := &db.Grow{}
+		if err := json.NewDecoder(r.Body).Decode(g); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if g.Room == "" && g.Device == "" {
+			http.Error(w, "grow needs a room or a device", http.StatusBadRequest)
+			return
+		}
+		if tx := s.db.First(&db.GrowProfile{}, g.ProfileID); tx.Error != nil {
+			http.Error(w, fmt.Sprintf("profile %d: %s", g.ProfileID, tx.Error), http.StatusBadRequest)
+			return
+		}
+		if g.StartedAt.IsZero() {
+			g.StartedAt = time.Now()
+		}
+
+		if r.Method == http.MethodPut {
+			// NB: respect only route param id to prevent mismatched updates
+			id, err := routeID(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			g.ID = id
+		}
+		// the grow may move, so rebuild the monitors where it was too
+		var old db.Grow
+		if g.ID != 0 {
+			if tx := s.db.Limit(1).Find(&old, g.ID); tx.Error != nil {
+				http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		// the stage is watchStages' to keep, unless the grow now follows
+		// another profile or schedule
+		g.Stage = -1
+		if old.ID != 0 && old.ProfileID == g.ProfileID && old.StartedAt.Equal(g.StartedAt) {
+			g.Stage = old.Stage
+		}
+		if tx := s.db.Save(&g); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.rebuildMonitorsOn(context.Background(),
+			place{old.Room, old.Device}, place{g.Room, g.Device})
+		json.NewEncoder(w).Encode(g)
+		return
+	case http.MethodDelete:
+		id, err := routeID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var g db.Grow
+		if tx := s.db.Limit(1).Find(&g, id); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		if tx := s.db.Delete(&db.Grow{}, id); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		s.rebuildMonitorsOn(context.Background(), place{g.Room, g.Device})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// growPlaces returns where the grows that follow a profile are attached.
+func (s *S) growPlaces(profileID uint) []place {
+	var grows []*db.Grow
+	if tx := s.db.Where("profile_id = ?", profileID).Find(&grows); tx.Error != nil {
+		log.Printf("failed to load grows of profile %d: %v", profileID, tx.Error)
+		return nil
+	}
+	places := make([]place, 0, len(grows))
+	for _, g := range grows {
+		places = append(places, place{g.Room, g.Device})
+	}
+	return places
+}
+
+// routeID parses the {id} route param.
+func routeID(r *http.Request) (uint, error) {
+	v, ok := mux.Vars(r)["id"]
+	if !ok {
+		return 0, fmt.Errorf("must provide id")
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
+
+// toProfile decodes and validates a stored profile.
+func toProfile(p *db.GrowProfile) (*alerts.Profile, error) {
+	profile := &alerts.Profile{Name: p.Name}
+	if len(p.Stages) > 0 {
+		if err := json.Unmarshal(p.Stages, &profile.Stages); err != nil {
+			return nil, fmt.Errorf("invalid stages: %w", err)
+		}
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// toGrow loads a stored grow's profile and returns it as an alerts.Grow.
+func (s *S) toGrow(g *db.Grow) (*alerts.Grow, error) {
+	var p db.GrowProfile
+	if tx := s.db.First(&p, g.ProfileID); tx.Error != nil {
+		return nil, tx.Error
+	}
+	profile, err := toProfile(&p)
+	if err != nil {
+		return nil, err
+	}
+	return &alerts.Grow{Profile: profile, Start: g.StartedAt}, nil
+}
+
+// growFor returns the running grow on a monitor's device, or failing
+// that in its room, or nil if there is none.
+func (s *S) growFor(m *db.Monitor) (*alerts.Grow, error) {
+	var g db.Grow
+	found, err := s.attachedTo(m, &g, "ended_at IS NULL")
+	if err != nil || !found {
+		return nil, err
+	}
+	return s.toGrow(&g)
+}
+
+// attachedTo finds the newest row of dest's model that is on a monitor's
+// device, or failing that in its room, and meets the extra where clause.
+func (s *S) attachedTo(m *db.Monitor, dest interface{}, where string) (bool, error) {
+	for _, on := range []struct{ column, value string }{
+		{"device", m.Device},
+		{"room", m.Room},
+	} {
+		if on.value == "" {
+			continue
+		}
+		tx := s.db.Where(on.column+" = ?", on.value)
+		if where != "" {
+			tx = tx.Where(where)
+		}
+		tx = tx.Order("created_at DESC").Limit(1).Find(dest)
+		if tx.Error != nil {
+			return false, tx.Error
+		}
+		if tx.RowsAffected == 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// watchStages notifies when a running grow moves into a new stage.
+// The stage is swapped in the database so that only one instance
+// notifies about each transition.
+func (s *S) watchStages(ctx context.Context) {
+	notify := alerts.Notify("events", func(ctx context.Context, err error) error {
+		return s.db.Create(&db.Event{
+			Kind:    "stage",
+			Message: err.Error(),
+			Source:  "grows",
+		}).Error
+	})
+
+	ticker := time.NewTicker(stageInterval)
+	defer ticker.Stop()
+	for {
+		var grows []*db.Grow
+		if tx := s.db.Where("ended_at IS NULL").Find(&grows); tx.Error != nil {
+			log.Printf("failed to load grows: %v", tx.Error)
+		}
+		for _, g := range grows {
+			grow, err := s.toGrow(g)
+			if err != nil {
+				log.Printf("failed to load grow %d: %v", g.ID, err)
+				continue
+			}
+			i := grow.Stage(time.Now())
+			if i < 0 || i == g.Stage {
+				continue
+			}
+			tx := s.db.Model(&db.Grow{}).Where("id = ? AND stage = ?", g.ID, g.Stage).Update("stage", i)
+			if tx.Error != nil || tx.RowsAffected == 0 {
+				continue
+			}
+			where := g.Room
+			if g.Device != "" {
+				where = g.Device
+			}
+			notify(ctx, fmt.Errorf("%s entered the %s stage of %s",
+				where, grow.Profile.Stages[i].Name, grow.Profile.Name))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
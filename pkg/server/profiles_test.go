@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matryer/is"
+	"gorm.io/datatypes"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// serve calls handler with a request to the {id} route.
+func serve(handler http.HandlerFunc, method string, id uint, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(id)})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// seedGrow stores a profile, a grow of it in tent-1 that has reached its
+// second stage, and a monitor that takes its bounds from the grow.
+func seedGrow(t *testing.T, s *S) (*db.GrowProfile, *db.Grow, *db.Monitor) {
+	t.Helper()
+	p := &db.GrowProfile{Name: "tomato", Stages: datatypes.JSON(`[
+		{"name": "seedling", "duration": "336h", "targets": {"temperature": {"day": {"min": 22, "max": 26}}}},
+		{"name": "veg", "duration": "720h", "targets": {"temperature": {"day": {"min": 20, "max": 28}}}}
+	]`)}
+	if err := s.db.Create(p).Error; err != nil {
+		t.Fatal(err)
+	}
+	g := &db.Grow{ProfileID: p.ID, Room: "tent-1", StartedAt: time.Now().Add(-20 * 24 * time.Hour), Stage: 1}
+	if err := s.db.Create(g).Error; err != nil {
+		t.Fatal(err)
+	}
+	m := &db.Monitor{Name: "tent-1-temp", Query: `from(bucket: "growmon")`, Room: "tent-1",
+		Condition: datatypes.JSON(`{"type": "threshold", "field": "temperature"}`)}
+	if err := s.db.Create(m).Error; err != nil {
+		t.Fatal(err)
+	}
+	return p, g, m
+}
+
+func TestProfileHandler(t *testing.T) {
+	is := is.New(t)
+	s := testServer(t)
+	p, g, m := seedGrow(t, s)
+
+	// the monitor on the profile's grow is rebuilt with the new stages
+	w := serve(s.profileHandler, http.MethodPut, p.ID, `{"Name": "tomato", "Stages": [
+		{"name": "veg", "duration": "720h", "targets": {"temperature": {"day": {"min": 18, "max": 30}}}}
+	]}`)
+	is.Equal(w.Code, http.StatusOK)
+	var stored db.Monitor
+	is.NoErr(s.db.First(&stored, m.ID).Error)
+	is.True(stored.UpdatedAt.After(m.UpdatedAt))
+
+	w = serve(s.profileHandler, http.MethodDelete, p.ID, "")
+	is.Equal(w.Code, http.StatusConflict) // the grow still follows it
+
+	is.NoErr(s.db.Model(g).Update("ended_at", time.Now()).Error)
+	w = serve(s.profileHandler, http.MethodDelete, p.ID, "")
+	is.Equal(w.Code, http.StatusNoContent)
+}
+
+func TestGrowHandlerStage(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  func(g *db.Grow) string
+		stage int
+	}{
+		{
+			name: "moved",
+			body: func(g *db.Grow) string {
+				return fmt.Sprintf(`{"ProfileID": %d, "Room": "tent-2", "StartedAt": %q}`,
+					g.ProfileID, g.StartedAt.Format(time.RFC3339Nano))
+			},
+			stage: 1,
+		},
+		{
+			name: "restarted",
+			body: func(g *db.Grow) string {
+				return fmt.Sprintf(`{"ProfileID": %d, "Room": "tent-1", "StartedAt": %q}`,
+					g.ProfileID, time.Now().Format(time.RFC3339Nano))
+			},
+			stage: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			s := testServer(t)
+			_, g, _ := seedGrow(t, s)
+
+			w := serve(s.growHandler, http.MethodPut, g.ID, tt.body(g))
+			is.Equal(w.Code, http.StatusOK)
+			var stored db.Grow
+			is.NoErr(s.db.First(&stored, g.ID).Error)
+			is.Equal(stored.Stage, tt.stage)
+		})
+	}
+}
+
+func TestNullBody(t *testing.T) {
+	s := testServer(t)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{name: "profile", handler: s.profileHandler},
+		{name: "grow", handler: s.growHandler},
+		{name: "light schedule", handler: s.lightsHandler},
+		{name: "calibration", handler: s.calibrationHandler},
+		{name: "template", handler: s.templateHandler},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			w := serve(tt.handler, http.MethodPost, 0, "null")
+			is.Equal(w.Code, http.StatusBadRequest)
+		})
+	}
+}
@@ -8,15 +8,18 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gorm.io/gorm"
 
 	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/cluster"
 	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+	"github.com/dylanlott/ubiquitous-disco/pkg/jobs"
 )
 
 // key is used tracking context keys
@@ -35,31 +38,89 @@ var nextRequestID = func() string {
 	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
 
+// shutdownTimeout is how long in-flight requests get to finish on shutdown.
+const shutdownTimeout = 15 * time.Second
+
 // S holds all of the relevant pieces together
 // for our monitoring service.
 type S struct {
-	db     *gorm.DB
-	influx influxdb2.Client
-	siren  *alerts.Siren
-	srv    *http.Server
+	db      *gorm.DB
+	influx  *alerts.InfluxClient // the one connection to InfluxDB
+	source  alerts.DataSource
+	breaker *alerts.Breaker // tracks whether InfluxDB is up
+	siren   *alerts.Siren
+	elector *cluster.Elector
+	members *cluster.Membership
+	queue   *jobs.Queue   // nil unless checks are scheduled through the job queue
+	files   *monitorFiles // nil unless monitors are loaded from MONITORS_DIR
+	srv     *http.Server
+	loaded  *loadedMonitors // the stored monitors the Siren runs
 }
 
 // New creates a new server with a given set of templates and static
 // embeds and returns it
 func New(t *template.Template, static embed.FS, addr string) (*S, error) {
 	s := &S{
-		db: db.New(),
+		db:     db.New(),
+		loaded: &loadedMonitors{byID: map[uint]loadedMonitor{}},
 		srv: &http.Server{
 			Addr: addr,
 		},
 	}
 
-	// connect to influx
-	influxURL := os.Getenv("INFLUX_URL")
-	influxToken := os.Getenv("INFLUX_TOKEN")
-	client := influxdb2.NewClient(influxURL, influxToken)
-	defer client.Close()
-	s.influx = client
+	// connect to influx. The routes and the monitors share this client,
+	// and Serve closes it on shutdown.
+	config, err := alerts.InfluxConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	source, err := alerts.NewInfluxClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create influx client: %w", err)
+	}
+	s.influx = source
+
+	// every instance runs the siren, but monitors only run their checks
+	// on the instance whose shard they fall in. With SCHEDULER=queue checks
+	// are instead run as jobs that any instance's worker can claim.
+	// monitors that run the same query at the same time share its result,
+	// and scheduled checks of different devices are batched into one query
+	ttl := defaultQueryCacheTTL
+	if v := os.Getenv("QUERY_CACHE_TTL"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid QUERY_CACHE_TTL: %w", err)
+		}
+	}
+	s.breaker = &alerts.Breaker{
+		Source:   &alerts.Batched{Source: source},
+		Name:     "influxdb",
+		Health:   source.Health,
+		OnChange: s.datasourceChanged,
+	}
+	shared := &alerts.Shared{Source: s.breaker, TTL: ttl}
+	// NB: everything that reads device data goes through s.source so that
+	// calibrations apply the same way everywhere
+	s.source = &alerts.Calibrated{Source: shared, Calibrations: s.calibrations}
+	s.siren = &alerts.Siren{}
+	if os.Getenv("SCHEDULER") == "queue" {
+		s.queue = jobs.New(s.db)
+		s.siren.External = true
+	}
+	if dir := os.Getenv("MONITORS_DIR"); dir != "" {
+		s.files = &monitorFiles{dir: dir}
+	}
+	id := cluster.InstanceID()
+	// the scheduler lease picks the one instance that enqueues checks
+	// when SCHEDULER=queue. Sharding needs no leader, so otherwise it's
+	// only reported by /status.
+	s.elector = cluster.NewElector(s.db, "scheduler", id)
+	s.members = cluster.NewMembership(s.db, id, func() []string {
+		var names []string
+		for _, m := range s.siren.Monitors() {
+			names = append(names, m.Name)
+		}
+		return names
+	})
 
 	// make a new logger
 	logger := log.New(os.Stdout, "api: ", log.LstdFlags)
@@ -71,11 +132,62 @@ func New(t *template.Template, static embed.FS, addr string) (*S, error) {
 	return s, nil
 }
 
-// Serve listens at the configured address
-// TODO: Handle context cancellation and graceful shutdown
+// Serve starts the Siren and listens at the configured address until
+// SIGINT or SIGTERM. It then stops the monitors and background loops,
+// lets in-flight requests finish, and closes the InfluxDB client. It
+// returns nil after a clean shutdown.
 func (s *S) Serve() error {
-	log.Printf("listening at %s", s.srv.Addr)
-	return s.srv.ListenAndServe()
+	defer s.influx.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.elector.Run(ctx)
+	go s.members.Run(ctx)
+	go s.watchStages(ctx)
+	if s.queue != nil {
+		go s.schedule(ctx)
+		go s.newWorker().Start(ctx)
+	}
+	if s.files != nil {
+		diff, err := s.syncMonitorFiles(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load monitor files: %w", err)
+		}
+		log.Printf("loaded monitor files from %s: %s", s.files.dir, diff)
+		go s.watchMonitorFiles(ctx)
+	}
+	if err := s.reconcileMonitors(ctx); err != nil {
+		return fmt.Errorf("failed to load monitors: %w", err)
+	}
+	go s.watchMonitors(ctx)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("listening at %s", s.srv.Addr)
+		errs <- s.srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Printf("shutting down on %s", sig)
+	}
+	// stop checks before the InfluxDB client closes under them
+	cancel()
+	shutdownCtx, done := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer done()
+	err := s.srv.Shutdown(shutdownCtx)
+	// monitors started by requests don't run under ctx
+	for _, m := range s.siren.Monitors() {
+		s.siren.Remove(m.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to shut down: %w", err)
+	}
+	return nil
 }
 
 // routes muxes the templates with the handlers and returns the muxer
@@ -88,19 +200,21 @@ func (s *S) routes(t *template.Template, static embed.FS) *mux.Router {
 
 	// index
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		hc, err := s.influx.Health(context.Background())
-		if err != nil {
-			log.Fatalf("failed influxDB health check: %v", err)
+		status := "pass"
+		if err := s.influx.Health(r.Context()); err != nil {
+			log.Printf("failed influxDB health check: %v", err)
+			status = "unreachable"
 		}
 
 		data := map[string]string{
 			"Region": os.Getenv("FLY_REGION"),
-			"Status": string(hc.Status),
+			"Status": status,
 		}
 		t.ExecuteTemplate(w, "index.html.tmpl", data)
 	})
 
 	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc("/status", s.statusHandler)
 
 	// product handles simple product pages
 	router.HandleFunc("/product", func(w http.ResponseWriter, r *http.Request) {
@@ -115,12 +229,12 @@ func (s *S) routes(t *template.Template, static embed.FS) *mux.Router {
 
 	router.HandleFunc("/buckets", func(w http.ResponseWriter, r *http.Request) {
 		data := map[string]interface{}{}
-		buckets, err := s.influx.BucketsAPI().GetBuckets(context.Background())
+		buckets, err := s.influx.Buckets(r.Context())
 		if err != nil {
 			w.Write([]byte(fmt.Sprintf("failed to get buckets: %s", err)))
 			return
 		}
-		for _, b := range *buckets {
+		for _, b := range buckets {
 			data[b.Name] = b
 		}
 		t.ExecuteTemplate(w, "buckets.html.tmpl", map[string]interface{}{"Buckets": data})
@@ -128,7 +242,24 @@ func (s *S) routes(t *template.Template, static embed.FS) *mux.Router {
 
 	// monitors
 	router.HandleFunc("/monitors", s.monitorHandler)
+	router.HandleFunc("/monitors/preview", s.previewHandler)
+	router.HandleFunc("/monitors/backtest", s.backtestHandler)
+	router.HandleFunc("/monitors/files", s.monitorFilesHandler)
 	router.HandleFunc("/monitors/{id}", s.monitorHandler)
+	router.HandleFunc("/profiles", s.profileHandler)
+	router.HandleFunc("/profiles/{id}", s.profileHandler)
+	router.HandleFunc("/grows", s.growHandler)
+	router.HandleFunc("/grows/{id}", s.growHandler)
+	router.HandleFunc("/lights", s.lightsHandler)
+	router.HandleFunc("/lights/{id}", s.lightsHandler)
+	router.HandleFunc("/calibrations", s.calibrationHandler)
+	router.HandleFunc("/calibrations/{id}", s.calibrationHandler)
+	router.HandleFunc("/templates", s.templateHandler)
+	router.HandleFunc("/templates/{id}", s.templateHandler)
+	router.HandleFunc("/jobs", s.jobsHandler)
+	router.HandleFunc("/jobs/stats", s.jobStatsHandler)
+	router.HandleFunc("/export", s.exportHandler)
+	router.HandleFunc("/import", s.importHandler)
 
 	// customers
 	router.HandleFunc("/config", handleConfig)
@@ -147,6 +278,46 @@ func (s *S) routes(t *template.Template, static embed.FS) *mux.Router {
 	return router
 }
 
+// statusHandler reports this instance, which instance currently holds
+// the scheduler lease, and the live members sharing the monitors. The
+// lease only decides anything when checks are scheduled through the job
+// queue.
+func (s *S) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	lease, err := s.elector.Leader(r.Context())
+	if err != nil {
+		writeJSON(w, nil, err)
+		return
+	}
+	members, err := s.members.Members(r.Context())
+	if err != nil {
+		writeJSON(w, nil, err)
+		return
+	}
+	writeJSON(w, struct {
+		Instance       string              `json:"instance"`
+		Region         string              `json:"region"`
+		IsLeader       bool                `json:"isLeader"`
+		Leader         string              `json:"leader"`
+		LeaseExpiresAt time.Time           `json:"leaseExpiresAt"`
+		Monitors       int                 `json:"monitors"`
+		Members        []db.Member         `json:"members"`
+		Datasource     alerts.SourceHealth `json:"datasource"`
+	}{
+		Instance:       s.elector.ID,
+		Region:         os.Getenv("FLY_REGION"),
+		IsLeader:       s.elector.IsLeader(),
+		Leader:         lease.Holder,
+		LeaseExpiresAt: lease.ExpiresAt,
+		Monitors:       len(s.siren.Monitors()),
+		Members:        members,
+		Datasource:     s.breaker.Status(),
+	}, nil)
+}
+
 // tracing adds tracing to our API by wrapping requests and adding an X-Request-ID header.
 func tracing(nextRequestID requestIDFunc) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
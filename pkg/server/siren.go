@@ -0,0 +1,591 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// defaultInterval is used for monitors that don't set their own Interval.
+const defaultInterval = time.Minute * 15
+
+// minInterval is the shortest Interval a monitor can be checked at. Each
+// check claims the monitor in Postgres and queries InfluxDB.
+const minInterval = 10 * time.Second
+
+// defaultQueryCacheTTL is how long query results are reused, unless
+// QUERY_CACHE_TTL says otherwise.
+const defaultQueryCacheTTL = 30 * time.Second
+
+// reconcileInterval is how often every instance brings its Siren in line
+// with the stored monitors, picking up changes made through other instances.
+const reconcileInterval = 10 * time.Second
+
+// loadedMonitors are the stored monitors the Siren runs, by ID.
+type loadedMonitors struct {
+	sync.Mutex
+	byID map[uint]loadedMonitor
+}
+
+// loadedMonitor is the version of a stored monitor that the Siren runs.
+type loadedMonitor struct {
+	name      string
+	updatedAt time.Time
+	running   bool // false if the monitor couldn't be built
+}
+
+// reconcileMonitors brings the Siren in line with the stored monitors.
+// Monitors are keyed by ID and rebuilt only when their updated_at moves,
+// so a monitor that hasn't changed keeps its state and timers. Every
+// change to a monitor, or to anything it's built from, must therefore
+// touch its updated_at.
+func (s *S) reconcileMonitors(ctx context.Context) error {
+	s.loaded.Lock()
+	defer s.loaded.Unlock()
+
+	var monitors []*db.Monitor
+	if tx := s.db.Find(&monitors); tx.Error != nil {
+		return tx.Error
+	}
+	// stop every changed or removed monitor before starting any, so that
+	// monitors can swap names
+	stored := map[uint]bool{}
+	var changed []*db.Monitor
+	for _, m := range monitors {
+		if !hasCheck(m) {
+			continue
+		}
+		stored[m.ID] = true
+		old, ok := s.loaded.byID[m.ID]
+		if ok && old.updatedAt.Equal(m.UpdatedAt) {
+			if old.running {
+				s.refreshProgress(m)
+			}
+			continue
+		}
+		changed = append(changed, m)
+		if ok && old.running {
+			s.siren.Remove(old.name)
+		}
+	}
+	for id, old := range s.loaded.byID {
+		if stored[id] {
+			continue
+		}
+		if old.running {
+			s.siren.Remove(old.name)
+		}
+		delete(s.loaded.byID, id)
+	}
+
+	for _, m := range changed {
+		loaded := loadedMonitor{name: m.Name, updatedAt: m.UpdatedAt}
+		if err := s.startMonitor(ctx, m); err != nil {
+			log.Printf("failed to start monitor %d: %v", m.ID, err)
+			// NB: the definition hasn't changed, so leave updated_at alone
+			tx := s.db.Model(&db.Monitor{}).Where("id = ?", m.ID).UpdateColumn("last_status", "invalid: "+err.Error())
+			if tx.Error != nil {
+				log.Printf("failed to record status of monitor %d: %v", m.ID, tx.Error)
+			}
+		} else {
+			loaded.running = true
+		}
+		s.loaded.byID[m.ID] = loaded
+	}
+	return nil
+}
+
+// runningMonitors returns the IDs of the stored monitors the Siren runs,
+// as of the last reconcile.
+func (s *S) runningMonitors() map[uint]bool {
+	s.loaded.Lock()
+	defer s.loaded.Unlock()
+	running := map[uint]bool{}
+	for id, l := range s.loaded.byID {
+		if l.running {
+			running[id] = true
+		}
+	}
+	return running
+}
+
+// refreshProgress restores a running monitor's Progress from its stored
+// row. Only the instance that checks a monitor keeps its Progress in step,
+// so this brings the others up to date, and with them the firing gauge.
+func (s *S) refreshProgress(m *db.Monitor) {
+	mon := s.siren.Get(m.Name)
+	if mon == nil {
+		return
+	}
+	p, err := progressOf(m)
+	if err != nil {
+		log.Printf("failed to restore state of monitor %d: %v", m.ID, err)
+		return
+	}
+	mon.Restore(p)
+}
+
+// watchMonitors reconciles the Siren every reconcileInterval until ctx
+// is cancelled.
+func (s *S) watchMonitors(ctx context.Context) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.reconcileMonitors(ctx); err != nil {
+			log.Printf("failed to reconcile monitors: %v", err)
+		}
+	}
+}
+
+// place is the room and device a grow or light schedule is attached to.
+type place struct{ room, device string }
+
+// String names the place, e.g. "room tent-1".
+func (p place) String() string {
+	switch {
+	case p.device == "":
+		return "room " + p.room
+	case p.room == "":
+		return "device " + p.device
+	default:
+		return fmt.Sprintf("room %s, device %s", p.room, p.device)
+	}
+}
+
+// rebuildMonitorsOn rebuilds the monitors in the rooms and on the devices
+// of places, e.g. after a grow there has changed. It moves their
+// updated_at so that every instance rebuilds them, and leaves every other
+// monitor's state and timers alone.
+func (s *S) rebuildMonitorsOn(ctx context.Context, places ...place) {
+	for _, p := range places {
+		if err := s.touchMonitors(p); err != nil {
+			log.Printf("failed to touch monitors on %s: %v", p, err)
+		}
+	}
+	if err := s.reconcileMonitors(ctx); err != nil {
+		log.Printf("failed to reconcile monitors: %v", err)
+	}
+}
+
+// touchMonitors moves updated_at on the monitors in p's room or on its
+// device.
+func (s *S) touchMonitors(p place) error {
+	tx := s.db.Model(&db.Monitor{})
+	switch {
+	case p.room == "" && p.device == "":
+		return nil
+	case p.room == "":
+		tx = tx.Where("device = ?", p.device)
+	case p.device == "":
+		tx = tx.Where("room = ?", p.room)
+	default:
+		tx = tx.Where("room = ? OR device = ?", p.room, p.device)
+	}
+	return tx.Update("updated_at", time.Now()).Error
+}
+
+// startMonitor builds an alerts.Monitor from a stored monitor and adds it
+// to the Siren. The monitor carries on from its stored state, so one that
+// was firing before a restart resolves when it next passes.
+func (s *S) startMonitor(ctx context.Context, m *db.Monitor) error {
+	mon, err := s.newMonitor(m)
+	if err != nil {
+		return err
+	}
+	p, err := progressOf(m)
+	if err != nil {
+		return err
+	}
+	mon.Restore(p)
+	return s.siren.Add(ctx, mon)
+}
+
+// progressOf returns the Progress a stored monitor recorded at its last
+// check.
+func progressOf(m *db.Monitor) (alerts.Progress, error) {
+	p := alerts.Progress{Since: m.FailingSince, Failures: m.Failures}
+	if m.State == "" {
+		return p, nil
+	}
+	state, err := alerts.ParseState(m.State)
+	if err != nil {
+		return p, err
+	}
+	p.State = state
+	return p, nil
+}
+
+// restoreProgress sets a monitor's Progress to what its last check
+// recorded, which may have been made by another instance before a shard
+// handoff.
+func (s *S) restoreProgress(mon *alerts.Monitor, id uint) error {
+	var m db.Monitor
+	tx := s.db.Select("id", "state", "failing_since", "failures").First(&m, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	p, err := progressOf(&m)
+	if err != nil {
+		return err
+	}
+	mon.Restore(p)
+	return nil
+}
+
+// keepProgress carries what checking a stored monitor recorded over from
+// old to m, e.g. when m is a new definition of it.
+func keepProgress(m, old *db.Monitor) {
+	m.LastChecked, m.LastStatus = old.LastChecked, old.LastStatus
+	m.State, m.FailingSince, m.Failures = old.State, old.FailingSince, old.Failures
+}
+
+// newMonitor builds an alerts.Monitor that checks a stored monitor's query
+// against InfluxDB, records its status, and logs alerts as Events.
+// It only runs its check on the instance whose shard it falls in.
+func (s *S) newMonitor(m *db.Monitor) (*alerts.Monitor, error) {
+	interval, err := parseInterval(m)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := parseFor(m)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := s.newRule(m, interval)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Labels) > 0 {
+		var labels map[string]string
+		if err := json.Unmarshal(m.Labels, &labels); err != nil {
+			return nil, fmt.Errorf("invalid labels: %w", err)
+		}
+	}
+	query := rule.Query
+	id := m.ID
+	source := fmt.Sprintf("%d", id)
+	name := m.Name
+	datasource := "influxdb"
+	if query == "" {
+		datasource = "monitors"
+	}
+	alert, err := s.alertFor(m, source)
+	if err != nil {
+		return nil, err
+	}
+
+	mon := &alerts.Monitor{
+		Name:     name,
+		Source:   datasource,
+		Interval: interval,
+		For:      hold,
+		Align:    true,
+		// count the monitor as firing only where it's owned, so summing
+		// alerts_firing across instances counts each monitor once
+		Counts: func() bool { return s.members.Owns(name) },
+		Check: func(ctx context.Context) (bool, error) {
+			ok, err := rule.Check(ctx)
+			status := "ok"
+			switch {
+			case errors.Is(err, alerts.ErrSuppressed):
+				status = "suppressed"
+			case errors.Is(err, alerts.ErrUnknown):
+				status = "unknown"
+			case !ok:
+				status = "failed"
+			}
+			// NB: UpdateColumn leaves updated_at alone, which only moves
+			// when the monitor's definition changes
+			tx := s.db.Model(&db.Monitor{}).Where("id = ?", id).UpdateColumn("last_status", status)
+			if tx.Error != nil {
+				log.Printf("failed to record status of monitor %d: %v", id, tx.Error)
+			}
+			return ok, err
+		},
+		OnObserve: func(p alerts.Progress) {
+			tx := s.db.Model(&db.Monitor{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+				"state":         p.State.String(),
+				"failing_since": p.Since,
+				"failures":      p.Failures,
+			})
+			if tx.Error != nil {
+				log.Printf("failed to record state of monitor %d: %v", id, tx.Error)
+			}
+		},
+		Alert: alert,
+	}
+	mon.Gate = func() bool {
+		if !s.members.Owns(name) || !s.claim(id, interval) {
+			return false
+		}
+		// the monitor's last check may have been made by the instance
+		// that owned it before, so carry on from what that recorded
+		if err := s.restoreProgress(mon, id); err != nil {
+			log.Printf("failed to restore state of monitor %d: %v", id, err)
+		}
+		return true
+	}
+	return mon, nil
+}
+
+// alertFor returns an Alert that notifies each of a stored monitor's
+// channels, or just "events" if it doesn't name any.
+func (s *S) alertFor(m *db.Monitor, source string) (alerts.Alert, error) {
+	channels := []string{"events"}
+	if len(m.Channels) > 0 {
+		if err := json.Unmarshal(m.Channels, &channels); err != nil {
+			return nil, fmt.Errorf("invalid channels: %w", err)
+		}
+	}
+	var notify []alerts.Alert
+	for _, channel := range channels {
+		switch channel {
+		case "events":
+			notify = append(notify, alerts.Notify(channel, func(ctx context.Context, err error) error {
+				return s.recordEvent(source, err)
+			}))
+		case "log":
+			name := m.Name
+			notify = append(notify, alerts.Notify(channel, func(ctx context.Context, err error) error {
+				log.Printf("monitor %s alerted: %v", name, err)
+				return nil
+			}))
+		default:
+			return nil, fmt.Errorf("unknown channel %q, want events or log", channel)
+		}
+	}
+	return func(ctx context.Context, err error) {
+		for _, n := range notify {
+			n(ctx, err)
+		}
+	}, nil
+}
+
+// newRule builds the alerts.Rule a stored monitor checks every interval.
+func (s *S) newRule(m *db.Monitor, interval time.Duration) (*alerts.Rule, error) {
+	query, err := s.monitorQuery(m)
+	if err != nil {
+		return nil, err
+	}
+
+	cond := alerts.Fresh(interval)
+	if len(m.Condition) > 0 {
+		grow, err := s.growFor(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find grow: %w", err)
+		}
+		lights, err := s.lightsFor(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find light schedule: %w", err)
+		}
+		cond, err = alerts.ParseCondition(m.Condition, &alerts.Env{Grow: grow, Lights: lights, State: s.monitorState})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &alerts.Rule{
+		Source:    &alerts.Derived{Source: s.source, LeafOffset: m.LeafOffset},
+		Query:     query,
+		Condition: cond,
+	}, nil
+}
+
+// hasCheck reports whether a stored monitor has anything to check: a
+// query or template, or a condition on other monitors.
+func hasCheck(m *db.Monitor) bool {
+	return m.Query != "" || m.Template != "" || len(m.Condition) > 0
+}
+
+// monitorState returns a stored monitor's last recorded State. States are
+// read from the database because the monitor may run on another instance.
+func (s *S) monitorState(name string) (alerts.State, error) {
+	var m db.Monitor
+	tx := s.db.Where("name = ?", name).Limit(1).Find(&m)
+	if tx.Error != nil {
+		return alerts.StateOK, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return alerts.StateOK, fmt.Errorf("ErrUnknownMonitor: %q", name)
+	}
+	if m.State == "" {
+		return alerts.StateOK, nil
+	}
+	return alerts.ParseState(m.State)
+}
+
+// referrers returns the names of the stored monitors whose conditions
+// refer to the named monitor.
+func (s *S) referrers(name string) ([]string, error) {
+	var monitors []*db.Monitor
+	if tx := s.db.Where("condition IS NOT NULL").Find(&monitors); tx.Error != nil {
+		return nil, tx.Error
+	}
+	var names []string
+	for _, m := range monitors {
+		refs, _ := alerts.References(m.Condition)
+		for _, ref := range refs {
+			if ref == name && m.Name != name {
+				names = append(names, m.Name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// checkReferences makes sure the monitors a stored monitor's condition
+// refers to exist and don't refer back to it.
+func (s *S) checkReferences(m *db.Monitor) error {
+	var monitors []*db.Monitor
+	if tx := s.db.Find(&monitors); tx.Error != nil {
+		return tx.Error
+	}
+	deps := map[string][]string{}
+	for _, other := range monitors {
+		if other.ID == m.ID && m.ID != 0 {
+			continue
+		}
+		refs, err := alerts.References(other.Condition)
+		if len(other.Condition) == 0 || err != nil {
+			deps[other.Name] = nil
+			continue
+		}
+		deps[other.Name] = refs
+	}
+	if len(m.Condition) == 0 {
+		return nil
+	}
+	refs, err := alerts.References(m.Condition)
+	if err != nil {
+		return fmt.Errorf("invalid condition: %w", err)
+	}
+	for _, ref := range refs {
+		if _, ok := deps[ref]; !ok && ref != m.Name {
+			return fmt.Errorf("condition refers to unknown monitor %q", ref)
+		}
+	}
+	deps[m.Name] = refs
+	if cycle := alerts.FindCycle(deps); cycle != nil {
+		return fmt.Errorf("monitors refer to each other in a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// recordEvent logs a monitor's alert as an Event. Violations are kept
+// as the Event's payload, and sensor faults get their own Event kind.
+func (s *S) recordEvent(source string, err error) error {
+	event := &db.Event{
+		Kind:    "alert",
+		Message: "check failed",
+		Source:  source,
+	}
+	if err != nil {
+		event.Message = err.Error()
+	}
+	var v *alerts.Violation
+	if errors.As(err, &v) {
+		if v.Kind == alerts.KindSensorFault {
+			event.Kind = alerts.KindSensorFault
+		}
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		event.Payload = payload
+	}
+	return s.db.Create(event).Error
+}
+
+// datasourceChanged records a single Event when InfluxDB goes down and
+// another when it's back, however many instances noticed.
+func (s *S) datasourceChanged(err error) {
+	kind, message := "datasource_up", "datasource influxdb is back up"
+	if err != nil {
+		kind, message = "datasource_down", fmt.Sprintf("datasource influxdb is down: %v", err)
+	}
+	log.Print(message)
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('datasource influxdb'))").Error; err != nil {
+			return err
+		}
+		var last db.Event
+		found := tx.Where("kind IN ? AND source = ?", []string{"datasource_down", "datasource_up"}, "influxdb").
+			Order("id DESC").Limit(1).Find(&last)
+		if found.Error != nil {
+			return found.Error
+		}
+		// another instance already recorded it, or the datasource was never
+		// recorded as down
+		if last.Kind == kind || (found.RowsAffected == 0 && kind == "datasource_up") {
+			return nil
+		}
+		return tx.Create(&db.Event{Kind: kind, Message: message, Source: "influxdb"}).Error
+	})
+	if err != nil {
+		log.Printf("failed to record datasource event: %v", err)
+	}
+}
+
+// parseInterval returns how often a stored monitor should be checked.
+func parseInterval(m *db.Monitor) (time.Duration, error) {
+	if m.Interval == "" {
+		return defaultInterval, nil
+	}
+	d, err := time.ParseDuration(m.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval: %w", err)
+	}
+	if d < minInterval {
+		return 0, fmt.Errorf("interval %s is shorter than the minimum of %s", d, minInterval)
+	}
+	return d, nil
+}
+
+// parseFor returns how long a stored monitor's checks must fail before
+// it alerts.
+func parseFor(m *db.Monitor) (time.Duration, error) {
+	if m.For == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(m.For)
+	if err != nil {
+		return 0, fmt.Errorf("invalid for: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("for %s must not be negative", d)
+	}
+	return d, nil
+}
+
+// claim marks a monitor as checked now, unless another instance already
+// checked it within the last half interval. Shards can briefly disagree
+// while members join or leave, so this is what keeps a monitor from being
+// checked twice during a handoff. The new owner picks the monitor up on
+// its next tick, so a handoff delays a check by at most half an interval.
+func (s *S) claim(id uint, interval time.Duration) bool {
+	tx := s.db.Exec(`
+		UPDATE monitors SET last_checked = now()
+		WHERE id = ? AND (last_checked IS NULL OR last_checked <= now() - ? * interval '1 millisecond')`,
+		id, (interval / 2).Milliseconds())
+	if tx.Error != nil {
+		log.Printf("failed to claim monitor %d: %v", id, tx.Error)
+		return false
+	}
+	return tx.RowsAffected == 1
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+func TestHandoffProgress(t *testing.T) {
+	is := is.New(t)
+	a := testServer(t)
+	b := testInstance(a.db, "b") // a second instance on the same database
+
+	m := &db.Monitor{Name: "api", Query: `from(bucket: "growmon")`, Interval: "1m", For: "10m"}
+	is.NoErr(a.db.Create(m).Error)
+	// both instances load the monitor while it's ok
+	onA, err := a.newMonitor(m)
+	is.NoErr(err)
+	onB, err := b.newMonitor(m)
+	is.NoErr(err)
+
+	// a owns the monitor and records failing checks
+	since := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	onA.OnObserve(alerts.Progress{State: alerts.StateFiring, Since: since, Failures: 3})
+
+	// then the shard moves to b, which carries on from a's last check
+	// rather than what it loaded
+	is.NoErr(b.restoreProgress(onB, m.ID))
+	p := onB.Progress()
+	is.Equal(p.State, alerts.StateFiring)
+	is.True(p.Since.Equal(since))
+	is.Equal(p.Failures, 3)
+
+	// a's checks never touched the monitor's definition, so reconciling
+	// wouldn't have rebuilt it on b
+	var stored db.Monitor
+	is.NoErr(a.db.First(&stored, m.ID).Error)
+	is.True(stored.UpdatedAt.Equal(m.UpdatedAt))
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dylanlott/ubiquitous-disco/pkg/alerts"
+	"github.com/dylanlott/ubiquitous-disco/pkg/db"
+)
+
+// templateHandler declares the whole query template route. GET lists the
+// built-in templates along with the stored ones.
+func (s *S) templateHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var stored []*db.QueryTemplate
+		if tx := s.db.Find(&stored); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		templates := []*alerts.QueryTemplate{}
+		for _, t := range alerts.BuiltinTemplates {
+			templates = append(templates, t)
+		}
+		for _, t := range stored {
+			tmpl, err := toQueryTemplate(t)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("template %q: %s", t.Name, err), http.StatusInternalServerError)
+				return
+			}
+			templates = append(templates, tmpl)
+		}
+		json.NewEncoder(w).Encode(&templates)
+		return
+	case http.MethodPost, http.MethodPut:
+		t := &db.QueryTemplate{}
+		if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := alerts.BuiltinTemplates[t.Name]; ok {
+			http.Error(w, fmt.Sprintf("template name %q is reserved", t.Name), http.StatusBadRequest)
+			return
+		}
+		tmpl, err := toQueryTemplate(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			// NB: respect only route param id to prevent mismatched updates
+			id, err := routeID(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			t.ID = id
+
+			var old db.QueryTemplate
+			tx := s.db.Limit(1).Find(&old, id)
+			if tx.Error != nil {
+				http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+				return
+			}
+			if tx.RowsAffected == 1 {
+				var users int64
+				if tx := s.db.Model(&db.Monitor{}).Where("template = ?", old.Name).Count(&users); tx.Error != nil {
+					http.Error(w, tx.Error.Error(), http.StatusInternalServerError)
+					return
+				}
+				if users > 0 && old.Name != t.Name {
+					http.Error(w, fmt.Sprintf("template %q is used by %d monitors, so it can't be renamed", old.Name, users), http.StatusConflict)
+					return
+				}
+				if err := s.checkTemplateUsers(tmpl); err != nil {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+			}
+		}
+		if tx := s.db.Save(&t); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.touchTemplateUsers(t.Name); err != nil {
+			log.Printf("failed to touch monitors using template %q: %v", t.Name, err)
+		}
+		if err := s.reconcileMonitors(context.Background()); err != nil {
+			log.Printf("failed to reconcile monitors: %v", err)
+		}
+		json.NewEncoder(w).Encode(t)
+		return
+	case http.MethodDelete:
+		id, err := routeID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var t db.QueryTemplate
+		if tx := s.db.First(&t, id); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusNotFound)
+			return
+		}
+		var users int64
+		if tx := s.db.Model(&db.Monitor{}).Where("template = ?", t.Name).Count(&users); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		if users > 0 {
+			http.Error(w, fmt.Sprintf("template %q is used by %d monitors", t.Name, users), http.StatusConflict)
+			return
+		}
+		if tx := s.db.Delete(&db.QueryTemplate{}, id); tx.Error != nil {
+			http.Error(w, tx.Error.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// toQueryTemplate decodes and validates a stored query template.
+func toQueryTemplate(t *db.QueryTemplate) (*alerts.QueryTemplate, error) {
+	tmpl := &alerts.QueryTemplate{Name: t.Name, Text: t.Text}
+	if len(t.Params) > 0 {
+		if err := json.Unmarshal(t.Params, &tmpl.Params); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+	}
+	if err := tmpl.Validate(); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// checkTemplateUsers renders every stored monitor that uses a template
+// with its new definition, so that a change to the template can't break
+// them.
+func (s *S) checkTemplateUsers(tmpl *alerts.QueryTemplate) error {
+	var users []*db.Monitor
+	if tx := s.db.Where("template = ?", tmpl.Name).Find(&users); tx.Error != nil {
+		return tx.Error
+	}
+	for _, m := range users {
+		if _, err := s.renderTemplate(tmpl, m); err != nil {
+			return fmt.Errorf("monitor %q uses template %q: %w", m.Name, tmpl.Name, err)
+		}
+	}
+	return nil
+}
+
+// touchTemplateUsers moves updated_at on the monitors that use a template,
+// so that every instance rebuilds them with its new definition.
+func (s *S) touchTemplateUsers(name string) error {
+	return s.db.Model(&db.Monitor{}).Where("template = ?", name).Update("updated_at", time.Now()).Error
+}
+
+// monitorQuery returns the Flux a stored monitor runs: its Query, or its
+// Template rendered with its Params.
+func (s *S) monitorQuery(m *db.Monitor) (string, error) {
+	if m.Template == "" {
+		return m.Query, nil
+	}
+	if m.Query != "" {
+		return "", fmt.Errorf("monitor can have a query or a template, not both")
+	}
+
+	tmpl, ok := alerts.BuiltinTemplates[m.Template]
+	if !ok {
+		var t db.QueryTemplate
+		tx := s.db.Where("name = ?", m.Template).Limit(1).Find(&t)
+		if tx.Error != nil {
+			return "", tx.Error
+		}
+		if tx.RowsAffected == 0 {
+			return "", fmt.Errorf("unknown template %q", m.Template)
+		}
+		var err error
+		if tmpl, err = toQueryTemplate(&t); err != nil {
+			return "", fmt.Errorf("template %q: %w", m.Template, err)
+		}
+	}
+	return s.renderTemplate(tmpl, m)
+}
+
+// renderTemplate renders a template with a stored monitor's Params. A
+// template's device param defaults to the monitor's Device, and its
+// bucket param to INFLUX_BUCKET.
+func (s *S) renderTemplate(tmpl *alerts.QueryTemplate, m *db.Monitor) (string, error) {
+	values := map[string]json.RawMessage{}
+	if len(m.Params) > 0 {
+		if err := json.Unmarshal(m.Params, &values); err != nil {
+			return "", fmt.Errorf("invalid params: %w", err)
+		}
+	}
+	if _, ok := values["device"]; !ok && m.Device != "" {
+		for _, p := range tmpl.Params {
+			if p.Name == "device" {
+				device, _ := json.Marshal(m.Device)
+				values["device"] = device
+			}
+		}
+	}
+	if _, ok := values["bucket"]; !ok && s.influx != nil {
+		for _, p := range tmpl.Params {
+			if p.Name == "bucket" {
+				bucket, _ := json.Marshal(s.influx.Config().Bucket)
+				values["bucket"] = bucket
+			}
+		}
+	}
+	return tmpl.Render(values)
+}